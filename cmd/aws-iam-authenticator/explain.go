@@ -0,0 +1,128 @@
+/*
+Copyright 2017 by the contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"sigs.k8s.io/aws-iam-authenticator/pkg/server"
+)
+
+var explainCmd = &cobra.Command{
+	Use:   "explain",
+	Short: "Explain how a running server would map an IAM identity, for debugging purpose",
+	Long: `Asks the admin listener of a running server how it would map an ARN, as if
+it had presented a valid token. It shows which mapper matched, why the mappers
+before it didn't, and the resulting username and groups.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if explainARN == "" {
+			fmt.Fprintf(os.Stderr, "error: arn not specified\n")
+			cmd.Usage()
+			os.Exit(1)
+		}
+
+		query := url.Values{}
+		query.Set("arn", explainARN)
+		if explainUserID != "" {
+			query.Set("userId", explainUserID)
+		}
+		if explainSessionName != "" {
+			query.Set("sessionName", explainSessionName)
+		}
+		client := &http.Client{Timeout: 30 * time.Second}
+		resp, err := client.Get(strings.TrimSuffix(explainAdminURL, "/") + "/debug/explain?" + query.Encode())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not reach the admin listener: %v\n", err)
+			os.Exit(1)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not read response: %v\n", err)
+			os.Exit(1)
+		}
+		if resp.StatusCode != http.StatusOK {
+			fmt.Fprintf(os.Stderr, "admin listener returned %s: %s\n", resp.Status, strings.TrimSpace(string(body)))
+			os.Exit(1)
+		}
+
+		if explainOutput == "json" {
+			fmt.Printf("%s", body)
+			return
+		}
+		var explanation server.Explanation
+		if err := json.Unmarshal(body, &explanation); err != nil {
+			fmt.Fprintf(os.Stderr, "could not unmarshal response: %v\n", err)
+			os.Exit(1)
+		}
+		printExplanation(&explanation)
+	},
+}
+
+func printExplanation(e *server.Explanation) {
+	fmt.Printf("ARN:           %s\n", e.ARN)
+	fmt.Printf("Canonical ARN: %s\n", e.CanonicalARN)
+	fmt.Printf("Account ID:    %s\n", e.AccountID)
+	if e.UserID != "" {
+		fmt.Printf("User ID:       %s\n", e.UserID)
+	}
+	if e.SessionName != "" {
+		fmt.Printf("Session name:  %s\n", e.SessionName)
+	}
+	fmt.Printf("\nMappers:\n")
+	for _, step := range e.Steps {
+		fmt.Printf("  %s: %s", step.Mapper, step.Result)
+		if step.Entry != "" {
+			fmt.Printf(" %s (username %q, groups %q)", step.Entry, step.UsernameTemplate, step.GroupTemplates)
+		}
+		if step.Error != "" {
+			fmt.Printf(": %s", step.Error)
+		}
+		fmt.Printf("\n")
+	}
+	fmt.Printf("\n")
+	if e.Allowed {
+		fmt.Printf("Allowed by %s as username %q with groups %q\n", e.Mapper, e.Username, e.Groups)
+	} else {
+		fmt.Printf("Denied: %s\n", e.Reason)
+	}
+}
+
+var (
+	explainAdminURL    string
+	explainARN         string
+	explainUserID      string
+	explainSessionName string
+	explainOutput      string
+)
+
+func init() {
+	rootCmd.AddCommand(explainCmd)
+	explainCmd.Flags().StringVar(&explainAdminURL, "admin-url", "http://127.0.0.1:21363", "URL of the server's admin listener")
+	explainCmd.Flags().StringVar(&explainARN, "arn", "", "ARN of the identity, e.g. arn:aws:sts::123456789012:assumed-role/Admin/alice")
+	explainCmd.Flags().StringVar(&explainUserID, "user-id", "", "Unique ID of the user or role, e.g. AROAAAAAAAAAAAAAAAAAA")
+	explainCmd.Flags().StringVar(&explainSessionName, "session-name", "", "STS session name, defaults to the one in an assumed role ARN")
+	explainCmd.Flags().StringVarP(&explainOutput, "output", "o", "", "Output format. Only `json` is supported currently.")
+}
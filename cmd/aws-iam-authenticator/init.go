@@ -24,6 +24,7 @@ import (
 
 	"sigs.k8s.io/aws-iam-authenticator/pkg"
 	"sigs.k8s.io/aws-iam-authenticator/pkg/config"
+	"sigs.k8s.io/aws-iam-authenticator/pkg/config/kubeconfig"
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -51,6 +52,10 @@ var initCmd = &cobra.Command{
 
 			logrus.Infof("certificate generated at %s on kubernetes master node(s)", cfg.CertPath())
 			logrus.Infof("key generated at %s on kubernetes master node(s)", cfg.KeyPath())
+			if cfg.RequireClientCert && cfg.ClientCAFile == "" {
+				logrus.Infof("client certificate generated at %s on kubernetes master node(s)", cfg.ClientCertPath())
+				logrus.Infof("client key generated at %s on kubernetes master node(s)", cfg.ClientKeyPath())
+			}
 			logrus.Infof("kubeconfig generated at %s on kubernetes master node(s)", cfg.GenerateKubeconfigPath)
 		} else {
 			deprecatedCfg := cfg
@@ -62,16 +67,38 @@ var initCmd = &cobra.Command{
 				fmt.Fprintf(os.Stderr, "could not initialize: %v\n", err)
 				os.Exit(1)
 			}
+			if cfg.RequireClientCert && cfg.ClientCAFile == "" {
+				// the kubeconfig must reference the client certificate where
+				// it is copied to, not where it was generated
+				if err := writeDeprecatedKubeconfig(cfg, deprecatedCfg); err != nil {
+					fmt.Fprintf(os.Stderr, "could not initialize: %v\n", err)
+					os.Exit(1)
+				}
+			}
 
 			logrus.Infof("copy %s to %s on kubernetes master node(s)", deprecatedCfg.CertPath(), cfg.CertPath())
 			logrus.Infof("copy %s to %s on kubernetes master node(s)", deprecatedCfg.KeyPath(), cfg.KeyPath())
+			if cfg.RequireClientCert && cfg.ClientCAFile == "" {
+				logrus.Infof("copy %s to %s on kubernetes master node(s)", deprecatedCfg.ClientCertPath(), cfg.ClientCertPath())
+				logrus.Infof("copy %s to %s on kubernetes master node(s)", deprecatedCfg.ClientKeyPath(), cfg.ClientKeyPath())
+			}
 			logrus.Infof("copy %s to %s on kubernetes master node(s)", deprecatedCfg.GenerateKubeconfigPath, cfg.GenerateKubeconfigPath)
 		}
 
-		logrus.Infof("configure your apiserver with `--authentication-token-webhook-config-file=%s` to enable authentication with aws-iam-authenticator", cfg.GenerateKubeconfigPath)
+		logrus.Infof("configure your apiserver with `--authentication-token-webhook-config-file=%s --authentication-token-webhook-version=%s` to enable authentication with aws-iam-authenticator", cfg.GenerateKubeconfigPath, kubeconfig.WebhookVersion)
 	},
 }
 
+func writeDeprecatedKubeconfig(cfg, deprecatedCfg config.Config) error {
+	params, err := deprecatedCfg.WebhookKubeconfigParams()
+	if err != nil {
+		return err
+	}
+	params.ClientCertificatePath = cfg.ClientCertPath()
+	params.ClientKeyPath = cfg.ClientKeyPath()
+	return kubeconfig.WriteWebhookKubeconfig(params, deprecatedCfg.GenerateKubeconfigPath)
+}
+
 func init() {
 	initCmd.Flags().String(
 		"hostname",
@@ -20,11 +20,14 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"reflect"
+	"time"
 
 	"sigs.k8s.io/aws-iam-authenticator/pkg/config"
 	"sigs.k8s.io/aws-iam-authenticator/pkg/mapper"
 
 	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/mitchellh/mapstructure"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -89,7 +92,18 @@ func getConfig() (config.Config, error) {
 
 	cfg := config.Config{
 		PartitionID:                       viper.GetString("server.partition"),
+		AdditionalPartitionIDs:            viper.GetStringSlice("server.additionalPartitions"),
+		STSHostPatterns:                   viper.GetStringSlice("server.stsHostPatterns"),
+		STSHostRewrites:                   viper.GetStringMapString("server.stsHostRewrites"),
+		STSCABundle:                       viper.GetString("server.stsCABundle"),
+		STSProxyURL:                       viper.GetString("server.stsProxyURL"),
+		STSRetries:                        viper.GetInt("server.stsRetries"),
+		STSRetryBackoff:                   viper.GetDuration("server.stsRetryBackoff"),
+		STSCircuitBreakerThreshold:        viper.GetInt("server.stsCircuitBreakerThreshold"),
+		STSCircuitBreakerCooldown:         viper.GetDuration("server.stsCircuitBreakerCooldown"),
+		STSTimeout:                        viper.GetDuration("server.stsTimeout"),
 		ClusterID:                         viper.GetString("clusterID"),
+		AdditionalClusterIDs:              viper.GetStringSlice("server.additionalClusterIDs"),
 		ServerEC2DescribeInstancesRoleARN: viper.GetString("server.ec2DescribeInstancesRoleARN"),
 		SourceARN:                         viper.GetString("server.sourceARN"),
 		HostPort:                          viper.GetInt("server.port"),
@@ -103,6 +117,35 @@ func getConfig() (config.Config, error) {
 		BackendMode:                       viper.GetStringSlice("server.backendMode"),
 		EC2DescribeInstancesQps:           viper.GetInt("server.ec2DescribeInstancesQps"),
 		EC2DescribeInstancesBurst:         viper.GetInt("server.ec2DescribeInstancesBurst"),
+		EC2VerifyClusterMembership:        viper.GetBool("server.ec2VerifyClusterMembership"),
+		EC2ClusterTag:                     viper.GetString("server.ec2ClusterTag"),
+		AuthenticateMaxInFlight:           viper.GetInt("server.authenticateMaxInFlight"),
+		AuthenticateQps:                   viper.GetFloat64("server.authenticateQps"),
+		AuthenticateBurst:                 viper.GetInt("server.authenticateBurst"),
+		AuthenticateAccessKeyQps:          viper.GetFloat64("server.authenticateAccessKeyQps"),
+		AuthenticateAccessKeyBurst:        viper.GetInt("server.authenticateAccessKeyBurst"),
+		TokenCacheSize:                    viper.GetInt("server.tokenCacheSize"),
+		TokenCacheTTL:                     viper.GetDuration("server.tokenCacheTTL"),
+		TokenCacheNegativeTTL:             viper.GetDuration("server.tokenCacheNegativeTTL"),
+		TokenSingleUse:                    viper.GetBool("server.tokenSingleUse"),
+		TokenReplayGracePeriod:            viper.GetDuration("server.tokenReplayGracePeriod"),
+		TokenReplayDynamoDBTable:          viper.GetString("server.tokenReplayDynamoDBTable"),
+		AuditLogPath:                      viper.GetString("server.auditLogPath"),
+		AuditLogMaxSizeMB:                 viper.GetInt("server.auditLogMaxSizeMB"),
+		AuditLogMaxBackups:                viper.GetInt("server.auditLogMaxBackups"),
+		AuditWebhookURL:                   viper.GetString("server.auditWebhookURL"),
+		CertLifetime:                      viper.GetDuration("server.certLifetime"),
+		CertRotationOverlap:               viper.GetDuration("server.certRotationOverlap"),
+		RequireClientCert:                 viper.GetBool("server.requireClientCert"),
+		ClientCAFile:                      viper.GetString("server.clientCAFile"),
+		AllowedClientNames:                viper.GetStringSlice("server.allowedClientNames"),
+		AdminAddress:                      viper.GetString("server.adminAddress"),
+		AdminDebug:                        viper.GetBool("server.adminDebug"),
+		WaitForMapperSync:                 viper.GetBool("server.waitForMapperSync"),
+		MapperSyncTimeout:                 viper.GetDuration("server.mapperSyncTimeout"),
+		MappingExpiryWarning:              viper.GetDuration("server.mappingExpiryWarning"),
+		UIDTemplate:                       viper.GetString("server.uidTemplate"),
+		ExtraAttributes:                   viper.GetStringSlice("server.extraAttributes"),
 		ScrubbedAWSAccounts:               viper.GetStringSlice("server.scrubbedAccounts"),
 		//flags for dynamicfile mode
 		//DynamicFilePath: the file path containing the roleMapping and userMapping
@@ -112,15 +155,24 @@ func getConfig() (config.Config, error) {
 		//DynamicBackendModePath: the file path containing the backend mode
 		DynamicBackendModePath: viper.GetString("server.dynamicBackendModePath"),
 	}
-	if err := viper.UnmarshalKey("server.mapRoles", &cfg.RoleMappings); err != nil {
+	// notBefore and expiresAt are parsed from RFC 3339 strings
+	decodeTimes := viper.DecodeHook(mapstructure.ComposeDecodeHookFunc(
+		mapstructure.StringToTimeHookFunc(time.RFC3339),
+		mapstructure.StringToTimeDurationHookFunc(),
+		mapstructure.StringToSliceHookFunc(","),
+	))
+	if err := viper.UnmarshalKey("server.mapRoles", &cfg.RoleMappings, decodeTimes); err != nil {
 		return cfg, fmt.Errorf("invalid server role mappings: %v", err)
 	}
-	if err := viper.UnmarshalKey("server.mapUsers", &cfg.UserMappings); err != nil {
+	if err := viper.UnmarshalKey("server.mapUsers", &cfg.UserMappings, decodeTimes); err != nil {
 		logrus.WithError(err).Fatal("invalid server user mappings")
 	}
-	if err := viper.UnmarshalKey("server.mapAccounts", &cfg.AutoMappedAWSAccounts); err != nil {
+	if err := viper.UnmarshalKey("server.mapAccounts", &cfg.AutoMappedAWSAccounts, viper.DecodeHook(accountIDToAccountMappingHookFunc)); err != nil {
 		logrus.WithError(err).Fatal("invalid server account mappings")
 	}
+	if err := viper.UnmarshalKey("server.mapDenies", &cfg.DenyMappings); err != nil {
+		return cfg, fmt.Errorf("invalid server deny mappings: %v", err)
+	}
 	var reservedPrefixConfig []config.ReservedPrefixConfig
 	if err := viper.UnmarshalKey("server.reservedPrefixConfig", &reservedPrefixConfig); err != nil {
 		return cfg, fmt.Errorf("invalid reserved prefix config: %v", err)
@@ -131,6 +183,10 @@ func getConfig() (config.Config, error) {
 			cfg.ReservedPrefixConfig[c.BackendMode] = c
 		}
 	}
+	if cfg.ExtraAttributes == nil && viper.IsSet("server.extraAttributes") {
+		// an empty list returns no attributes, rather than the default ones
+		cfg.ExtraAttributes = []string{}
+	}
 	if featureGates.Enabled(config.SSORoleMatch) {
 		logrus.Info("SSORoleMatch feature enabled")
 		config.SSORoleMatchEnabled = true
@@ -149,8 +205,10 @@ func getConfig() (config.Config, error) {
 		partitionMap[p.ID()] = p
 		partitionKeys = append(partitionKeys, p.ID())
 	}
-	if _, ok := partitionMap[cfg.PartitionID]; !ok {
-		return cfg, errors.New("Invalid partition")
+	for _, partitionID := range cfg.PartitionIDs() {
+		if _, ok := partitionMap[partitionID]; !ok {
+			return cfg, fmt.Errorf("Invalid partition %q, must be one of: %v", partitionID, partitionKeys)
+		}
 	}
 
 	// DynamicFile BackendMode and DynamicFilePath are mutually inclusive.
@@ -174,6 +232,15 @@ func getConfig() (config.Config, error) {
 	return cfg, nil
 }
 
+// accountIDToAccountMappingHookFunc decodes mapAccounts entries that are just
+// an account ID, quoted or not, into an AccountMapping
+func accountIDToAccountMappingHookFunc(from reflect.Type, to reflect.Type, data interface{}) (interface{}, error) {
+	if to != reflect.TypeOf(config.AccountMapping{}) || from.Kind() == reflect.Map {
+		return data, nil
+	}
+	return map[string]interface{}{"account": data}, nil
+}
+
 func getLogFormatter() logrus.Formatter {
 	format, _ := rootCmd.PersistentFlags().GetString("log-format")
 
@@ -22,6 +22,7 @@ import (
 	"flag"
 	"fmt"
 	"strings"
+	"time"
 
 	"k8s.io/sample-controller/pkg/signals"
 	"sigs.k8s.io/aws-iam-authenticator/pkg"
@@ -39,9 +40,33 @@ import (
 const (
 	// DefaultPort is the default localhost port (chosen randomly).
 	DefaultPort = 21362
+	// DefaultAdminAddress is where the admin endpoints are served by default
+	DefaultAdminAddress = ":21363"
 	// Default Ec2 TPS Variables
 	DefaultEC2DescribeInstancesQps   = 15
 	DefaultEC2DescribeInstancesBurst = 5
+	// Default /authenticate rate limiting bursts, only used when the matching qps is set
+	DefaultAuthenticateBurst          = 100
+	DefaultAuthenticateAccessKeyBurst = 10
+	// Default verified-token cache TTLs, only used when the cache is enabled
+	DefaultTokenCacheTTL         = 5 * time.Minute
+	DefaultTokenCacheNegativeTTL = 10 * time.Second
+	// Default time a used token is accepted again, only used with --token-single-use
+	DefaultTokenReplayGracePeriod = 30 * time.Second
+	// Default audit log rotation
+	DefaultAuditLogMaxSizeMB  = 100
+	DefaultAuditLogMaxBackups = 5
+	// Default time to wait for the backend mappers to sync, only used with --wait-for-mapper-sync
+	DefaultMapperSyncTimeout = 5 * time.Minute
+	// Default time before they expire that mappings are reported as expiring soon
+	DefaultMappingExpiryWarning = 24 * time.Hour
+	// Default retries of, and circuit breakers for, failed STS calls
+	DefaultSTSRetries                 = 2
+	DefaultSTSRetryBackoff            = 100 * time.Millisecond
+	DefaultSTSCircuitBreakerThreshold = 10
+	DefaultSTSCircuitBreakerCooldown  = 30 * time.Second
+	// Default time spent calling STS for a token, well under the webhook timeout
+	DefaultSTSTimeout = 10 * time.Second
 )
 
 // serverCmd represents the server command
@@ -76,6 +101,56 @@ func init() {
 		fmt.Sprintf("The AWS partition. Must be one of: %v", partitionKeys))
 	viper.BindPFlag("server.partition", serverCmd.Flags().Lookup("partition"))
 
+	serverCmd.Flags().StringSlice("additional-partitions",
+		nil,
+		fmt.Sprintf("Other AWS partitions tokens are also accepted from, for clusters shared by identities of several partitions. Each must be one of: %v", partitionKeys))
+	viper.BindPFlag("server.additionalPartitions", serverCmd.Flags().Lookup("additional-partitions"))
+
+	serverCmd.Flags().StringSlice("sts-host-patterns",
+		nil,
+		"Hostname patterns of STS endpoints tokens are also accepted from, e.g. \"*.sts.us-east-1.vpce.amazonaws.com\". Wildcards are not allowed in the last two labels. Only patterns matching AWS hosts must be used.")
+	viper.BindPFlag("server.stsHostPatterns", serverCmd.Flags().Lookup("sts-host-patterns"))
+
+	serverCmd.Flags().StringToString("sts-host-rewrites",
+		nil,
+		"STS hosts tokens are signed for, and the `host=endpoint` called instead to verify them, e.g. a regional VPC endpoint.")
+	viper.BindPFlag("server.stsHostRewrites", serverCmd.Flags().Lookup("sts-host-rewrites"))
+
+	serverCmd.Flags().String("sts-ca-bundle",
+		"",
+		"PEM `file` of CAs trusted, in addition to the system ones, when calling STS.")
+	viper.BindPFlag("server.stsCABundle", serverCmd.Flags().Lookup("sts-ca-bundle"))
+
+	serverCmd.Flags().String("sts-proxy-url",
+		"",
+		"`URL` of the proxy STS is called through. Defaults to the HTTPS_PROXY environment variable.")
+	viper.BindPFlag("server.stsProxyURL", serverCmd.Flags().Lookup("sts-proxy-url"))
+
+	serverCmd.Flags().Int("sts-retries",
+		DefaultSTSRetries,
+		"Number of times a GetCallerIdentity call that failed to connect, or got a 5xx, is retried within --sts-timeout while the token is valid. 0 disables retries.")
+	viper.BindPFlag("server.stsRetries", serverCmd.Flags().Lookup("sts-retries"))
+
+	serverCmd.Flags().Duration("sts-retry-backoff",
+		DefaultSTSRetryBackoff,
+		"Maximum delay before the first STS retry, doubled for each following one. Delays are random up to that maximum.")
+	viper.BindPFlag("server.stsRetryBackoff", serverCmd.Flags().Lookup("sts-retry-backoff"))
+
+	serverCmd.Flags().Int("sts-circuit-breaker-threshold",
+		DefaultSTSCircuitBreakerThreshold,
+		"Number of failed calls in a row to an STS region after which calls to it fail immediately for the cooldown. 0 disables the circuit breakers.")
+	viper.BindPFlag("server.stsCircuitBreakerThreshold", serverCmd.Flags().Lookup("sts-circuit-breaker-threshold"))
+
+	serverCmd.Flags().Duration("sts-circuit-breaker-cooldown",
+		DefaultSTSCircuitBreakerCooldown,
+		"How long calls to an STS region fail immediately once its circuit breaker opens, before a single call probes it.")
+	viper.BindPFlag("server.stsCircuitBreakerCooldown", serverCmd.Flags().Lookup("sts-circuit-breaker-cooldown"))
+
+	serverCmd.Flags().Duration("sts-timeout",
+		DefaultSTSTimeout,
+		"Maximum time spent calling STS to verify a token, retries included. Keep it well under the API server's webhook timeout.")
+	viper.BindPFlag("server.stsTimeout", serverCmd.Flags().Lookup("sts-timeout"))
+
 	serverCmd.Flags().String("generate-kubeconfig",
 		"/etc/kubernetes/aws-iam-authenticator/kubeconfig.yaml",
 		"Output `path` where a generated webhook kubeconfig (for `--authentication-token-webhook-config-file`) will be stored.  When running as a container, this should be a hostPath mount and the API server must be able to access the file.")
@@ -91,6 +166,31 @@ func init() {
 		"State `directory` for generated certificate and private key.  When running as a container, this should be a hostPath mount so that the certificate and key persisted across resarts.")
 	viper.BindPFlag("server.stateDir", serverCmd.Flags().Lookup("state-dir"))
 
+	serverCmd.Flags().Duration("cert-lifetime",
+		0,
+		"Lifetime of the generated self-signed certificate. 0 uses the default of 100 years")
+	viper.BindPFlag("server.certLifetime", serverCmd.Flags().Lookup("cert-lifetime"))
+
+	serverCmd.Flags().Duration("cert-rotation-overlap",
+		0,
+		"How long before it expires the certificate is rotated. The next certificate is added to the webhook kubeconfig when the window starts and served from half way through it. 0 uses a quarter of --cert-lifetime")
+	viper.BindPFlag("server.certRotationOverlap", serverCmd.Flags().Lookup("cert-rotation-overlap"))
+
+	serverCmd.Flags().Bool("require-client-cert",
+		false,
+		"Only accept connections presenting a client certificate signed by --client-ca-file. Without --client-ca-file a client certificate is generated in --state-dir and referenced from the webhook kubeconfig")
+	viper.BindPFlag("server.requireClientCert", serverCmd.Flags().Lookup("require-client-cert"))
+
+	serverCmd.Flags().String("client-ca-file",
+		"",
+		"PEM bundle of CAs client certificates are verified against when --require-client-cert is set")
+	viper.BindPFlag("server.clientCAFile", serverCmd.Flags().Lookup("client-ca-file"))
+
+	serverCmd.Flags().StringSlice("allowed-client-names",
+		[]string{},
+		"Only accept client certificates with one of these names as CN or DNS SAN. Empty accepts any client certificate signed by the client CA")
+	viper.BindPFlag("server.allowedClientNames", serverCmd.Flags().Lookup("allowed-client-names"))
+
 	serverCmd.Flags().String("kubeconfig",
 		"",
 		"kubeconfig file path for using a local kubeconfig to configure the client to talk to the API server for CRD and EKSConfigMap backends.")
@@ -116,6 +216,18 @@ func init() {
 		"Port to bind the server to listen to")
 	viper.BindPFlag("server.port", serverCmd.Flags().Lookup("port"))
 
+	serverCmd.Flags().String(
+		"admin-address",
+		DefaultAdminAddress,
+		"Address to serve the unauthenticated health checks on: /healthz and /readyz. Empty disables the admin listener")
+	viper.BindPFlag("server.adminAddress", serverCmd.Flags().Lookup("admin-address"))
+
+	serverCmd.Flags().Bool(
+		"admin-debug",
+		false,
+		"Also serve /metrics, /debug/pprof, /debug/mappings and /debug/explain on the admin listener. They are unauthenticated, only enable them with --admin-address bound to a trusted address such as 127.0.0.1")
+	viper.BindPFlag("server.adminDebug", serverCmd.Flags().Lookup("admin-debug"))
+
 	serverCmd.Flags().Int(
 		"ec2-describeInstances-qps",
 		DefaultEC2DescribeInstancesQps,
@@ -127,6 +239,142 @@ func init() {
 		DefaultEC2DescribeInstancesBurst,
 		"AWS EC2 rate Limiting with burst")
 	viper.BindPFlag("server.ec2DescribeInstancesBurst", serverCmd.Flags().Lookup("ec2-describeInstances-burst"))
+	serverCmd.Flags().Bool(
+		"ec2-verify-cluster-membership",
+		false,
+		"Only map EC2 instances that are running and tagged as members of the cluster")
+	viper.BindPFlag("server.ec2VerifyClusterMembership", serverCmd.Flags().Lookup("ec2-verify-cluster-membership"))
+	serverCmd.Flags().String(
+		"ec2-cluster-tag",
+		"",
+		"Tag, as key or key=value, of the EC2 instances that are members of the cluster (default kubernetes.io/cluster/<cluster-id>)")
+	viper.BindPFlag("server.ec2ClusterTag", serverCmd.Flags().Lookup("ec2-cluster-tag"))
+
+	serverCmd.Flags().Int(
+		"authenticate-max-inflight",
+		0,
+		"Maximum number of /authenticate requests processed at once, requests over the limit are rejected with a 429. 0 disables the limit")
+	viper.BindPFlag("server.authenticateMaxInFlight", serverCmd.Flags().Lookup("authenticate-max-inflight"))
+
+	serverCmd.Flags().Float64(
+		"authenticate-qps",
+		0,
+		"Rate limit for /authenticate requests across all callers, applied before calling STS. 0 disables the limit")
+	viper.BindPFlag("server.authenticateQps", serverCmd.Flags().Lookup("authenticate-qps"))
+
+	serverCmd.Flags().Int(
+		"authenticate-burst",
+		DefaultAuthenticateBurst,
+		"Burst for the --authenticate-qps rate limit")
+	viper.BindPFlag("server.authenticateBurst", serverCmd.Flags().Lookup("authenticate-burst"))
+
+	serverCmd.Flags().Float64(
+		"authenticate-access-key-qps",
+		0,
+		"Rate limit for /authenticate requests per AWS Access Key ID, applied before calling STS. 0 disables the limit")
+	viper.BindPFlag("server.authenticateAccessKeyQps", serverCmd.Flags().Lookup("authenticate-access-key-qps"))
+
+	serverCmd.Flags().Int(
+		"authenticate-access-key-burst",
+		DefaultAuthenticateAccessKeyBurst,
+		"Burst for the --authenticate-access-key-qps rate limit")
+	viper.BindPFlag("server.authenticateAccessKeyBurst", serverCmd.Flags().Lookup("authenticate-access-key-burst"))
+
+	serverCmd.Flags().Int(
+		"token-cache-size",
+		0,
+		"Maximum number of verified tokens to cache in front of STS. 0 disables the cache")
+	viper.BindPFlag("server.tokenCacheSize", serverCmd.Flags().Lookup("token-cache-size"))
+
+	serverCmd.Flags().Duration(
+		"token-cache-ttl",
+		DefaultTokenCacheTTL,
+		"How long a verified token is cached. Tokens are never cached past their X-Amz-Expires, 60 seconds for those of aws-iam-authenticator token")
+	viper.BindPFlag("server.tokenCacheTTL", serverCmd.Flags().Lookup("token-cache-ttl"))
+
+	serverCmd.Flags().Duration(
+		"token-cache-negative-ttl",
+		DefaultTokenCacheNegativeTTL,
+		"How long a token rejected by STS is cached. 0 disables negative caching")
+	viper.BindPFlag("server.tokenCacheNegativeTTL", serverCmd.Flags().Lookup("token-cache-negative-ttl"))
+
+	serverCmd.Flags().Bool(
+		"token-single-use",
+		false,
+		"Reject tokens that were already accepted, once the replay grace period has passed")
+	viper.BindPFlag("server.tokenSingleUse", serverCmd.Flags().Lookup("token-single-use"))
+
+	serverCmd.Flags().Duration(
+		"token-replay-grace-period",
+		DefaultTokenReplayGracePeriod,
+		"How long after it was first accepted a single-use token is accepted again, e.g. when sent by several API servers")
+	viper.BindPFlag("server.tokenReplayGracePeriod", serverCmd.Flags().Lookup("token-replay-grace-period"))
+
+	serverCmd.Flags().String(
+		"token-replay-dynamodb-table",
+		"",
+		"DynamoDB `table` the used tokens are shared in between replicas. Empty keeps them in memory")
+	viper.BindPFlag("server.tokenReplayDynamoDBTable", serverCmd.Flags().Lookup("token-replay-dynamodb-table"))
+
+	serverCmd.Flags().String(
+		"audit-log-path",
+		"",
+		"File to append a JSON audit record to for every TokenReview. Empty disables the audit log")
+	viper.BindPFlag("server.auditLogPath", serverCmd.Flags().Lookup("audit-log-path"))
+
+	serverCmd.Flags().Int(
+		"audit-log-max-size",
+		DefaultAuditLogMaxSizeMB,
+		"Size in megabytes the audit log is rotated at. 0 disables rotation")
+	viper.BindPFlag("server.auditLogMaxSizeMB", serverCmd.Flags().Lookup("audit-log-max-size"))
+
+	serverCmd.Flags().Int(
+		"audit-log-max-backups",
+		DefaultAuditLogMaxBackups,
+		"Number of rotated audit logs to keep")
+	viper.BindPFlag("server.auditLogMaxBackups", serverCmd.Flags().Lookup("audit-log-max-backups"))
+
+	serverCmd.Flags().String(
+		"audit-webhook-url",
+		"",
+		"URL batches of JSON audit records are POSTed to. Empty disables the audit webhook")
+	viper.BindPFlag("server.auditWebhookURL", serverCmd.Flags().Lookup("audit-webhook-url"))
+
+	serverCmd.Flags().Bool(
+		"wait-for-mapper-sync",
+		false,
+		"Hold back serving /authenticate until every backend has loaded its mappings, so identities aren't denied while the backends are still syncing")
+	viper.BindPFlag("server.waitForMapperSync", serverCmd.Flags().Lookup("wait-for-mapper-sync"))
+
+	serverCmd.Flags().Duration(
+		"mapper-sync-timeout",
+		DefaultMapperSyncTimeout,
+		"How long --wait-for-mapper-sync waits for the backends to sync before serving anyway. 0 waits forever")
+	viper.BindPFlag("server.mapperSyncTimeout", serverCmd.Flags().Lookup("mapper-sync-timeout"))
+
+	serverCmd.Flags().Duration(
+		"mapping-expiry-warning",
+		DefaultMappingExpiryWarning,
+		"How long before their expiresAt mappings are logged and counted as expiring soon. 0 disables the check")
+	viper.BindPFlag("server.mappingExpiryWarning", serverCmd.Flags().Lookup("mapping-expiry-warning"))
+
+	serverCmd.Flags().StringSlice(
+		"additional-cluster-ids",
+		nil,
+		"Cluster IDs accepted in addition to --cluster-id, e.g. the previous one while clients move to a new cluster ID. Each is tried in turn with STS after --cluster-id, costing an extra STS call. At most 2 are accepted.")
+	viper.BindPFlag("server.additionalClusterIDs", serverCmd.Flags().Lookup("additional-cluster-ids"))
+
+	serverCmd.Flags().String(
+		"uid-template",
+		server.DefaultUIDTemplate,
+		"Template of the UID of authenticated users, with the same placeholders as usernames")
+	viper.BindPFlag("server.uidTemplate", serverCmd.Flags().Lookup("uid-template"))
+
+	serverCmd.Flags().StringSlice(
+		"extra-attributes",
+		server.DefaultExtraAttributes,
+		"Attributes of the identity and of its mapping returned as user extra, among arn, canonicalArn, sessionName, accessKeyId, principalId, sigs.k8s.io/aws-iam-authenticator/principalId, accountId, stsEndpoint, clusterId, mapper and mappingSource")
+	viper.BindPFlag("server.extraAttributes", serverCmd.Flags().Lookup("extra-attributes"))
 
 	fs := flag.NewFlagSet("", flag.ContinueOnError)
 	_ = fs.Parse([]string{})
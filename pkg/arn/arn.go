@@ -35,7 +35,7 @@ func Canonicalize(arn string) (PrincipalType, string, error) {
 		return NONE, "", fmt.Errorf("arn '%s' is invalid: '%v'", arn, err)
 	}
 
-	if err := checkPartition(parsed.Partition); err != nil {
+	if err := CheckPartition(parsed.Partition); err != nil {
 		return NONE, "", fmt.Errorf("arn '%s' does not have a recognized partition", arn)
 	}
 
@@ -80,7 +80,7 @@ func StripPath(arn string) (string, error) {
 		return "", fmt.Errorf("arn '%s' is invalid: '%v'", arn, err)
 	}
 
-	if err := checkPartition(parsed.Partition); err != nil {
+	if err := CheckPartition(parsed.Partition); err != nil {
 		return "", fmt.Errorf("arn '%s' does not have a recognized partition", arn)
 	}
 
@@ -100,7 +100,9 @@ func StripPath(arn string) (string, error) {
 	return arn, nil
 }
 
-func checkPartition(partition string) error {
+// CheckPartition returns an error if partition is not one of the AWS
+// partitions (e.g., "aws", "aws-cn" or "aws-us-gov")
+func CheckPartition(partition string) error {
 	for _, p := range endpoints.DefaultPartitions() {
 		if partition == p.ID() {
 			return nil
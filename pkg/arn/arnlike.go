@@ -32,27 +32,45 @@ func ArnLike(arn, pattern string) (bool, error) {
 	if err != nil {
 		return false, fmt.Errorf("Could not parse input arn: %v", err)
 	}
+	patternGlobs, err := compilePattern(pattern)
+	if err != nil {
+		return false, err
+	}
+
+	return matchSections(arnSections, patternGlobs), nil
+}
+
+// matchSections returns true if each section of the parsed ARN is matched by
+// the regular expression of the same section of a compiled pattern
+func matchSections(arnSections []string, patternGlobs []*regexp.Regexp) bool {
+	for index := range arnSections {
+		if !patternGlobs[index].MatchString(arnSections[index]) {
+			return false
+		}
+	}
+	return true
+}
+
+// compilePattern returns a regular expression for each section of pattern
+func compilePattern(pattern string) ([]*regexp.Regexp, error) {
 	patternSections, err := parse(pattern)
 	if err != nil {
-		return false, fmt.Errorf("Could not parse ArnLike string: %v", err)
+		return nil, fmt.Errorf("Could not parse ArnLike string: %v", err)
 	}
 
 	// Tidy regexp special characters. Escape the ones not used in ArnLike.
 	// Replace multiple * with .* - we're assuming `\` is not allowed in ARNs
 	preparePatternSections(patternSections)
 
-	for index := range arnSections {
-		patternGlob, err := regexp.Compile(patternSections[index])
+	globs := make([]*regexp.Regexp, len(patternSections))
+	for index, section := range patternSections {
+		patternGlob, err := regexp.Compile(section)
 		if err != nil {
-			return false, fmt.Errorf("Could not parse %s: %v", patternSections[index], err)
-		}
-
-		if !patternGlob.MatchString(arnSections[index]) {
-			return false, nil
+			return nil, fmt.Errorf("Could not parse %s: %v", section, err)
 		}
+		globs[index] = patternGlob
 	}
-
-	return true, nil
+	return globs, nil
 }
 
 // parse is a copy of arn.Parse from the AWS SDK but represents the ARN as []string
@@ -0,0 +1,95 @@
+package arn
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// IsPattern returns true if arn contains the * or ? wildcards of ArnLike
+func IsPattern(arn string) bool {
+	return strings.ContainsAny(arn, "*?")
+}
+
+// MoreSpecific returns true if pattern a is more specific than pattern b: it
+// has more characters that aren't wildcards, or as many and fewer * wildcards.
+// Patterns that are as specific as each other are ordered alphabetically, so
+// that the order is always the same.
+func MoreSpecific(a, b string) bool {
+	if literalsA, literalsB := literals(a), literals(b); literalsA != literalsB {
+		return literalsA > literalsB
+	}
+	if starsA, starsB := strings.Count(a, "*"), strings.Count(b, "*"); starsA != starsB {
+		return starsA < starsB
+	}
+	return a < b
+}
+
+// literals returns the number of characters of pattern that aren't wildcards
+func literals(pattern string) int {
+	return len(pattern) - strings.Count(pattern, "*") - strings.Count(pattern, "?")
+}
+
+// Patterns is a set of ArnLike patterns and the mapping of each. They are kept
+// from the most to the least specific, so that the mapping found for an ARN
+// doesn't depend on the order the patterns were added in, and compiled once
+// when added. The zero value is an empty set.
+type Patterns[T any] struct {
+	patterns []pattern[T]
+}
+
+type pattern[T any] struct {
+	pattern string
+	globs   []*regexp.Regexp
+	mapping T
+}
+
+// Add adds the mapping of pattern, replacing the mapping already added for the
+// same pattern. It returns an error if pattern is not a valid ArnLike pattern.
+func (p *Patterns[T]) Add(arnLike string, mapping T) error {
+	globs, err := compilePattern(arnLike)
+	if err != nil {
+		return err
+	}
+	i := sort.Search(len(p.patterns), func(i int) bool {
+		return !MoreSpecific(p.patterns[i].pattern, arnLike)
+	})
+	if i < len(p.patterns) && p.patterns[i].pattern == arnLike {
+		p.patterns[i].mapping = mapping
+		return nil
+	}
+	p.patterns = append(p.patterns, pattern[T]{})
+	copy(p.patterns[i+1:], p.patterns[i:])
+	p.patterns[i] = pattern[T]{pattern: arnLike, globs: globs, mapping: mapping}
+	return nil
+}
+
+// Find returns the mapping of the most specific pattern that matches arn and
+// for which ok, if not nil, returns true.
+func (p *Patterns[T]) Find(arn string, ok func(T) bool) (T, bool) {
+	var none T
+	if p == nil || len(p.patterns) == 0 {
+		return none, false
+	}
+	arnSections, err := parse(arn)
+	if err != nil {
+		return none, false
+	}
+	for _, pattern := range p.patterns {
+		if !matchSections(arnSections, pattern.globs) {
+			continue
+		}
+		if ok == nil || ok(pattern.mapping) {
+			return pattern.mapping, true
+		}
+	}
+	return none, false
+}
+
+// Len returns the number of patterns in the set
+func (p *Patterns[T]) Len() int {
+	if p == nil {
+		return 0
+	}
+	return len(p.patterns)
+}
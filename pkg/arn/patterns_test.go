@@ -0,0 +1,93 @@
+package arn
+
+import (
+	"testing"
+)
+
+func TestMoreSpecific(t *testing.T) {
+	tests := []struct {
+		a, b string
+	}{
+		{`arn:aws:iam::000000000000:role/eks-admin-*`, `arn:aws:iam::*:role/eks-admin-*`},
+		{`arn:aws:iam::*:role/eks-admin-?`, `arn:aws:iam::*:role/eks-admin-*`},
+		{`arn:aws:iam::*:role/eks-*-admin`, `arn:aws:iam::*:role/eks-*-*dmin`},
+		{`arn:aws:iam::*:role/a*`, `arn:aws:iam::*:role/b*`},
+	}
+	for _, tt := range tests {
+		if !MoreSpecific(tt.a, tt.b) {
+			t.Errorf("expected %s to be more specific than %s", tt.a, tt.b)
+		}
+		if MoreSpecific(tt.b, tt.a) {
+			t.Errorf("expected %s not to be more specific than %s", tt.b, tt.a)
+		}
+	}
+	if MoreSpecific(`arn:aws:iam::*:role/a*`, `arn:aws:iam::*:role/a*`) {
+		t.Errorf("expected a pattern not to be more specific than itself")
+	}
+}
+
+func TestPatternsFind(t *testing.T) {
+	patterns := []string{
+		`arn:aws:iam::*:role/*`,
+		`arn:aws:iam::000000000000:role/eks-admin-*`,
+		`arn:aws:iam::*:role/eks-admin-*`,
+		`arn:aws:iam::*:user/*`,
+	}
+	// the result mustn't depend on the order the patterns were added in
+	for _, order := range [][]int{{0, 1, 2, 3}, {3, 2, 1, 0}, {2, 0, 3, 1}} {
+		var p Patterns[string]
+		for _, i := range order {
+			if err := p.Add(patterns[i], patterns[i]); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		tests := []struct {
+			arn      string
+			ok       func(string) bool
+			expected string
+		}{
+			{`arn:aws:iam::000000000000:role/eks-admin-alice`, nil, patterns[1]},
+			{`arn:aws:iam::111122223333:role/eks-admin-alice`, nil, patterns[2]},
+			{`arn:aws:iam::111122223333:role/developer`, nil, patterns[0]},
+			{`arn:aws:iam::111122223333:user/alice`, nil, patterns[3]},
+			// ok skips the more specific patterns, e.g. when they've expired
+			{`arn:aws:iam::000000000000:role/eks-admin-alice`, func(s string) bool { return s != patterns[1] }, patterns[2]},
+		}
+		for _, tt := range tests {
+			if got, found := p.Find(tt.arn, tt.ok); !found || got != tt.expected {
+				t.Errorf("order %v: expected %s to match %s, got %s", order, tt.arn, tt.expected, got)
+			}
+		}
+		if got, found := p.Find(`arn:aws:sts::000000000000:federated-user/alice`, nil); found {
+			t.Errorf("order %v: expected no match, got %s", order, got)
+		}
+		if got, found := p.Find(`not an arn`, nil); found {
+			t.Errorf("order %v: expected no match, got %s", order, got)
+		}
+	}
+
+	var p Patterns[string]
+	p.Add(`arn:aws:iam::*:role/*`, "first")
+	p.Add(`arn:aws:iam::*:role/*`, "second")
+	if got, _ := p.Find(`arn:aws:iam::000000000000:role/a`, nil); got != "second" || p.Len() != 1 {
+		t.Errorf("expected the pattern to be replaced, got %s and %d patterns", got, p.Len())
+	}
+	if err := p.Add(`arn:aws`, "invalid"); err == nil {
+		t.Errorf("expected an error adding an invalid pattern")
+	}
+}
+
+func TestPatternsAddCompiles(t *testing.T) {
+	var p Patterns[string]
+	if err := p.Add(`arn:aws:iam::*:role/*`, "role"); err != nil {
+		t.Fatal(err)
+	}
+	// the compiled pattern is kept with its mapping, not in a global cache
+	if globs := p.patterns[0].globs; len(globs) != arnSectionsExpected {
+		t.Fatalf("expected %d compiled sections, got %d", arnSectionsExpected, len(globs))
+	}
+	if !matchSections([]string{"arn", "aws", "iam", "", "000000000000", "role/a"}, p.patterns[0].globs) {
+		t.Errorf("expected the compiled pattern to match")
+	}
+}
@@ -24,6 +24,7 @@ import (
 	"crypto/x509/pkix"
 	"encoding/base64"
 	"encoding/pem"
+	"fmt"
 	"math/big"
 	"net"
 	"os"
@@ -40,6 +41,14 @@ type CertificateOptions struct {
 	Lifetime time.Duration
 }
 
+// ClientCertificateOptions configures a self-signed client certificate
+type ClientCertificateOptions struct {
+	CertPath   string
+	KeyPath    string
+	CommonName string
+	Lifetime   time.Duration
+}
+
 func GetOrCreateX509KeyPair(opts CertificateOptions) (*tls.Certificate, error) {
 	// first try to load the existing keypair
 	cert, err := LoadX509KeyPair(opts.CertPath, opts.KeyPath)
@@ -51,10 +60,20 @@ func GetOrCreateX509KeyPair(opts CertificateOptions) (*tls.Certificate, error) {
 		return cert, nil
 	}
 
-	// generate a self-signed certificate and write out the certificate and private key
+	if err := CreateX509KeyPair(opts); err != nil {
+		return nil, err
+	}
+
+	newCert, err := tls.LoadX509KeyPair(opts.CertPath, opts.KeyPath)
+	return &newCert, err
+}
+
+// CreateX509KeyPair generates a self-signed certificate and writes out the
+// certificate and private key, replacing any existing files.
+func CreateX509KeyPair(opts CertificateOptions) error {
 	certBytes, keyBytes, err := selfSignedCertificate(opts.Address, opts.Hostname, opts.Lifetime)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	logrus.WithFields(logrus.Fields{
@@ -63,18 +82,75 @@ func GetOrCreateX509KeyPair(opts CertificateOptions) (*tls.Certificate, error) {
 	}).Info("saving new key and certificate")
 	err = dumpPEM(opts.CertPath, 0666, "CERTIFICATE", certBytes)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	err = dumpPEM(opts.KeyPath, 0600, "RSA PRIVATE KEY", keyBytes)
+	return dumpPEM(opts.KeyPath, 0600, "RSA PRIVATE KEY", keyBytes)
+}
+
+// GetOrCreateClientX509KeyPair loads the client certificate and private key,
+// generating a self-signed pair if they don't exist.
+func GetOrCreateClientX509KeyPair(opts ClientCertificateOptions) (*tls.Certificate, error) {
+	cert, err := LoadX509KeyPair(opts.CertPath, opts.KeyPath)
 	if err != nil {
 		return nil, err
 	}
+	if cert != nil {
+		return cert, nil
+	}
+
+	if err := CreateClientX509KeyPair(opts); err != nil {
+		return nil, err
+	}
 
 	newCert, err := tls.LoadX509KeyPair(opts.CertPath, opts.KeyPath)
 	return &newCert, err
 }
 
+// CreateClientX509KeyPair generates a self-signed client certificate and
+// writes out the certificate and private key, replacing any existing files.
+func CreateClientX509KeyPair(opts ClientCertificateOptions) error {
+	certBytes, keyBytes, err := selfSignedClientCertificate(opts.CommonName, opts.Lifetime)
+	if err != nil {
+		return err
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"certPath": opts.CertPath,
+		"keyPath":  opts.KeyPath,
+	}).Info("saving new client key and certificate")
+	if err := dumpPEM(opts.CertPath, 0666, "CERTIFICATE", certBytes); err != nil {
+		return err
+	}
+	return dumpPEM(opts.KeyPath, 0600, "RSA PRIVATE KEY", keyBytes)
+}
+
+// WriteCertificate writes a DER certificate to a pem file, replacing any
+// existing file.
+func WriteCertificate(certPath string, der []byte) error {
+	return dumpPEM(certPath, 0666, "CERTIFICATE", der)
+}
+
+// RenameX509KeyPair moves a certificate and private key to new paths,
+// replacing any existing files.
+func RenameX509KeyPair(fromCertPath, fromKeyPath, toCertPath, toKeyPath string) error {
+	if err := os.Rename(fromCertPath, toCertPath); err != nil {
+		return err
+	}
+	return os.Rename(fromKeyPath, toKeyPath)
+}
+
+// Leaf returns the parsed leaf certificate of cert.
+func Leaf(cert *tls.Certificate) (*x509.Certificate, error) {
+	if cert.Leaf != nil {
+		return cert.Leaf, nil
+	}
+	if len(cert.Certificate) == 0 {
+		return nil, fmt.Errorf("no certificate found")
+	}
+	return x509.ParseCertificate(cert.Certificate[0])
+}
+
 func LoadX509KeyPair(certPath, keyPath string) (*tls.Certificate, error) {
 	// if either file does not exist, we'll consider that not an error but
 	// return a nil
@@ -96,13 +172,24 @@ func LoadX509KeyPair(certPath, keyPath string) (*tls.Certificate, error) {
 	return &cert, nil
 }
 
+// dumpPEM writes a PEM block to a temporary file and renames it over
+// filename, so that a reader watching filename never sees a partial write.
 func dumpPEM(filename string, mode os.FileMode, blockType string, bytes []byte) error {
-	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	tmp := filename + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	return pem.Encode(f, &pem.Block{Type: blockType, Bytes: bytes})
+	if err := pem.Encode(f, &pem.Block{Type: blockType, Bytes: bytes}); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, filename)
 }
 
 func selfSignedCertificate(address, hostname string, lifetime time.Duration) ([]byte, []byte, error) {
@@ -112,7 +199,7 @@ func selfSignedCertificate(address, hostname string, lifetime time.Duration) ([]
 		return nil, nil, err
 	}
 
-	// choose a beginning and end for the cert's lifetime (currently ~infinite)
+	// choose a beginning and end for the cert's lifetime
 	notBefore := time.Now()
 	notAfter := notBefore.Add(lifetime)
 
@@ -165,11 +252,58 @@ func selfSignedCertificate(address, hostname string, lifetime time.Duration) ([]
 	return certBytes, keyBytes, nil
 }
 
+// selfSignedClientCertificate generates a self-signed certificate for client
+// authentication. Being self-signed, it is also the CA it is verified against.
+func selfSignedClientCertificate(commonName string, lifetime time.Duration) ([]byte, []byte, error) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	notBefore := time.Now()
+	notAfter := notBefore.Add(lifetime)
+
+	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
+	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template := x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			CommonName: commonName,
+		},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	certBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &privateKey.PublicKey, privateKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return certBytes, x509.MarshalPKCS1PrivateKey(privateKey), nil
+}
+
 // certToPEMBase64 returns the Base64 encoded PEM block for a given DER
 // certificate (i.e., it returns "Base64(PEM(asn1))").
 func CertToPEMBase64(der []byte) string {
-	return base64.StdEncoding.EncodeToString(pem.EncodeToMemory(&pem.Block{
-		Type:  "CERTIFICATE",
-		Bytes: der,
-	}))
+	return CertsToPEMBase64(der)
+}
+
+// CertsToPEMBase64 returns the Base64 encoded PEM bundle of the given DER
+// certificates, in order.
+func CertsToPEMBase64(ders ...[]byte) string {
+	var bundle []byte
+	for _, der := range ders {
+		bundle = append(bundle, pem.EncodeToMemory(&pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: der,
+		})...)
+	}
+	return base64.StdEncoding.EncodeToString(bundle)
 }
@@ -20,6 +20,8 @@ import (
 	"bytes"
 	"crypto/x509"
 	"net"
+	"os"
+	"path/filepath"
 	"sort"
 	"testing"
 	"time"
@@ -123,3 +125,43 @@ func TestSelfSignCert(t *testing.T) {
 		}
 	}
 }
+
+func TestCreateX509KeyPair(t *testing.T) {
+	dir := t.TempDir()
+	opts := CertificateOptions{
+		CertPath: filepath.Join(dir, "cert.pem"),
+		KeyPath:  filepath.Join(dir, "key.pem"),
+		Address:  "127.0.0.1",
+		Hostname: "localhost",
+		Lifetime: time.Hour,
+	}
+	if err := CreateX509KeyPair(opts); err != nil {
+		t.Fatalf("CreateX509KeyPair: %v", err)
+	}
+	cert, err := LoadX509KeyPair(opts.CertPath, opts.KeyPath)
+	if err != nil || cert == nil {
+		t.Fatalf("LoadX509KeyPair: %v", err)
+	}
+	leaf, err := Leaf(cert)
+	if err != nil {
+		t.Fatalf("Leaf: %v", err)
+	}
+	if lifetime := leaf.NotAfter.Sub(leaf.NotBefore); lifetime != time.Hour {
+		t.Errorf("expected a lifetime of 1h, got %s", lifetime)
+	}
+
+	// regenerating replaces the existing files
+	if err := CreateX509KeyPair(opts); err != nil {
+		t.Fatalf("CreateX509KeyPair: %v", err)
+	}
+	replaced, err := LoadX509KeyPair(opts.CertPath, opts.KeyPath)
+	if err != nil || replaced == nil {
+		t.Fatalf("LoadX509KeyPair: %v", err)
+	}
+	if bytes.Equal(cert.Certificate[0], replaced.Certificate[0]) {
+		t.Errorf("expected a new certificate")
+	}
+	if _, err := os.Stat(opts.CertPath + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("expected no temporary file to be left behind")
+	}
+}
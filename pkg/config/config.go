@@ -22,7 +22,9 @@ import (
 	"net"
 	"net/url"
 	"path/filepath"
+	"slices"
 	"strconv"
+	"time"
 
 	"sigs.k8s.io/aws-iam-authenticator/pkg/config/certs"
 	"sigs.k8s.io/aws-iam-authenticator/pkg/config/kubeconfig"
@@ -55,6 +57,11 @@ func (c *Config) GenerateFiles() error {
 	if err != nil {
 		return fmt.Errorf("could not load/generate a certificate")
 	}
+	if c.GeneratesClientCert() {
+		if _, err := c.GetOrCreateClientX509KeyPair(); err != nil {
+			return fmt.Errorf("could not load/generate a client certificate: %v", err)
+		}
+	}
 	err = c.GenerateWebhookKubeconfig()
 	if err != nil {
 		return fmt.Errorf("could not generate a webhook kubeconfig at %s: %v", c.GenerateKubeconfigPath, err)
@@ -63,22 +70,109 @@ func (c *Config) GenerateFiles() error {
 }
 
 func (c *Config) GenerateWebhookKubeconfig() error {
+	params, err := c.WebhookKubeconfigParams()
+	if err != nil {
+		return err
+	}
+	return kubeconfig.WriteWebhookKubeconfig(params, c.GenerateKubeconfigPath)
+}
+
+// WebhookKubeconfigParams returns the parameters of the webhook kubeconfig
+func (c *Config) WebhookKubeconfigParams() (kubeconfig.KubeconfigParams, error) {
+	caBundle, err := c.WebhookCABundle()
+	if err != nil {
+		return kubeconfig.KubeconfigParams{}, err
+	}
+
+	params := kubeconfig.KubeconfigParams{
+		ServerURL:                  c.ServerURL(),
+		CertificateAuthorityBase64: caBundle,
+	}
+	if c.GeneratesClientCert() {
+		// the API server authenticates with the client certificate we generated
+		params.ClientCertificatePath = c.ClientCertPath()
+		params.ClientKeyPath = c.ClientKeyPath()
+	}
+	return params, nil
+}
+
+// WebhookCABundle returns the Base64 encoded PEM bundle of CAs the webhook
+// kubeconfig trusts: the current certificate and, during a rotation, the
+// certificate that will replace it.
+func (c *Config) WebhookCABundle() (string, error) {
 	cert, err := certs.LoadX509KeyPair(c.CertPath(), c.KeyPath())
 	if err != nil {
-		return fmt.Errorf("failed to load an existing certificate: %v", err)
+		return "", fmt.Errorf("failed to load an existing certificate: %v", err)
+	}
+	if cert == nil {
+		return "", fmt.Errorf("failed to load an existing certificate: %s not found", c.CertPath())
 	}
+	ders := [][]byte{cert.Certificate[0]}
 
-	return kubeconfig.CreateWebhookKubeconfig(cert, c.GenerateKubeconfigPath, c.ServerURL())
+	next, err := certs.LoadX509KeyPair(c.NextCertPath(), c.NextKeyPath())
+	if err != nil {
+		return "", fmt.Errorf("failed to load the next certificate: %v", err)
+	}
+	if next != nil {
+		ders = append(ders, next.Certificate[0])
+	}
+	return certs.CertsToPEMBase64(ders...), nil
 }
 
 // CertPath returns the path to the pem file containing the certificate
 func (c *Config) CertPath() string {
-	return filepath.Join(c.StateDir, "cert.pem")
+	return filepath.Join(c.StateDir, certFilename)
 }
 
 // KeyPath returns the path to the pem file containing the private key
 func (c *Config) KeyPath() string {
-	return filepath.Join(c.StateDir, "key.pem")
+	return filepath.Join(c.StateDir, keyFilename)
+}
+
+// NextCertPath returns the path to the pem file containing the certificate
+// that will replace the current one during a rotation
+func (c *Config) NextCertPath() string {
+	return filepath.Join(c.StateDir, nextCertFilename)
+}
+
+// NextKeyPath returns the path to the pem file containing the private key
+// that will replace the current one during a rotation
+func (c *Config) NextKeyPath() string {
+	return filepath.Join(c.StateDir, nextKeyFilename)
+}
+
+// ClientCertPath returns the path to the pem file containing the client
+// certificate the API server authenticates with
+func (c *Config) ClientCertPath() string {
+	return filepath.Join(c.StateDir, clientCertFilename)
+}
+
+// ClientKeyPath returns the path to the pem file containing the private key
+// of the client certificate
+func (c *Config) ClientKeyPath() string {
+	return filepath.Join(c.StateDir, clientKeyFilename)
+}
+
+// PreviousClientCertPath returns the path to the pem file containing the
+// client certificate replaced by the last rotation
+func (c *Config) PreviousClientCertPath() string {
+	return filepath.Join(c.StateDir, previousClientCertFilename)
+}
+
+// ClientCAPaths returns the paths to the CA bundles client certificates are
+// verified against: ClientCAFile if set, otherwise the generated client
+// certificate, which is self-signed, and the one it replaced.
+func (c *Config) ClientCAPaths() []string {
+	if c.ClientCAFile != "" {
+		return []string{c.ClientCAFile}
+	}
+	return []string{c.ClientCertPath(), c.PreviousClientCertPath()}
+}
+
+// GeneratesClientCert returns true if the API server authenticates with a
+// client certificate generated, and rotated, by the authenticator
+func (c *Config) GeneratesClientCert() bool {
+	return c.RequireClientCert && c.ClientCAFile == ""
 }
 
 func (c *Config) CertOpts() certs.CertificateOptions {
@@ -87,11 +181,87 @@ func (c *Config) CertOpts() certs.CertificateOptions {
 		KeyPath:  c.KeyPath(),
 		Hostname: c.Hostname,
 		Address:  c.Address,
-		Lifetime: certLifetime,
+		Lifetime: c.CertLifetimeOrDefault(),
+	}
+}
+
+// NextCertOpts returns the options for the certificate that will replace the
+// current one during a rotation
+func (c *Config) NextCertOpts() certs.CertificateOptions {
+	opts := c.CertOpts()
+	opts.CertPath = c.NextCertPath()
+	opts.KeyPath = c.NextKeyPath()
+	return opts
+}
+
+// CertLifetimeOrDefault returns the lifetime of generated certificates
+func (c *Config) CertLifetimeOrDefault() time.Duration {
+	if c.CertLifetime > 0 {
+		return c.CertLifetime
+	}
+	return certLifetime
+}
+
+// CertRotationOverlapOrDefault returns how long before it expires the
+// certificate is rotated, a quarter of the lifetime unless configured.
+func (c *Config) CertRotationOverlapOrDefault() time.Duration {
+	if c.CertRotationOverlap > 0 {
+		return c.CertRotationOverlap
+	}
+	return c.CertLifetimeOrDefault() / 4
+}
+
+// EC2ClusterTagOrDefault returns the tag of the EC2 instances that are members
+// of the cluster
+func (c *Config) EC2ClusterTagOrDefault() string {
+	if c.EC2ClusterTag != "" {
+		return c.EC2ClusterTag
 	}
+	return "kubernetes.io/cluster/" + c.ClusterID
+}
+
+// ClusterIDs returns ClusterID followed by the AdditionalClusterIDs, without
+// duplicates.
+func (c *Config) ClusterIDs() []string {
+	clusterIDs := []string{c.ClusterID}
+	for _, clusterID := range c.AdditionalClusterIDs {
+		if clusterID != "" && !slices.Contains(clusterIDs, clusterID) {
+			clusterIDs = append(clusterIDs, clusterID)
+		}
+	}
+	return clusterIDs
+}
+
+// PartitionIDs returns PartitionID followed by the AdditionalPartitionIDs,
+// without duplicates.
+func (c *Config) PartitionIDs() []string {
+	partitionIDs := []string{c.PartitionID}
+	for _, partitionID := range c.AdditionalPartitionIDs {
+		if partitionID != "" && !slices.Contains(partitionIDs, partitionID) {
+			partitionIDs = append(partitionIDs, partitionID)
+		}
+	}
+	return partitionIDs
 }
 
 // GetOrCreateCertificate will create a certificate if it cannot find one based on the config
 func (c *Config) GetOrCreateX509KeyPair() (*tls.Certificate, error) {
 	return certs.GetOrCreateX509KeyPair(c.CertOpts())
 }
+
+// GetOrCreateClientX509KeyPair will create a client certificate for the API
+// server if it cannot find one based on the config
+func (c *Config) GetOrCreateClientX509KeyPair() (*tls.Certificate, error) {
+	return certs.GetOrCreateClientX509KeyPair(c.ClientCertOpts())
+}
+
+// ClientCertOpts returns the options for the client certificate the API
+// server authenticates with
+func (c *Config) ClientCertOpts() certs.ClientCertificateOptions {
+	return certs.ClientCertificateOptions{
+		CertPath:   c.ClientCertPath(),
+		KeyPath:    c.ClientKeyPath(),
+		CommonName: clientCertCommonName,
+		Lifetime:   c.CertLifetimeOrDefault(),
+	}
+}
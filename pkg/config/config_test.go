@@ -1,6 +1,7 @@
 package config
 
 import (
+	"reflect"
 	"testing"
 )
 
@@ -39,3 +40,65 @@ func TestServerUrl(t *testing.T) {
 		}
 	}
 }
+
+func TestWebhookKubeconfigParamsClientCert(t *testing.T) {
+	cfg := Config{
+		StateDir: t.TempDir(),
+		Hostname: "localhost",
+		Address:  "127.0.0.1",
+		HostPort: 21362,
+	}
+	if _, err := cfg.GetOrCreateX509KeyPair(); err != nil {
+		t.Fatal(err)
+	}
+
+	params, err := cfg.WebhookKubeconfigParams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params.ClientCertificatePath != "" || params.ClientKeyPath != "" {
+		t.Errorf("expected no client certificate without RequireClientCert, got %+v", params)
+	}
+
+	cfg.RequireClientCert = true
+	params, err = cfg.WebhookKubeconfigParams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params.ClientCertificatePath != cfg.ClientCertPath() || params.ClientKeyPath != cfg.ClientKeyPath() {
+		t.Errorf("expected the generated client certificate, got %+v", params)
+	}
+
+	// with a custom client CA the API server's client certificate isn't ours to reference
+	cfg.ClientCAFile = "/etc/kubernetes/pki/ca.crt"
+	params, err = cfg.WebhookKubeconfigParams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params.ClientCertificatePath != "" {
+		t.Errorf("expected no client certificate with a custom client CA, got %+v", params)
+	}
+}
+
+func TestClusterIDs(t *testing.T) {
+	tests := []struct {
+		config   Config
+		expected []string
+	}{
+		{
+			config:   Config{ClusterID: "new"},
+			expected: []string{"new"},
+		},
+		{
+			config:   Config{ClusterID: "new", AdditionalClusterIDs: []string{"old", "", "new", "old"}},
+			expected: []string{"new", "old"},
+		},
+	}
+
+	for _, test := range tests {
+		actual := test.config.ClusterIDs()
+		if !reflect.DeepEqual(actual, test.expected) {
+			t.Errorf("Expected %q, got %q", test.expected, actual)
+		}
+	}
+}
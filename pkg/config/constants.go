@@ -27,6 +27,26 @@ const (
 	// will be stored.
 	keyFilename = "key.pem"
 
-	// certLifetime is the lifetime of the CA certificate (100 years)
+	// nextCertFilename and nextKeyFilename are where the certificate and
+	// private key that will replace the current ones are stored during a
+	// rotation.
+	nextCertFilename = "next-cert.pem"
+	nextKeyFilename  = "next-key.pem"
+
+	// clientCertFilename and clientKeyFilename are where the client
+	// certificate the API server authenticates with, and its private key, are
+	// stored when mutual TLS is enabled.
+	clientCertFilename = "client-cert.pem"
+	clientKeyFilename  = "client-key.pem"
+
+	// previousClientCertFilename is where the client certificate replaced by
+	// the last rotation is kept, so that it is still trusted until the API
+	// server picks up the new one.
+	previousClientCertFilename = "previous-client-cert.pem"
+
+	// clientCertCommonName is the CN of the generated client certificate
+	clientCertCommonName = "aws-iam-authenticator-apiserver"
+
+	// certLifetime is the default lifetime of the CA certificate (100 years)
 	certLifetime = time.Hour * 24 * 365 * 100
 )
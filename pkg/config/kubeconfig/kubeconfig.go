@@ -26,20 +26,37 @@ import (
 	"sigs.k8s.io/aws-iam-authenticator/pkg/config/certs"
 )
 
+// WebhookVersion is the authentication.k8s.io version the API server should
+// use when sending TokenReviews (`--authentication-token-webhook-version`).
+// The server also still answers v1beta1 TokenReviews.
+const WebhookVersion = "v1"
+
 type KubeconfigParams struct {
 	ServerURL                  string
 	CertificateAuthorityBase64 string
 	Token                      string
+	WebhookVersion             string
+	// ClientCertificatePath and ClientKeyPath are the client certificate the
+	// API server authenticates to the webhook with, if mutual TLS is enabled
+	ClientCertificatePath string
+	ClientKeyPath         string
 }
 
 // CreateWebhookKubeconfig will create a kubeconfig for the webhook server
 func CreateWebhookKubeconfig(cert *tls.Certificate, kubeconfigPath, serverURL string) error {
-	logrus.WithField("kubeconfigPath", kubeconfigPath).Info("writing webhook kubeconfig file")
-
-	return KubeconfigParams{
+	return WriteWebhookKubeconfig(KubeconfigParams{
 		ServerURL:                  serverURL,
 		CertificateAuthorityBase64: certs.CertToPEMBase64(cert.Certificate[0]),
-	}.WriteKubeconfig(kubeconfigPath, webhookKubeconfigTemplate)
+	}, kubeconfigPath)
+}
+
+// WriteWebhookKubeconfig will create a kubeconfig for the webhook server from
+// the given params. WebhookVersion is always set to the current version.
+func WriteWebhookKubeconfig(params KubeconfigParams, kubeconfigPath string) error {
+	logrus.WithField("kubeconfigPath", kubeconfigPath).Info("writing webhook kubeconfig file")
+
+	params.WebhookVersion = WebhookVersion
+	return params.WriteKubeconfig(kubeconfigPath, webhookKubeconfigTemplate)
 }
 
 func (p KubeconfigParams) WriteKubeconfig(outputPath string, t *template.Template) error {
@@ -53,6 +70,7 @@ func (p KubeconfigParams) WriteKubeconfig(outputPath string, t *template.Templat
 
 var webhookKubeconfigTemplate = template.Must(
 	template.New("webhook.kubeconfig").Option("missingkey=error").Parse(`
+# use with --authentication-token-webhook-version={{.WebhookVersion}}
 clusters:
   - name: aws-iam-authenticator
     cluster:
@@ -61,6 +79,11 @@ clusters:
 # user refers to the API server client
 users:
   - name: apiserver
+{{- if .ClientCertificatePath}}
+    user:
+      client-certificate: {{.ClientCertificatePath}}
+      client-key: {{.ClientKeyPath}}
+{{- end}}
 current-context: webhook
 contexts:
 - name: webhook
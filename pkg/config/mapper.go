@@ -1,16 +1,25 @@
 package config
 
 import (
+	"encoding/json"
 	"fmt"
 	"regexp"
 	"strings"
+	"time"
 
 	"sigs.k8s.io/aws-iam-authenticator/pkg/arn"
+	"sigs.k8s.io/aws-iam-authenticator/pkg/template"
 	"sigs.k8s.io/aws-iam-authenticator/pkg/token"
 
 	"github.com/sirupsen/logrus"
 )
 
+var accountIDRegexp = regexp.MustCompile("^[0-9]{12}$")
+
+// DefaultAccountUsername is the username pattern of account mappings that
+// don't have one, identities keep their canonical ARN as username.
+const DefaultAccountUsername = "{{CanonicalARN}}"
+
 // SSOArnLike returns a string that can be passed to arnlike.ArnLike to
 // match canonicalized IAM Role ARNs against. Assumes Validate() has been called.
 func (m *RoleMapping) SSOArnLike() string {
@@ -18,8 +27,8 @@ func (m *RoleMapping) SSOArnLike() string {
 		return ""
 	}
 
-	var partition string
-	if m.SSO.Partition == "" {
+	partition := m.SSO.Partition
+	if partition == "" {
 		partition = "aws"
 	}
 
@@ -38,8 +47,11 @@ func (m *RoleMapping) Validate() error {
 		return fmt.Errorf("Only one of rolearn or SSO can be supplied")
 	}
 
+	if err := ValidateARNPattern(m.RoleARN); err != nil {
+		return err
+	}
+
 	if m.SSO != nil {
-		accountIDRegexp := regexp.MustCompile("^[0-9]{12}$")
 		if !accountIDRegexp.MatchString(m.SSO.AccountID) {
 			return fmt.Errorf("AccountID '%s' is not a valid AWS Account ID", m.SSO.AccountID)
 		}
@@ -50,12 +62,8 @@ func (m *RoleMapping) Validate() error {
 			return fmt.Errorf("PermissionSetName '%s' is not a valid AWS SSO PermissionSet Name", m.SSO.PermissionSetName)
 		}
 
-		switch m.SSO.Partition {
-		case "aws", "aws-cn", "aws-us-gov", "aws-iso", "aws-iso-b":
-			// valid
-		case "":
-			// treated as "aws"
-		default:
+		// "" is treated as "aws"
+		if m.SSO.Partition != "" && arn.CheckPartition(m.SSO.Partition) != nil {
 			return fmt.Errorf("Partition '%s' is not a valid AWS partition", m.SSO.Partition)
 		}
 
@@ -68,14 +76,20 @@ func (m *RoleMapping) Validate() error {
 		}
 	}
 
-	return nil
+	if err := ValidateActivePeriod(m.NotBefore, m.ExpiresAt); err != nil {
+		return err
+	}
+	if err := ValidateTemplates(m.Username, m.Groups); err != nil {
+		return err
+	}
+	return ValidateExtra(m.Extra)
 }
 
 // Matches returns true if the supplied ARN or SSO settings matches
 // this RoleMapping
 func (m *RoleMapping) Matches(subject string) bool {
 	if m.RoleARN != "" {
-		return strings.ToLower(m.RoleARN) == strings.ToLower(subject)
+		return matchesARN(m.RoleARN, subject)
 	}
 
 	// Assume the caller has called Validate(), which parses m.RoleARNLike
@@ -92,6 +106,19 @@ func (m *RoleMapping) Matches(subject string) bool {
 	return ok
 }
 
+// MatchEnabled returns false for SSO matchers unless the SSORoleMatch feature
+// is enabled. It is all that is left of Matches for a mapping already matched
+// by its Key() pattern, e.g. in an arn.Patterns.
+func (m *RoleMapping) MatchEnabled() bool {
+	return m.SSO == nil || SSORoleMatchEnabled
+}
+
+// IsActive returns true if the RoleMapping matches at now, between its
+// NotBefore and ExpiresAt
+func (m *RoleMapping) IsActive(now time.Time) bool {
+	return IsActive(m.NotBefore, m.ExpiresAt, now)
+}
+
 // Key returns RoleARN or SSOArnLike(), whichever is not empty.
 // Used to get a Key name for map[string]RoleMapping
 func (m *RoleMapping) Key() string {
@@ -101,12 +128,19 @@ func (m *RoleMapping) Key() string {
 	return m.SSOArnLike()
 }
 
-// IdentityMapping converts the RoleMapping into a generic IdentityMapping object
+// IdentityMapping converts the RoleMapping into a generic IdentityMapping object.
+// Its source is the key of the RoleMapping, or its UserId if it has no ARN.
 func (m *RoleMapping) IdentityMapping(identity *token.Identity) *IdentityMapping {
+	source := m.Key()
+	if source == "" {
+		source = m.UserId
+	}
 	return &IdentityMapping{
 		IdentityARN: strings.ToLower(identity.CanonicalARN),
 		Username:    m.Username,
 		Groups:      m.Groups,
+		Source:      source,
+		Extra:       m.Extra,
 	}
 }
 
@@ -120,12 +154,107 @@ func (m *UserMapping) Validate() error {
 		return fmt.Errorf("Value for userarn must be supplied")
 	}
 
+	if err := ValidateARNPattern(m.UserARN); err != nil {
+		return err
+	}
+
+	if err := ValidateActivePeriod(m.NotBefore, m.ExpiresAt); err != nil {
+		return err
+	}
+	if err := ValidateTemplates(m.Username, m.Groups); err != nil {
+		return err
+	}
+	return ValidateExtra(m.Extra)
+}
+
+// ValidateActivePeriod returns an error if a mapping expires before it starts
+// matching
+func ValidateActivePeriod(notBefore, expiresAt *time.Time) error {
+	if notBefore != nil && expiresAt != nil && !expiresAt.After(*notBefore) {
+		return fmt.Errorf("expiresAt %s must be after notBefore %s", expiresAt.Format(time.RFC3339), notBefore.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// IsActive returns false if a mapping with the given notBefore and expiresAt,
+// either of which may be nil, doesn't match at now
+func IsActive(notBefore, expiresAt *time.Time, now time.Time) bool {
+	if notBefore != nil && now.Before(*notBefore) {
+		return false
+	}
+	return expiresAt == nil || now.Before(*expiresAt)
+}
+
+// ValidateTemplates returns an error if the username or one of the groups
+// of a mapping is not a valid template
+func ValidateTemplates(username string, groups []string) error {
+	if err := template.Validate(username); err != nil {
+		return fmt.Errorf("invalid username template %q: %v", username, err)
+	}
+	for _, group := range groups {
+		if err := template.Validate(group); err != nil {
+			return fmt.Errorf("invalid group template %q: %v", group, err)
+		}
+	}
+	return nil
+}
+
+// ValidateExtra returns an error if a key of the extra of a mapping is empty,
+// or one of its values is not a valid template
+func ValidateExtra(extra map[string][]string) error {
+	for key, values := range extra {
+		if key == "" {
+			return fmt.Errorf("extra keys must not be empty")
+		}
+		for _, value := range values {
+			if err := template.Validate(value); err != nil {
+				return fmt.Errorf("invalid extra %q template %q: %v", key, value, err)
+			}
+		}
+	}
 	return nil
 }
 
 // Matches returns true if the supplied ARN string matche this UserMapping
 func (m *UserMapping) Matches(subject string) bool {
-	return strings.ToLower(m.UserARN) == strings.ToLower(subject)
+	return matchesARN(m.UserARN, subject)
+}
+
+// matchesARN returns true if subject is mappingARN, or matches it if it is
+// an ArnLike pattern with * and ? wildcards. Both are compared lowercase.
+func matchesARN(mappingARN, subject string) bool {
+	mappingARN, subject = strings.ToLower(mappingARN), strings.ToLower(subject)
+	if !arn.IsPattern(mappingARN) {
+		return mappingARN == subject
+	}
+	// subject comes from STS, an error means it can't match
+	ok, _ := arn.ArnLike(subject, mappingARN)
+	return ok
+}
+
+// ValidateARNPattern returns an error if the ARN of a role or user mapping is
+// an ArnLike pattern that can't be parsed
+func ValidateARNPattern(mappingARN string) error {
+	if !arn.IsPattern(mappingARN) {
+		return nil
+	}
+	return validateArnLike(mappingARN)
+}
+
+// validateArnLike returns an error if mappingARN is not an ArnLike pattern,
+// with or without wildcards
+func validateArnLike(mappingARN string) error {
+	// matching a valid ARN catches patterns ArnLike can't parse
+	if _, err := arn.ArnLike("arn:aws:iam::000000000000:role/Validate", strings.ToLower(mappingARN)); err != nil {
+		return fmt.Errorf("ARN '%s' is not valid: %v", mappingARN, err)
+	}
+	return nil
+}
+
+// IsActive returns true if the UserMapping matches at now, between its
+// NotBefore and ExpiresAt
+func (m *UserMapping) IsActive(now time.Time) bool {
+	return IsActive(m.NotBefore, m.ExpiresAt, now)
 }
 
 // Key returns UserARN.
@@ -134,11 +263,211 @@ func (m *UserMapping) Key() string {
 	return m.UserARN
 }
 
-// IdentityMapping converts the UserMapping into a generic IdentityMapping object
+// IdentityMapping converts the UserMapping into a generic IdentityMapping object.
+// Its source is the key of the UserMapping, or its UserId if it has no ARN.
 func (m *UserMapping) IdentityMapping(identity *token.Identity) *IdentityMapping {
+	source := m.Key()
+	if source == "" {
+		source = m.UserId
+	}
 	return &IdentityMapping{
 		IdentityARN: strings.ToLower(identity.CanonicalARN),
 		Username:    m.Username,
 		Groups:      m.Groups,
+		Source:      source,
+		Extra:       m.Extra,
+	}
+}
+
+// Validate returns an error if the AccountMapping is not valid after being unmarshaled
+func (m *AccountMapping) Validate() error {
+	if m == nil {
+		return fmt.Errorf("AccountMapping is nil")
 	}
+
+	if m.AccountID == "" {
+		return fmt.Errorf("Value for account must be supplied")
+	}
+	if err := ValidateTemplates(m.Username, m.Groups); err != nil {
+		return err
+	}
+	return ValidateExtra(m.Extra)
+}
+
+// Key returns AccountID.
+// Used to get a Key name for map[string]AccountMapping
+func (m *AccountMapping) Key() string {
+	return m.AccountID
+}
+
+// IdentityMapping converts the AccountMapping into a generic IdentityMapping
+// object, with the default username pattern if it doesn't have one
+func (m *AccountMapping) IdentityMapping(identity *token.Identity) *IdentityMapping {
+	username := m.Username
+	if username == "" {
+		username = DefaultAccountUsername
+	}
+	return &IdentityMapping{
+		IdentityARN: strings.ToLower(identity.CanonicalARN),
+		Username:    username,
+		Groups:      m.Groups,
+		Source:      m.AccountID,
+		Extra:       m.Extra,
+	}
+}
+
+// isAccountID returns true if the AccountMapping only has an account ID, so
+// that it can be written as a string
+func (m *AccountMapping) isAccountID() bool {
+	return m.Username == "" && len(m.Groups) == 0 && len(m.Extra) == 0
+}
+
+// accountMapping has the fields of AccountMapping without its marshaling methods
+type accountMapping AccountMapping
+
+// UnmarshalJSON accepts either an account ID or an object.
+func (m *AccountMapping) UnmarshalJSON(data []byte) error {
+	var accountID string
+	if err := json.Unmarshal(data, &accountID); err == nil {
+		*m = AccountMapping{AccountID: accountID}
+		return nil
+	}
+	return json.Unmarshal(data, (*accountMapping)(m))
+}
+
+// MarshalJSON writes account mappings with neither a username, groups nor
+// extra as just the account ID, the way they were written before they could
+// have any.
+func (m AccountMapping) MarshalJSON() ([]byte, error) {
+	if m.isAccountID() {
+		return json.Marshal(m.AccountID)
+	}
+	return json.Marshal(accountMapping(m))
+}
+
+// UnmarshalYAML accepts either an account ID or a mapping.
+func (m *AccountMapping) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var accountID string
+	if err := unmarshal(&accountID); err == nil {
+		*m = AccountMapping{AccountID: accountID}
+		return nil
+	}
+	return unmarshal((*accountMapping)(m))
+}
+
+// MarshalYAML writes account mappings with neither a username, groups nor
+// extra as just the account ID.
+func (m AccountMapping) MarshalYAML() (interface{}, error) {
+	if m.isAccountID() {
+		return m.AccountID, nil
+	}
+	return accountMapping(m), nil
+}
+
+// Validate returns an error if the DenyMapping is not valid after being unmarshaled
+func (m *DenyMapping) Validate() error {
+	if m == nil {
+		return fmt.Errorf("DenyMapping is nil")
+	}
+
+	set := 0
+	for _, value := range []string{m.ARN, m.AccountID, m.AccessKeyID} {
+		if value != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		return fmt.Errorf("Exactly one of arn, accountID or accessKeyID must be supplied")
+	}
+
+	if m.AccountID != "" && !accountIDRegexp.MatchString(m.AccountID) {
+		return fmt.Errorf("AccountID '%s' is not a valid AWS Account ID", m.AccountID)
+	}
+	if m.ARN != "" {
+		return validateArnLike(m.ARN)
+	}
+	return nil
+}
+
+// Matches returns true if the identity is denied by this DenyMapping
+func (m *DenyMapping) Matches(identity *token.Identity) bool {
+	switch {
+	case m.AccountID != "":
+		return m.AccountID == identity.AccountID
+	case m.AccessKeyID != "":
+		return m.AccessKeyID == identity.AccessKeyID
+	case m.ARN != "":
+		return matchesARN(m.ARN, identity.CanonicalARN) || matchesARN(m.ARN, identity.ARN)
+	}
+	return false
+}
+
+// Key returns the ARN, AccountID or AccessKeyID of the DenyMapping, whichever
+// is not empty.
+func (m *DenyMapping) Key() string {
+	switch {
+	case m.AccountID != "":
+		return m.AccountID
+	case m.AccessKeyID != "":
+		return m.AccessKeyID
+	}
+	return strings.ToLower(m.ARN)
+}
+
+// DenyMatcher matches identities against a set of deny mappings. Their ARN
+// patterns are compiled when they are added rather than for each identity.
+// The zero value matches nothing.
+type DenyMatcher struct {
+	mappings []DenyMapping
+	// arns are the indexes in mappings of the deny mappings with an ARN,
+	// keyed by the lowercase ARN
+	arns arn.Patterns[int]
+}
+
+// NewDenyMatcher returns a DenyMatcher for mappings, or an error if one of
+// them has an invalid ARN.
+func NewDenyMatcher(mappings []DenyMapping) (DenyMatcher, error) {
+	var d DenyMatcher
+	for _, m := range mappings {
+		if err := d.Add(m); err != nil {
+			return DenyMatcher{}, err
+		}
+	}
+	return d, nil
+}
+
+// Add adds a deny mapping. It returns an error if its ARN is not a valid
+// ArnLike pattern.
+func (d *DenyMatcher) Add(m DenyMapping) error {
+	if m.ARN != "" {
+		if err := d.arns.Add(strings.ToLower(m.ARN), len(d.mappings)); err != nil {
+			return fmt.Errorf("ARN '%s' is not valid: %v", m.ARN, err)
+		}
+	}
+	d.mappings = append(d.mappings, m)
+	return nil
+}
+
+// Match returns the deny mapping that matches identity, or nil. Like
+// DenyMapping.Matches, ARNs are matched against both the canonical ARN and
+// the ARN of identity.
+func (d *DenyMatcher) Match(identity *token.Identity) *DenyMapping {
+	for i := range d.mappings {
+		m := &d.mappings[i]
+		if (m.AccountID != "" && m.AccountID == identity.AccountID) ||
+			(m.AccessKeyID != "" && m.AccessKeyID == identity.AccessKeyID) {
+			return m
+		}
+	}
+	for _, subject := range []string{identity.CanonicalARN, identity.ARN} {
+		if i, ok := d.arns.Find(strings.ToLower(subject), nil); ok {
+			return &d.mappings[i]
+		}
+	}
+	return nil
+}
+
+// Mappings returns the deny mappings, in the order they were added
+func (d *DenyMatcher) Mappings() []DenyMapping {
+	return d.mappings
 }
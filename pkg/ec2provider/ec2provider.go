@@ -43,15 +43,44 @@ const (
 	headerSourceAccount = "x-amz-source-account"
 )
 
-// Get a node name from instance ID
+// Get a node name, or other details, from instance ID
 type EC2Provider interface {
 	GetPrivateDNSName(string) (string, error)
+	GetInstance(string) (*Instance, error)
 	StartEc2DescribeBatchProcessing()
 }
 
-type ec2PrivateDNSCache struct {
-	cache map[string]string
-	lock  sync.RWMutex
+// Instance is what is cached about an EC2 instance
+type Instance struct {
+	PrivateDNSName string
+	InstanceType   string
+	// State is the name of the instance state, e.g. running or terminated
+	State string
+	Tags  map[string]string
+}
+
+func newInstance(instance *ec2.Instance) *Instance {
+	tags := make(map[string]string, len(instance.Tags))
+	for _, tag := range instance.Tags {
+		tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+	var state string
+	if instance.State != nil {
+		state = aws.StringValue(instance.State.Name)
+	}
+	return &Instance{
+		PrivateDNSName: aws.StringValue(instance.PrivateDnsName),
+		InstanceType:   aws.StringValue(instance.InstanceType),
+		State:          state,
+		Tags:           tags,
+	}
+}
+
+type ec2InstanceCache struct {
+	cache map[string]*Instance
+	// describedAt is when each instance in cache was described
+	describedAt map[string]time.Time
+	lock        sync.RWMutex
 }
 
 type ec2Requests struct {
@@ -61,15 +90,16 @@ type ec2Requests struct {
 
 type ec2ProviderImpl struct {
 	ec2                ec2iface.EC2API
-	privateDNSCache    ec2PrivateDNSCache
+	instanceCache      ec2InstanceCache
 	ec2Requests        ec2Requests
 	instanceIdsChannel chan string
 }
 
 func New(roleARN, sourceARN, region string, qps int, burst int) EC2Provider {
-	dnsCache := ec2PrivateDNSCache{
-		cache: make(map[string]string),
-		lock:  sync.RWMutex{},
+	instanceCache := ec2InstanceCache{
+		cache:       make(map[string]*Instance),
+		describedAt: make(map[string]time.Time),
+		lock:        sync.RWMutex{},
 	}
 	ec2Requests := ec2Requests{
 		set:  make(map[string]bool),
@@ -77,7 +107,7 @@ func New(roleARN, sourceARN, region string, qps int, burst int) EC2Provider {
 	}
 	return &ec2ProviderImpl{
 		ec2:                ec2.New(newSession(roleARN, sourceARN, region, qps, burst)),
-		privateDNSCache:    dnsCache,
+		instanceCache:      instanceCache,
 		ec2Requests:        ec2Requests,
 		instanceIdsChannel: make(chan string, maxChannelSize),
 	}
@@ -121,10 +151,24 @@ func newSession(roleARN, sourceARN, region string, qps int, burst int) *session.
 	return sess
 }
 
-func (p *ec2ProviderImpl) setPrivateDNSNameCache(id string, privateDNSName string) {
-	p.privateDNSCache.lock.Lock()
-	defer p.privateDNSCache.lock.Unlock()
-	p.privateDNSCache.cache[id] = privateDNSName
+func (p *ec2ProviderImpl) setInstanceCache(id string, instance *Instance) {
+	p.instanceCache.lock.Lock()
+	defer p.instanceCache.lock.Unlock()
+	p.instanceCache.cache[id] = instance
+	p.instanceCache.describedAt[id] = time.Now()
+}
+
+// getInstanceNewerThan is GetInstance, but describes the instance again if it
+// was cached more than maxAge ago, for the fields that change over the life of
+// an instance, like State and Tags.
+func (p *ec2ProviderImpl) getInstanceNewerThan(id string, maxAge time.Duration) (*Instance, error) {
+	p.instanceCache.lock.Lock()
+	if describedAt, ok := p.instanceCache.describedAt[id]; ok && time.Since(describedAt) > maxAge {
+		delete(p.instanceCache.cache, id)
+		delete(p.instanceCache.describedAt, id)
+	}
+	p.instanceCache.lock.Unlock()
+	return p.GetInstance(id)
 }
 
 func (p *ec2ProviderImpl) setRequestInFlightForInstanceId(id string) {
@@ -153,22 +197,34 @@ func (p *ec2ProviderImpl) getRequestInFlightSize() int {
 	return length
 }
 
-// GetPrivateDNS looks up the private DNS from the EC2 API
-func (p *ec2ProviderImpl) getPrivateDNSNameCache(id string) (string, error) {
-	p.privateDNSCache.lock.RLock()
-	defer p.privateDNSCache.lock.RUnlock()
-	name, ok := p.privateDNSCache.cache[id]
+func (p *ec2ProviderImpl) getInstanceCache(id string) (*Instance, error) {
+	p.instanceCache.lock.RLock()
+	defer p.instanceCache.lock.RUnlock()
+	instance, ok := p.instanceCache.cache[id]
 	if ok {
-		return name, nil
+		return instance, nil
 	}
-	return "", errors.New("instance id not found")
+	return nil, errors.New("instance id not found")
 }
 
-// Only calls API if its not in the cache
+// GetPrivateDNSName looks up the private DNS from the EC2 API
 func (p *ec2ProviderImpl) GetPrivateDNSName(id string) (string, error) {
-	privateDNSName, err := p.getPrivateDNSNameCache(id)
+	instance, err := p.GetInstance(id)
+	if err != nil {
+		return "", err
+	}
+	if instance.PrivateDNSName == "" {
+		return "", fmt.Errorf("failed to find node %s ", id)
+	}
+	return instance.PrivateDNSName, nil
+}
+
+// GetInstance looks up the instance from the EC2 API. Only calls API if its
+// not in the cache
+func (p *ec2ProviderImpl) GetInstance(id string) (*Instance, error) {
+	instance, err := p.getInstanceCache(id)
 	if err == nil {
-		return privateDNSName, nil
+		return instance, nil
 	}
 	logrus.Debugf("Missed the cache for the InstanceId = %s Verifying if its already in requestQueue ", id)
 	// check if the request for instanceId already in queue.
@@ -176,12 +232,12 @@ func (p *ec2ProviderImpl) GetPrivateDNSName(id string) (string, error) {
 		logrus.Debugf("Found the InstanceId:= %s request In Queue waiting in 5 seconds loop ", id)
 		for i := 0; i < totalIterationForWaitInterval; i++ {
 			time.Sleep(defaultWaitInterval)
-			privateDNSName, err := p.getPrivateDNSNameCache(id)
+			instance, err := p.getInstanceCache(id)
 			if err == nil {
-				return privateDNSName, nil
+				return instance, nil
 			}
 		}
-		return "", fmt.Errorf("failed to find node %s in PrivateDNSNameCache returning from loop", id)
+		return nil, fmt.Errorf("failed to find node %s in instance cache returning from loop", id)
 	}
 	logrus.Debugf("Missed the requestQueue cache for the InstanceId = %s", id)
 	p.setRequestInFlightForInstanceId(id)
@@ -191,33 +247,35 @@ func (p *ec2ProviderImpl) GetPrivateDNSName(id string) (string, error) {
 	if requestQueueLength > maxAllowedInflightRequest {
 		logrus.Debugf("Writing to buffered channel for instance Id %s ", id)
 		p.instanceIdsChannel <- id
-		return p.GetPrivateDNSName(id)
+		return p.GetInstance(id)
 	}
 
 	logrus.Infof("Calling ec2:DescribeInstances for the InstanceId = %s ", id)
 	metrics.Get().EC2DescribeInstanceCallCount.Inc()
 	// Look up instance from EC2 API
+	start := time.Now()
 	output, err := p.ec2.DescribeInstances(&ec2.DescribeInstancesInput{
 		InstanceIds: aws.StringSlice([]string{id}),
 	})
+	metrics.Get().EC2DescribeInstancesLatency.Observe(time.Since(start).Seconds())
 	if err != nil {
 		p.unsetRequestInFlightForInstanceId(id)
-		return "", fmt.Errorf("failed querying private DNS from EC2 API for node %s: %s ", id, err.Error())
+		return nil, fmt.Errorf("failed querying private DNS from EC2 API for node %s: %s ", id, err.Error())
 	}
 	for _, reservation := range output.Reservations {
-		for _, instance := range reservation.Instances {
-			if aws.StringValue(instance.InstanceId) == id {
-				privateDNSName = aws.StringValue(instance.PrivateDnsName)
-				p.setPrivateDNSNameCache(id, privateDNSName)
+		for _, ec2Instance := range reservation.Instances {
+			if aws.StringValue(ec2Instance.InstanceId) == id {
+				instance = newInstance(ec2Instance)
+				p.setInstanceCache(id, instance)
 				p.unsetRequestInFlightForInstanceId(id)
 			}
 		}
 	}
 
-	if privateDNSName == "" {
-		return "", fmt.Errorf("failed to find node %s ", id)
+	if instance == nil {
+		return nil, fmt.Errorf("failed to find node %s ", id)
 	}
-	return privateDNSName, nil
+	return instance, nil
 }
 
 func (p *ec2ProviderImpl) StartEc2DescribeBatchProcessing() {
@@ -258,9 +316,11 @@ func (p *ec2ProviderImpl) getPrivateDnsAndPublishToCache(instanceIdList []string
 	// Look up instance from EC2 API
 	logrus.Infof("Making Batch Query to DescribeInstances for %v instances ", len(instanceIdList))
 	metrics.Get().EC2DescribeInstanceCallCount.Inc()
+	start := time.Now()
 	output, err := p.ec2.DescribeInstances(&ec2.DescribeInstancesInput{
 		InstanceIds: aws.StringSlice(instanceIdList),
 	})
+	metrics.Get().EC2DescribeInstancesLatency.Observe(time.Since(start).Seconds())
 	if err != nil {
 		logrus.Errorf("Batch call failed querying private DNS from EC2 API for nodes [%s] : with error = []%s ", instanceIdList, err.Error())
 	} else {
@@ -272,9 +332,7 @@ func (p *ec2ProviderImpl) getPrivateDnsAndPublishToCache(instanceIdList []string
 		// Adding the result to privateDNSChache as well as removing from the requestQueueMap.
 		for _, reservation := range output.Reservations {
 			for _, instance := range reservation.Instances {
-				id := aws.StringValue(instance.InstanceId)
-				privateDNSName := aws.StringValue(instance.PrivateDnsName)
-				p.setPrivateDNSNameCache(id, privateDNSName)
+				p.setInstanceCache(aws.StringValue(instance.InstanceId), newInstance(instance))
 			}
 		}
 	}
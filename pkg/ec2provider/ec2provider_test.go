@@ -1,6 +1,7 @@
 package ec2provider
 
 import (
+	"reflect"
 	"strconv"
 	"sync"
 	"testing"
@@ -45,9 +46,10 @@ func (c *mockEc2Client) DescribeInstances(in *ec2.DescribeInstancesInput) (*ec2.
 }
 
 func newMockedEC2ProviderImpl() *ec2ProviderImpl {
-	dnsCache := ec2PrivateDNSCache{
-		cache: make(map[string]string),
-		lock:  sync.RWMutex{},
+	instanceCache := ec2InstanceCache{
+		cache:       make(map[string]*Instance),
+		describedAt: make(map[string]time.Time),
+		lock:        sync.RWMutex{},
 	}
 	ec2Requests := ec2Requests{
 		set:  make(map[string]bool),
@@ -55,7 +57,7 @@ func newMockedEC2ProviderImpl() *ec2ProviderImpl {
 	}
 	return &ec2ProviderImpl{
 		ec2:                &mockEc2Client{},
-		privateDNSCache:    dnsCache,
+		instanceCache:      instanceCache,
 		ec2Requests:        ec2Requests,
 		instanceIdsChannel: make(chan string, maxChannelSize),
 	}
@@ -76,6 +78,108 @@ func TestGetPrivateDNSName(t *testing.T) {
 	}
 }
 
+func TestGetInstance(t *testing.T) {
+	metrics.InitMetrics(prometheus.NewRegistry())
+	ec2Provider := newMockedEC2ProviderImpl()
+	ec2Provider.ec2 = &mockEc2Client{Reservations: prepareSingleInstanceOutput()}
+	go ec2Provider.StartEc2DescribeBatchProcessing()
+	instance, err := ec2Provider.GetInstance("ec2-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := &Instance{
+		PrivateDNSName: "ec2-dns-1",
+		InstanceType:   "m5.large",
+		Tags:           map[string]string{"team": "payments"},
+	}
+	if !reflect.DeepEqual(instance, expected) {
+		t.Errorf("want: %+v, got: %+v", expected, instance)
+	}
+	// the private DNS name comes from the cached instance
+	dnsName, err := ec2Provider.GetPrivateDNSName("ec2-1")
+	if err != nil || dnsName != "ec2-dns-1" {
+		t.Errorf("want: %v, got: %v (%v)", "ec2-dns-1", dnsName, err)
+	}
+	if _, err := ec2Provider.GetInstance("ec2-2"); err == nil {
+		t.Errorf("expected an error for an unknown instance")
+	}
+}
+
+func TestClusterMemberProvider(t *testing.T) {
+	metrics.InitMetrics(prometheus.NewRegistry())
+	instance := func(id, state string, tags ...*ec2.Tag) *ec2.Instance {
+		return &ec2.Instance{
+			InstanceId:     aws.String(id),
+			PrivateDnsName: aws.String(id + ".ec2.internal"),
+			State:          &ec2.InstanceState{Name: aws.String(state)},
+			Tags:           tags,
+		}
+	}
+	clusterTag := &ec2.Tag{Key: aws.String("kubernetes.io/cluster/test"), Value: aws.String("owned")}
+	otherTag := &ec2.Tag{Key: aws.String("kubernetes.io/cluster/other"), Value: aws.String("owned")}
+	ec2Provider := newMockedEC2ProviderImpl()
+	ec2Provider.ec2 = &mockEc2Client{Reservations: []*ec2.Reservation{{Instances: []*ec2.Instance{
+		instance("member", ec2.InstanceStateNameRunning, clusterTag),
+		instance("stopped", ec2.InstanceStateNameStopped, clusterTag),
+		instance("other", ec2.InstanceStateNameRunning, otherTag),
+	}}}}
+	go ec2Provider.StartEc2DescribeBatchProcessing()
+
+	tests := []struct {
+		tag     string
+		id      string
+		wantErr bool
+	}{
+		{"kubernetes.io/cluster/test", "member", false},
+		{"kubernetes.io/cluster/test=owned", "member", false},
+		{"kubernetes.io/cluster/test=shared", "member", true},
+		{"kubernetes.io/cluster/test", "stopped", true},
+		{"kubernetes.io/cluster/test", "other", true},
+		{"kubernetes.io/cluster/test", "unknown", true},
+	}
+	for _, tc := range tests {
+		provider := NewClusterMemberProvider(ec2Provider, tc.tag)
+		dnsName, err := provider.GetPrivateDNSName(tc.id)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s with tag %s: want error %v, got %v", tc.id, tc.tag, tc.wantErr, err)
+		}
+		if !tc.wantErr && dnsName != tc.id+".ec2.internal" {
+			t.Errorf("%s: want: %v, got: %v", tc.id, tc.id+".ec2.internal", dnsName)
+		}
+	}
+}
+
+func TestClusterMemberProviderStateChange(t *testing.T) {
+	metrics.InitMetrics(prometheus.NewRegistry())
+	member := &ec2.Instance{
+		InstanceId:     aws.String("member"),
+		PrivateDnsName: aws.String("member.ec2.internal"),
+		State:          &ec2.InstanceState{Name: aws.String(ec2.InstanceStateNameRunning)},
+		Tags:           []*ec2.Tag{{Key: aws.String("kubernetes.io/cluster/test"), Value: aws.String("owned")}},
+	}
+	ec2Provider := newMockedEC2ProviderImpl()
+	ec2Provider.ec2 = &mockEc2Client{Reservations: []*ec2.Reservation{{Instances: []*ec2.Instance{member}}}}
+	go ec2Provider.StartEc2DescribeBatchProcessing()
+	provider := NewClusterMemberProvider(ec2Provider, "kubernetes.io/cluster/test").(*clusterMemberProvider)
+
+	if _, err := provider.GetInstance("member"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	member.State = &ec2.InstanceState{Name: aws.String(ec2.InstanceStateNameStopping)}
+
+	// the cached instance is trusted until it is older than maxAge
+	if _, err := provider.GetInstance("member"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	provider.maxAge = 0
+	if _, err := provider.GetInstance("member"); err == nil {
+		t.Errorf("expected an error once the instance is stopping")
+	}
+	if _, err := provider.GetPrivateDNSName("member"); err == nil {
+		t.Errorf("expected an error looking up the private DNS name of a stopping instance")
+	}
+}
+
 func prepareSingleInstanceOutput() []*ec2.Reservation {
 	reservations := []*ec2.Reservation{
 		{
@@ -84,6 +188,8 @@ func prepareSingleInstanceOutput() []*ec2.Reservation {
 				&ec2.Instance{
 					InstanceId:     aws.String("ec2-1"),
 					PrivateDnsName: aws.String("ec2-dns-1"),
+					InstanceType:   aws.String("m5.large"),
+					Tags:           []*ec2.Tag{{Key: aws.String("team"), Value: aws.String("payments")}},
 				},
 			},
 			OwnerId:       nil,
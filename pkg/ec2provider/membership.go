@@ -0,0 +1,72 @@
+package ec2provider
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// membershipMaxAge is how long a cached instance is trusted to be running and
+// tagged before it is described again
+const membershipMaxAge = time.Minute
+
+// instanceRefresher is implemented by the providers that cache instances
+type instanceRefresher interface {
+	getInstanceNewerThan(id string, maxAge time.Duration) (*Instance, error)
+}
+
+// clusterMemberProvider only returns instances that are running and tagged as
+// members of the cluster, so that an instance of another cluster sharing the
+// node role can't be mapped to a node of this one.
+type clusterMemberProvider struct {
+	EC2Provider
+	tag      string
+	tagKey   string
+	tagValue string
+	// maxAge is how old the cached instance checked can be
+	maxAge time.Duration
+}
+
+// NewClusterMemberProvider wraps provider so that looking up an instance fails
+// unless it is running and carries tag. tag is either a key, e.g.
+// kubernetes.io/cluster/<ClusterID>, which matches any value, or key=value.
+// The instances are cached by provider, and only described again once they
+// have been cached for a minute, so that an instance that was stopped or
+// untagged stops being mapped soon after.
+func NewClusterMemberProvider(provider EC2Provider, tag string) EC2Provider {
+	p := &clusterMemberProvider{EC2Provider: provider, tag: tag, tagKey: tag, maxAge: membershipMaxAge}
+	if i := strings.Index(tag, "="); i >= 0 {
+		p.tagKey, p.tagValue = tag[:i], tag[i+1:]
+	}
+	return p
+}
+
+func (p *clusterMemberProvider) GetInstance(id string) (*Instance, error) {
+	var instance *Instance
+	var err error
+	if refresher, ok := p.EC2Provider.(instanceRefresher); ok {
+		instance, err = refresher.getInstanceNewerThan(id, p.maxAge)
+	} else {
+		instance, err = p.EC2Provider.GetInstance(id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if instance.State != ec2.InstanceStateNameRunning {
+		return nil, fmt.Errorf("instance %s is %s, not running", id, instance.State)
+	}
+	value, ok := instance.Tags[p.tagKey]
+	if !ok || (p.tagValue != "" && value != p.tagValue) {
+		return nil, fmt.Errorf("instance %s is not tagged %s", id, p.tag)
+	}
+	return instance, nil
+}
+
+func (p *clusterMemberProvider) GetPrivateDNSName(id string) (string, error) {
+	if _, err := p.GetInstance(id); err != nil {
+		return "", err
+	}
+	return p.EC2Provider.GetPrivateDNSName(id)
+}
@@ -108,6 +108,10 @@ func (cli *client) add(role *config.RoleMapping, user *config.UserMapping) (cm *
 		if err != nil {
 			return err
 		}
+		// the deny mappings aren't changed here, keep them as they are
+		if denyData, ok := cm.Data["mapDenies"]; ok {
+			data["mapDenies"] = denyData
+		}
 
 		cm.Data = data
 
@@ -12,6 +12,7 @@ import (
 	"github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v2"
 	core_v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/fields"
 	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
@@ -20,17 +21,30 @@ import (
 	v1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/tools/clientcmd"
 
+	"sigs.k8s.io/aws-iam-authenticator/pkg/arn"
 	"sigs.k8s.io/aws-iam-authenticator/pkg/config"
+	"sigs.k8s.io/aws-iam-authenticator/pkg/mapper"
 	"sigs.k8s.io/aws-iam-authenticator/pkg/metrics"
+	"sigs.k8s.io/aws-iam-authenticator/pkg/template"
+	"sigs.k8s.io/aws-iam-authenticator/pkg/token"
 )
 
 type MapStore struct {
 	mutex sync.RWMutex
 	users map[string]config.UserMapping
 	roles map[string]config.RoleMapping
-	// Used as set.
-	awsAccounts map[string]interface{}
-	configMap   v1.ConfigMapInterface
+	// rolePatterns and userPatterns are the mappings with an ARN pattern or
+	// SSO matcher, the others are looked up in roles and users
+	rolePatterns arn.Patterns[config.RoleMapping]
+	userPatterns arn.Patterns[config.UserMapping]
+	// Keyed by account ID.
+	awsAccounts map[string]config.AccountMapping
+	denies      config.DenyMatcher
+	// templates are the parsed templates of the mappings
+	templates template.Set
+	configMap v1.ConfigMapInterface
+	// synced is set once the aws-auth configmap has been loaded
+	synced bool
 }
 
 func New(masterURL, kubeConfig string) (*MapStore, error) {
@@ -61,6 +75,14 @@ func (ms *MapStore) startLoadConfigMap(stopCh <-chan struct{}) {
 				logrus.Info("stopCh is closed in startLoadConfigMap")
 				return
 			default:
+				if !ms.HasSynced() {
+					if err := ms.loadConfigMap(); err != nil {
+						logrus.Errorf("Unable to load configmap: %v, sleeping for 5 seconds.", err)
+						metrics.Get().ConfigMapWatchFailures.Inc()
+						time.Sleep(5 * time.Second)
+						continue
+					}
+				}
 				watcher, err := ms.configMap.Watch(context.TODO(), metav1.ListOptions{
 					Watch:         true,
 					FieldSelector: fields.OneTermEqualSelector("metadata.name", "aws-auth").String(),
@@ -80,8 +102,8 @@ func (ms *MapStore) startLoadConfigMap(stopCh <-chan struct{}) {
 						logrus.Info("Resetting configmap on delete")
 						userMappings := make([]config.UserMapping, 0)
 						roleMappings := make([]config.RoleMapping, 0)
-						awsAccounts := make([]string, 0)
-						ms.saveMap(userMappings, roleMappings, awsAccounts)
+						awsAccounts := make([]config.AccountMapping, 0)
+						ms.saveMap(userMappings, roleMappings, awsAccounts, config.DenyMatcher{})
 					case watch.Added, watch.Modified:
 						switch cm := r.Object.(type) {
 						case *core_v1.ConfigMap:
@@ -89,13 +111,8 @@ func (ms *MapStore) startLoadConfigMap(stopCh <-chan struct{}) {
 								break
 							}
 							logrus.Info("Received aws-auth watch event")
-							userMappings, roleMappings, awsAccounts, err := ParseMap(cm.Data)
-							if err != nil {
-								logrus.Errorf("There was an error parsing the config maps.  Only saving data that was good, %+v", err)
-							}
-							ms.saveMap(userMappings, roleMappings, awsAccounts)
-							if err != nil {
-								logrus.Error(err)
+							if err := ms.updateMap(cm.Data); err != nil {
+								logrus.Errorf("Ignoring the aws-auth update, keeping the previous mappings: %v", err)
 							}
 						}
 
@@ -107,6 +124,42 @@ func (ms *MapStore) startLoadConfigMap(stopCh <-chan struct{}) {
 	}()
 }
 
+// loadConfigMap reads the aws-auth configmap once, so that the store is synced
+// even if the configmap doesn't exist and the watch never sends an event.
+func (ms *MapStore) loadConfigMap() error {
+	cm, err := ms.configMap.Get(context.TODO(), "aws-auth", metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		logrus.Info("aws-auth configmap not found, starting with no mappings")
+		ms.saveMap(make([]config.UserMapping, 0), make([]config.RoleMapping, 0), make([]config.AccountMapping, 0), config.DenyMatcher{})
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return ms.updateMap(cm.Data)
+}
+
+// updateMap saves the mappings of the aws-auth configmap data. Invalid user,
+// role and account mappings are skipped, but invalid deny mappings fail the
+// whole update: skipping one would let the identities it denies in. The
+// previous mappings are kept then, and the store stays unsynced if it wasn't.
+func (ms *MapStore) updateMap(data map[string]string) error {
+	denyMappings, err := ParseDenyMappings(data)
+	if err != nil {
+		return fmt.Errorf("invalid deny mappings: %v", err)
+	}
+	denies, err := config.NewDenyMatcher(denyMappings)
+	if err != nil {
+		return fmt.Errorf("invalid deny mappings: %v", err)
+	}
+	userMappings, roleMappings, awsAccounts, err := ParseMap(data)
+	if err != nil {
+		logrus.Errorf("There was an error parsing the config maps.  Only saving data that was good, %+v", err)
+	}
+	ms.saveMap(userMappings, roleMappings, awsAccounts, denies)
+	return nil
+}
+
 type ErrParsingMap struct {
 	errors []error
 }
@@ -115,7 +168,7 @@ func (err ErrParsingMap) Error() string {
 	return fmt.Sprintf("error parsing config map: %v", err.errors)
 }
 
-func ParseMap(m map[string]string) (userMappings []config.UserMapping, roleMappings []config.RoleMapping, awsAccounts []string, err error) {
+func ParseMap(m map[string]string) (userMappings []config.UserMapping, roleMappings []config.RoleMapping, awsAccounts []config.AccountMapping, err error) {
 	errs := make([]error, 0)
 	rawUserMappings := make([]config.UserMapping, 0)
 	userMappings = make([]config.UserMapping, 0)
@@ -167,13 +220,25 @@ func ParseMap(m map[string]string) (userMappings []config.UserMapping, roleMappi
 		}
 	}
 
-	awsAccounts = make([]string, 0)
+	rawAWSAccounts := make([]config.AccountMapping, 0)
+	awsAccounts = make([]config.AccountMapping, 0)
 	if accountsData, ok := m["mapAccounts"]; ok {
 		if !isSkippable(accountsData) {
-			err := yaml.Unmarshal([]byte(accountsData), &awsAccounts)
+			// yaml rather than json, so that unquoted account IDs keep
+			// parsing the way they always have
+			err := yaml.Unmarshal([]byte(accountsData), &rawAWSAccounts)
 			if err != nil {
 				errs = append(errs, err)
 			}
+
+			for _, accountMapping := range rawAWSAccounts {
+				err = accountMapping.Validate()
+				if err != nil {
+					errs = append(errs, err)
+				} else {
+					awsAccounts = append(awsAccounts, accountMapping)
+				}
+			}
 		}
 	}
 
@@ -184,12 +249,43 @@ func ParseMap(m map[string]string) (userMappings []config.UserMapping, roleMappi
 	return userMappings, roleMappings, awsAccounts, err
 }
 
+// ParseDenyMappings parses the mapDenies key of the configmap. Invalid deny
+// mappings are left out and reported in the error.
+func ParseDenyMappings(m map[string]string) (denyMappings []config.DenyMapping, err error) {
+	errs := make([]error, 0)
+	rawDenyMappings := make([]config.DenyMapping, 0)
+	denyMappings = make([]config.DenyMapping, 0)
+	if denyData, ok := m["mapDenies"]; ok && !isSkippable(denyData) {
+		denyJson, err := utilyaml.ToJSON([]byte(denyData))
+		if err != nil {
+			errs = append(errs, err)
+		} else {
+			if err := json.Unmarshal(denyJson, &rawDenyMappings); err != nil {
+				errs = append(errs, err)
+			}
+			for _, denyMapping := range rawDenyMappings {
+				if err := denyMapping.Validate(); err != nil {
+					errs = append(errs, err)
+				} else {
+					denyMappings = append(denyMappings, denyMapping)
+				}
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		logrus.Warnf("Errors parsing configmap deny mappings: %+v", errs)
+		err = ErrParsingMap{errors: errs}
+	}
+	return denyMappings, err
+}
+
 func isSkippable(data string) bool {
 	trimmed := strings.TrimSpace(data)
 	return trimmed == "" || trimmed == "``" || trimmed == "\"\"" || trimmed == "''"
 }
 
-func EncodeMap(userMappings []config.UserMapping, roleMappings []config.RoleMapping, awsAccounts []string) (m map[string]string, err error) {
+func EncodeMap(userMappings []config.UserMapping, roleMappings []config.RoleMapping, awsAccounts []config.AccountMapping) (m map[string]string, err error) {
 	m = make(map[string]string)
 
 	if len(userMappings) > 0 {
@@ -222,23 +318,55 @@ func EncodeMap(userMappings []config.UserMapping, roleMappings []config.RoleMapp
 func (ms *MapStore) saveMap(
 	userMappings []config.UserMapping,
 	roleMappings []config.RoleMapping,
-	awsAccounts []string) {
+	awsAccounts []config.AccountMapping,
+	denies config.DenyMatcher) {
 
 	ms.mutex.Lock()
 	defer ms.mutex.Unlock()
 	ms.users = make(map[string]config.UserMapping)
 	ms.roles = make(map[string]config.RoleMapping)
-	ms.awsAccounts = make(map[string]interface{})
+	ms.awsAccounts = make(map[string]config.AccountMapping)
+	ms.rolePatterns = arn.Patterns[config.RoleMapping]{}
+	ms.userPatterns = arn.Patterns[config.UserMapping]{}
 
 	for _, user := range userMappings {
-		ms.users[user.Key()] = user
+		key := strings.ToLower(user.Key())
+		ms.users[key] = user
+		if arn.IsPattern(key) {
+			// validated when the configmap was parsed
+			_ = ms.userPatterns.Add(key, user)
+		}
 	}
 	for _, role := range roleMappings {
 		ms.roles[role.Key()] = role
+		if arn.IsPattern(role.Key()) {
+			_ = ms.rolePatterns.Add(role.Key(), role)
+		}
 	}
 	for _, awsAccount := range awsAccounts {
-		ms.awsAccounts[awsAccount] = nil
+		ms.awsAccounts[awsAccount.Key()] = awsAccount
 	}
+	ms.denies = denies
+	ms.templates = mapper.ParseTemplates(mapper.Mappings{
+		RoleMappings: roleMappings,
+		UserMappings: userMappings,
+		AWSAccounts:  awsAccounts,
+	})
+	ms.synced = true
+}
+
+// Template returns the parsed template of pattern if a mapping has it, or nil.
+func (ms *MapStore) Template(pattern string) *template.Template {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+	return ms.templates[pattern]
+}
+
+// HasSynced returns true once the aws-auth configmap has been loaded.
+func (ms *MapStore) HasSynced() bool {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+	return ms.synced
 }
 
 // UserNotFound is the error returned when the user is not found in the config map.
@@ -247,31 +375,78 @@ var UserNotFound = errors.New("User not found in configmap")
 // RoleNotFound is the error returned when the role is not found in the config map.
 var RoleNotFound = errors.New("Role not found in configmap")
 
-func (ms *MapStore) UserMapping(arn string) (config.UserMapping, error) {
+// UserMapping returns the mapping of the user ARN, or of the most specific
+// user ARN pattern that matches it.
+func (ms *MapStore) UserMapping(userARN string) (config.UserMapping, error) {
 	ms.mutex.RLock()
 	defer ms.mutex.RUnlock()
-	for _, user := range ms.users {
-		if user.Matches(arn) {
-			return user, nil
-		}
+	now := time.Now()
+	if user, ok := ms.users[strings.ToLower(userARN)]; ok && user.Matches(userARN) && user.IsActive(now) {
+		return user, nil
+	}
+	if user, ok := ms.userPatterns.Find(strings.ToLower(userARN), func(user config.UserMapping) bool {
+		return user.IsActive(now)
+	}); ok {
+		return user, nil
 	}
 	return config.UserMapping{}, UserNotFound
 }
 
-func (ms *MapStore) RoleMapping(arn string) (config.RoleMapping, error) {
+// RoleMapping returns the mapping of the role ARN, or of the most specific
+// role ARN pattern or SSO matcher that matches it.
+func (ms *MapStore) RoleMapping(roleARN string) (config.RoleMapping, error) {
 	ms.mutex.RLock()
 	defer ms.mutex.RUnlock()
-	for _, role := range ms.roles {
-		if role.Matches(arn) {
-			return role, nil
-		}
+	now := time.Now()
+	if role, ok := ms.roles[strings.ToLower(roleARN)]; ok && role.Matches(roleARN) && role.IsActive(now) {
+		return role, nil
+	}
+	if role, ok := ms.rolePatterns.Find(strings.ToLower(roleARN), func(role config.RoleMapping) bool {
+		// SSO matchers only match with the SSORoleMatch feature enabled
+		return role.MatchEnabled() && role.IsActive(now)
+	}); ok {
+		return role, nil
 	}
 	return config.RoleMapping{}, RoleNotFound
 }
 
 func (ms *MapStore) AWSAccount(id string) bool {
+	return ms.AccountMapping(id) != nil
+}
+
+// AccountMapping returns the mapping of account id, or nil if it isn't in
+// mapAccounts.
+func (ms *MapStore) AccountMapping(id string) *config.AccountMapping {
 	ms.mutex.RLock()
 	defer ms.mutex.RUnlock()
-	_, ok := ms.awsAccounts[id]
-	return ok
+	if account, ok := ms.awsAccounts[id]; ok {
+		return &account
+	}
+	return nil
+}
+
+// DenyMapping returns the deny mapping that matches identity, or nil.
+func (ms *MapStore) DenyMapping(identity *token.Identity) *config.DenyMapping {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+	return ms.denies.Match(identity)
+}
+
+// Mappings returns a snapshot of the mappings loaded from the configmap.
+func (ms *MapStore) Mappings() mapper.Mappings {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+	var mappings mapper.Mappings
+	for _, role := range ms.roles {
+		mappings.RoleMappings = append(mappings.RoleMappings, role)
+	}
+	for _, user := range ms.users {
+		mappings.UserMappings = append(mappings.UserMappings, user)
+	}
+	for _, account := range ms.awsAccounts {
+		mappings.AWSAccounts = append(mappings.AWSAccounts, account)
+	}
+	mappings.DenyMappings = append(mappings.DenyMappings, ms.denies.Mappings()...)
+	mappings.Sort()
+	return mappings
 }
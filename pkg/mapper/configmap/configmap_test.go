@@ -15,6 +15,7 @@ import (
 	"k8s.io/client-go/kubernetes/typed/core/v1/fake"
 	k8stesting "k8s.io/client-go/testing"
 	"sigs.k8s.io/aws-iam-authenticator/pkg/config"
+	"sigs.k8s.io/aws-iam-authenticator/pkg/token"
 )
 
 func init() {
@@ -35,15 +36,13 @@ var (
 )
 
 func makeStore() MapStore {
-	ms := MapStore{
-		users:       make(map[string]config.UserMapping),
-		roles:       make(map[string]config.RoleMapping),
-		awsAccounts: make(map[string]interface{}),
-	}
-	ms.users["arn:aws:iam::012345678912:user/matt"] = testUser
-	ms.roles["arn:aws:iam::012345678912:role/awsreservedsso_viewonlyaccess_*"] = testSSORole
-	ms.roles["arn:aws:iam::012345678912:role/comp*"] = testRole
-	ms.awsAccounts["123"] = nil
+	ms := MapStore{}
+	ms.saveMap(
+		[]config.UserMapping{testUser},
+		[]config.RoleMapping{testSSORole, testRole},
+		[]config.AccountMapping{{AccountID: "123"}},
+		config.DenyMatcher{},
+	)
 	return ms
 }
 
@@ -190,6 +189,10 @@ func TestLoadConfigMap(t *testing.T) {
 
 	time.Sleep(2 * time.Second)
 
+	if !ms.HasSynced() {
+		t.Errorf("Expected the store to be synced after the initial load")
+	}
+
 	meta := metav1.ObjectMeta{Name: "aws-auth"}
 	data := make(map[string]string)
 	data["mapUsers"] = userMapping
@@ -308,7 +311,7 @@ func TestParseMap(t *testing.T) {
 			Groups:   []string{"system:basic-users"},
 		},
 	}
-	accounts := []string{}
+	accounts := []config.AccountMapping{}
 
 	u, r, a, err := ParseMap(m1)
 	if err != nil {
@@ -334,6 +337,125 @@ func TestParseMap(t *testing.T) {
 	}
 }
 
+func TestParseDenyMappings(t *testing.T) {
+	m := map[string]string{
+		"mapDenies": `- arn: arn:aws:iam::012345678912:role/Compromised*
+  reason: incident 42
+- accountID: "123456789012"
+- accountID: "1234"
+`,
+	}
+	denyMappings, err := ParseDenyMappings(m)
+	if err == nil {
+		t.Errorf("Expected an error for the invalid account ID")
+	}
+	expected := []config.DenyMapping{
+		{ARN: "arn:aws:iam::012345678912:role/Compromised*", Reason: "incident 42"},
+		{AccountID: "123456789012"},
+	}
+	if !reflect.DeepEqual(denyMappings, expected) {
+		t.Errorf("Deny mappings do not match expected values. (Actual: %+v, Expected: %+v", denyMappings, expected)
+	}
+
+	denies, err := config.NewDenyMatcher(denyMappings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms := makeStore()
+	ms.saveMap(nil, nil, nil, denies)
+	identity := &token.Identity{
+		ARN:          "arn:aws:sts::012345678912:assumed-role/CompromisedRole/session",
+		CanonicalARN: "arn:aws:iam::012345678912:role/CompromisedRole",
+		AccountID:    "012345678912",
+	}
+	if deny := ms.DenyMapping(identity); deny == nil || deny.Reason != "incident 42" {
+		t.Errorf("Expected %s to be denied, got %+v", identity.ARN, deny)
+	}
+	identity.CanonicalARN = "arn:aws:iam::012345678912:role/Admin"
+	identity.ARN = "arn:aws:sts::012345678912:assumed-role/Admin/session"
+	if deny := ms.DenyMapping(identity); deny != nil {
+		t.Errorf("Expected %s not to be denied, got %+v", identity.ARN, deny)
+	}
+}
+
+func TestUpdateMapInvalidDenyMappings(t *testing.T) {
+	ms := MapStore{}
+	if err := ms.updateMap(map[string]string{"mapDenies": `- accountID: "1234"`}); err == nil {
+		t.Errorf("Expected an error for the invalid deny mapping")
+	}
+	if ms.HasSynced() {
+		t.Errorf("Expected the store not to be synced without valid deny mappings")
+	}
+
+	if err := ms.updateMap(map[string]string{
+		"mapUsers":  userMapping,
+		"mapDenies": `- accountID: "012345678912"`,
+	}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	err := ms.updateMap(map[string]string{
+		"mapUsers":  updatedUserMapping,
+		"mapDenies": "- accountID: \"012345678912\"\n- accountID: \"1234\"\n",
+	})
+	if err == nil {
+		t.Errorf("Expected an error for the invalid deny mapping")
+	}
+	identity := &token.Identity{
+		ARN:          "arn:aws:iam::012345678912:user/NIC",
+		CanonicalARN: "arn:aws:iam::012345678912:user/NIC",
+		AccountID:    "012345678912",
+	}
+	if deny := ms.DenyMapping(identity); deny == nil {
+		t.Errorf("Expected %s to still be denied", identity.ARN)
+	}
+	if _, err := ms.UserMapping("arn:iam:beswar"); err != UserNotFound {
+		t.Errorf("Expected the update to be ignored, got err: %v", err)
+	}
+}
+
+func TestParseMapAccountMappings(t *testing.T) {
+	m1 := map[string]string{
+		"mapAccounts": `- "012345678912"
+- account: "111122223333"
+  username: partner:{{SessionName}}
+  groups:
+  - readonly
+`,
+	}
+	accounts := []config.AccountMapping{
+		{AccountID: "012345678912"},
+		{AccountID: "111122223333", Username: "partner:{{SessionName}}", Groups: []string{"readonly"}},
+	}
+
+	_, _, a, err := ParseMap(m1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(a, accounts) {
+		t.Fatalf("unexpected accounts %+v", a)
+	}
+
+	m2, err := EncodeMap(nil, nil, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, a2, err := ParseMap(m2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(a2, accounts) {
+		t.Fatalf("unexpected accounts after encoding %v: %+v", m2, a2)
+	}
+
+	_, _, a, err = ParseMap(map[string]string{"mapAccounts": `- account: "111122223333"
+  groups:
+  - "{{Session}}"
+`})
+	if err == nil || len(a) != 0 {
+		t.Errorf("Expected an account mapping with an invalid group template to be rejected, got %+v", a)
+	}
+}
+
 func TestBadParseMap(t *testing.T) {
 	m1 := map[string]string{
 		"mapAccounts": ``,
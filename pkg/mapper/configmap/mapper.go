@@ -33,35 +33,39 @@ func (m *ConfigMapMapper) Start(stopCh <-chan struct{}) error {
 	return nil
 }
 
+func (m *ConfigMapMapper) HasSynced() bool {
+	return m.MapStore.HasSynced()
+}
+
 func (m *ConfigMapMapper) Map(identity *token.Identity) (*config.IdentityMapping, error) {
 	canonicalARN := strings.ToLower(identity.CanonicalARN)
 
 	rm, err := m.RoleMapping(canonicalARN)
 	// TODO: Check for non Role/UserNotFound errors
 	if err == nil {
-		return &config.IdentityMapping{
-			IdentityARN: canonicalARN,
-			Username:    rm.Username,
-			Groups:      rm.Groups,
-		}, nil
+		return rm.IdentityMapping(identity), nil
 	}
 
 	um, err := m.UserMapping(canonicalARN)
 	if err == nil {
-		return &config.IdentityMapping{
-			IdentityARN: canonicalARN,
-			Username:    um.Username,
-			Groups:      um.Groups,
-		}, nil
+		return um.IdentityMapping(identity), nil
 	}
 
 	return nil, errutil.ErrNotMapped
 }
 
-func (m *ConfigMapMapper) IsAccountAllowed(accountID string) bool {
-	return m.AWSAccount(accountID)
+func (m *ConfigMapMapper) Deny(identity *token.Identity) (*config.DenyMapping, error) {
+	return m.DenyMapping(identity), nil
+}
+
+func (m *ConfigMapMapper) AccountMapping(accountID string) *config.AccountMapping {
+	return m.MapStore.AccountMapping(accountID)
 }
 
 func (m *ConfigMapMapper) UsernamePrefixReserveList() []string {
 	return []string{}
 }
+
+func (m *ConfigMapMapper) Mappings() mapper.Mappings {
+	return m.MapStore.Mappings()
+}
@@ -38,6 +38,23 @@ type IAMIdentityMappingSpec struct {
 	ARN      string   `json:"arn"`
 	Username string   `json:"username"`
 	Groups   []string `json:"groups"`
+
+	// NotBefore and ExpiresAt, if set, bound when the mapping matches
+	NotBefore *metav1.Time `json:"notBefore,omitempty"`
+	ExpiresAt *metav1.Time `json:"expiresAt,omitempty"`
+
+	// Extra is added to the user extra of the TokenReview. Each value can
+	// include the same placeholders as Username.
+	Extra map[string][]string `json:"extra,omitempty"`
+
+	// Deny makes the mapping deny the identities it matches, even if another
+	// mapping allows them. ARN can then contain * and ? wildcards, or be
+	// replaced by AccountID or AccessKeyID, and Username and Groups are unused.
+	Deny        bool   `json:"deny,omitempty"`
+	AccountID   string `json:"accountID,omitempty"`
+	AccessKeyID string `json:"accessKeyID,omitempty"`
+	// Reason is recorded in the audit log when the mapping denies an identity
+	Reason string `json:"reason,omitempty"`
 }
 
 // IAMIdentityMappingStatus is the status for a IAMIdentityMapping resource
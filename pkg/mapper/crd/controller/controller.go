@@ -34,6 +34,7 @@ import (
 	"github.com/sirupsen/logrus"
 
 	"sigs.k8s.io/aws-iam-authenticator/pkg/arn"
+	"sigs.k8s.io/aws-iam-authenticator/pkg/config"
 	iamauthenticatorv1alpha1 "sigs.k8s.io/aws-iam-authenticator/pkg/mapper/crd/apis/iamauthenticator/v1alpha1"
 	clientset "sigs.k8s.io/aws-iam-authenticator/pkg/mapper/crd/generated/clientset/versioned"
 	iamscheme "sigs.k8s.io/aws-iam-authenticator/pkg/mapper/crd/generated/clientset/versioned/scheme"
@@ -50,6 +51,28 @@ const (
 
 	// IdentitySynced is the `message` when an Identity is synced
 	IdentitySynced = "Identity synced successfully"
+
+	// InvalidTemplate is used as part of the Event 'reason' when the username,
+	// groups or extra of an Identity are not valid templates
+	InvalidTemplate = "InvalidTemplate"
+
+	// InvalidActivePeriod is used as part of the Event 'reason' when an
+	// Identity expires before it starts matching
+	InvalidActivePeriod = "InvalidActivePeriod"
+
+	// InvalidDenyMapping is used as part of the Event 'reason' when a deny
+	// Identity doesn't set exactly one of arn, accountID or accessKeyID
+	InvalidDenyMapping = "InvalidDenyMapping"
+
+	// InvalidARNPattern is used as part of the Event 'reason' when the arn of
+	// an Identity is a pattern that can't be parsed
+	InvalidARNPattern = "InvalidARNPattern"
+
+	// DenyIndex is the index of the Identities with deny set
+	DenyIndex = "deny"
+
+	// PatternIndex is the index of the synced Identities with an ARN pattern
+	PatternIndex = "arnPattern"
 )
 
 // Controller implements the logic for getting and mutating IAMIdentityMappings
@@ -111,6 +134,8 @@ func New(
 
 	err := iamMappingInformer.Informer().GetIndexer().AddIndexers(cache.Indexers{
 		"canonicalARN": IndexIAMIdentityMappingByCanonicalArn,
+		DenyIndex:      IndexIAMIdentityMappingByDeny,
+		PatternIndex:   IndexIAMIdentityMappingByPattern,
 	})
 	if err != nil {
 		logrus.WithError(err).Fatal("error adding index")
@@ -203,13 +228,51 @@ func (c *Controller) syncHandler(key string) (err error) {
 		return err
 	}
 
+	if iamIdentityMapping.Spec.Deny {
+		// deny mappings are matched on the spec as soon as the informer has
+		// them, they don't need a canonical ARN
+		denyMapping := DenyMapping(iamIdentityMapping)
+		if err := denyMapping.Validate(); err != nil {
+			c.recorder.Event(iamIdentityMapping, corev1.EventTypeWarning, InvalidDenyMapping, err.Error())
+			return nil
+		}
+		c.recorder.Event(iamIdentityMapping, corev1.EventTypeNormal, SuccessSynced, IdentitySynced)
+		return nil
+	}
+
+	if err := config.ValidateTemplates(iamIdentityMapping.Spec.Username, iamIdentityMapping.Spec.Groups); err != nil {
+		// retrying won't help until the mapping is updated
+		c.recorder.Event(iamIdentityMapping, corev1.EventTypeWarning, InvalidTemplate, err.Error())
+		return nil
+	}
+
+	if err := config.ValidateExtra(iamIdentityMapping.Spec.Extra); err != nil {
+		c.recorder.Event(iamIdentityMapping, corev1.EventTypeWarning, InvalidTemplate, err.Error())
+		return nil
+	}
+
+	if err := config.ValidateActivePeriod(Time(iamIdentityMapping.Spec.NotBefore), Time(iamIdentityMapping.Spec.ExpiresAt)); err != nil {
+		c.recorder.Event(iamIdentityMapping, corev1.EventTypeWarning, InvalidActivePeriod, err.Error())
+		return nil
+	}
+
+	if err := config.ValidateARNPattern(iamIdentityMapping.Spec.ARN); err != nil {
+		c.recorder.Event(iamIdentityMapping, corev1.EventTypeWarning, InvalidARNPattern, err.Error())
+		return nil
+	}
+
 	// Process items
 	if iamIdentityMapping.Spec.ARN != "" {
 		iamIdentityMappingCopy := iamIdentityMapping.DeepCopy()
 
-		_, canonicalizedARN, err := arn.Canonicalize(strings.ToLower(iamIdentityMapping.Spec.ARN))
-		if err != nil {
-			return err
+		// patterns can't be canonicalized, they are matched against the
+		// canonical ARN of the identity instead
+		canonicalizedARN := strings.ToLower(iamIdentityMapping.Spec.ARN)
+		if !arn.IsPattern(canonicalizedARN) {
+			_, canonicalizedARN, err = arn.Canonicalize(canonicalizedARN)
+			if err != nil {
+				return err
+			}
 		}
 
 		iamIdentityMappingCopy.Status.CanonicalARN = canonicalizedARN
@@ -242,9 +305,47 @@ func IndexIAMIdentityMappingByCanonicalArn(obj interface{}) ([]string, error) {
 	}
 
 	canonicalArnStr := iamIdentity.Status.CanonicalARN
-	if canonicalArnStr == "" {
+	if canonicalArnStr == "" || iamIdentity.Spec.Deny || arn.IsPattern(canonicalArnStr) {
 		return []string{}, nil
 	}
 
 	return []string{canonicalArnStr}, nil
 }
+
+// IndexIAMIdentityMappingByPattern indexes the synced identities with an ARN
+// pattern under "true", they can't be looked up by canonical ARN
+func IndexIAMIdentityMappingByPattern(obj interface{}) ([]string, error) {
+	iamIdentity, ok := obj.(*iamauthenticatorv1alpha1.IAMIdentityMapping)
+	if !ok || iamIdentity.Spec.Deny || !arn.IsPattern(iamIdentity.Status.CanonicalARN) {
+		return []string{}, nil
+	}
+	return []string{"true"}, nil
+}
+
+// IndexIAMIdentityMappingByDeny indexes the identities with deny set under "true"
+func IndexIAMIdentityMappingByDeny(obj interface{}) ([]string, error) {
+	iamIdentity, ok := obj.(*iamauthenticatorv1alpha1.IAMIdentityMapping)
+	if !ok || !iamIdentity.Spec.Deny {
+		return []string{}, nil
+	}
+	return []string{"true"}, nil
+}
+
+// DenyMapping returns the deny mapping described by an identity with deny set
+func DenyMapping(iamIdentity *iamauthenticatorv1alpha1.IAMIdentityMapping) config.DenyMapping {
+	return config.DenyMapping{
+		ARN:         iamIdentity.Spec.ARN,
+		AccountID:   iamIdentity.Spec.AccountID,
+		AccessKeyID: iamIdentity.Spec.AccessKeyID,
+		Reason:      iamIdentity.Spec.Reason,
+	}
+}
+
+// Time converts an optional Kubernetes time to the optional time used by the
+// mappings
+func Time(t *metav1.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	return &t.Time
+}
@@ -241,3 +241,43 @@ func TestIAMIdentityMappingCreation(t *testing.T) {
 	f.expectUpdateStatusAction(iamidentity)
 	f.run(getKey(iamidentity, t))
 }
+
+func TestIAMIdentityMappingDeny(t *testing.T) {
+	f := newFixture(t)
+	iamidentity := newIAMIdentityMapping("test", "arn:aws:iam::XXXXXXXXXXXX:role/Compromised*", "")
+	iamidentity.Spec.Deny = true
+	f.iamIdentityLister = append(f.iamIdentityLister, iamidentity)
+	f.objects = append(f.objects, iamidentity)
+
+	// deny mappings are used from the spec, their status isn't updated
+	f.run(getKey(iamidentity, t))
+
+	if keys, _ := IndexIAMIdentityMappingByDeny(iamidentity); !reflect.DeepEqual(keys, []string{"true"}) {
+		t.Errorf("expected the deny mapping to be indexed, got %v", keys)
+	}
+	iamidentity.Status.CanonicalARN = "arn:aws:iam::xxxxxxxxxxxx:role/compromised*"
+	if keys, _ := IndexIAMIdentityMappingByCanonicalArn(iamidentity); len(keys) != 0 {
+		t.Errorf("expected the deny mapping not to be indexed by canonical ARN, got %v", keys)
+	}
+}
+
+func TestIAMIdentityMappingPattern(t *testing.T) {
+	f := newFixture(t)
+	iamidentity := newIAMIdentityMapping("test", "arn:aws:iam::*:role/EKS-Admin-*", "admin")
+	f.iamIdentityLister = append(f.iamIdentityLister, iamidentity)
+	f.objects = append(f.objects, iamidentity)
+
+	// patterns are lowercased rather than canonicalized
+	iamidentity.Status = iamauthenticatorv1alpha1.IAMIdentityMappingStatus{
+		CanonicalARN: "arn:aws:iam::*:role/eks-admin-*",
+	}
+	f.expectUpdateStatusAction(iamidentity)
+	f.run(getKey(iamidentity, t))
+
+	if keys, _ := IndexIAMIdentityMappingByPattern(iamidentity); !reflect.DeepEqual(keys, []string{"true"}) {
+		t.Errorf("expected the pattern to be indexed, got %v", keys)
+	}
+	if keys, _ := IndexIAMIdentityMappingByCanonicalArn(iamidentity); len(keys) != 0 {
+		t.Errorf("expected the pattern not to be indexed by canonical ARN, got %v", keys)
+	}
+}
@@ -2,12 +2,18 @@ package crd
 
 import (
 	"fmt"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
+	"sigs.k8s.io/aws-iam-authenticator/pkg/arn"
 	"sigs.k8s.io/aws-iam-authenticator/pkg/errutil"
+	"sigs.k8s.io/aws-iam-authenticator/pkg/template"
 	"sigs.k8s.io/aws-iam-authenticator/pkg/token"
 
+	awsarn "github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/sirupsen/logrus"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
@@ -28,6 +34,31 @@ type CRDMapper struct {
 	iamMappingsSynced cache.InformerSynced
 	// iamMappingsIndex is a custom indexer which allows for indexing on canonical arns
 	iamMappingsIndex cache.Indexer
+
+	// patterns are the ARN patterns and deny mappings of the
+	// IAMIdentityMappings in iamMappingsIndex, compiled whenever they change
+	// rather than for each identity
+	patternsMutex sync.RWMutex
+	patterns      *compiledPatterns
+
+	// templates are the parsed templates of the IAMIdentityMappings in
+	// iamMappingsIndex, keyed by pattern
+	templatesMutex sync.RWMutex
+	templates      map[string]*countedTemplate
+}
+
+// countedTemplate is a parsed template and the number of IAMIdentityMappings
+// in the informer cache that have it
+type countedTemplate struct {
+	template *template.Template
+	count    int
+}
+
+type compiledPatterns struct {
+	// mappings are the synced IAMIdentityMappings with an ARN pattern, those
+	// with the same pattern sorted by name
+	mappings arn.Patterns[[]*iamauthenticatorv1alpha1.IAMIdentityMapping]
+	denies   config.DenyMatcher
 }
 
 var _ mapper.Mapper = &CRDMapper{}
@@ -66,11 +97,150 @@ func NewCRDMapper(cfg config.Config) (*CRDMapper, error) {
 
 	ctrl := controller.New(kubeClient, iamClient, iamMappingInformer)
 
-	return &CRDMapper{ctrl, iamInformerFactory, iamMappingsSynced, iamMappingsIndex}, nil
+	m := &CRDMapper{
+		Controller:         ctrl,
+		iamInformerFactory: iamInformerFactory,
+		iamMappingsSynced:  iamMappingsSynced,
+		iamMappingsIndex:   iamMappingsIndex,
+		templates:          map[string]*countedTemplate{},
+	}
+	m.compilePatterns()
+	// the handlers are called once the indexer has been updated
+	_, err = iamMappingInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			m.countTemplates(obj, 1)
+			m.compilePatternsFor(obj)
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			m.countTemplates(newObj, 1)
+			m.countTemplates(oldObj, -1)
+			if !m.compilePatternsFor(oldObj) {
+				m.compilePatternsFor(newObj)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			m.countTemplates(obj, -1)
+			m.compilePatternsFor(obj)
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("can't watch the IAMIdentityMappings: %v", err)
+	}
+	return m, nil
 }
 
+// NewCRDMapperWithIndexer returns a CRDMapper for a prepopulated indexer, the
+// ARN patterns and templates are only compiled once.
 func NewCRDMapperWithIndexer(iamMappingsIndex cache.Indexer) *CRDMapper {
-	return &CRDMapper{iamMappingsIndex: iamMappingsIndex}
+	m := &CRDMapper{
+		iamMappingsIndex: iamMappingsIndex,
+		templates:        map[string]*countedTemplate{},
+	}
+	m.compilePatterns()
+	for _, obj := range iamMappingsIndex.List() {
+		m.countTemplates(obj, 1)
+	}
+	return m
+}
+
+// countTemplates parses the templates of obj if delta is 1, or forgets them
+// once no other IAMIdentityMapping has them if delta is -1. Templates that
+// don't parse are left out, they fail when they are rendered.
+func (m *CRDMapper) countTemplates(obj interface{}, delta int) {
+	iamidentity, ok := obj.(*iamauthenticatorv1alpha1.IAMIdentityMapping)
+	if !ok || iamidentity.Spec.Deny {
+		return
+	}
+	patterns := append([]string{iamidentity.Spec.Username}, iamidentity.Spec.Groups...)
+	for _, values := range iamidentity.Spec.Extra {
+		patterns = append(patterns, values...)
+	}
+
+	m.templatesMutex.Lock()
+	defer m.templatesMutex.Unlock()
+	for _, pattern := range patterns {
+		counted, ok := m.templates[pattern]
+		if !ok {
+			if delta < 0 {
+				continue
+			}
+			t, err := template.Parse(pattern)
+			if err != nil {
+				continue
+			}
+			counted = &countedTemplate{template: t}
+			m.templates[pattern] = counted
+		}
+		counted.count += delta
+		if counted.count <= 0 {
+			delete(m.templates, pattern)
+		}
+	}
+}
+
+// Template returns the parsed template of pattern if an IAMIdentityMapping
+// has it, or nil.
+func (m *CRDMapper) Template(pattern string) *template.Template {
+	m.templatesMutex.RLock()
+	defer m.templatesMutex.RUnlock()
+	if counted, ok := m.templates[pattern]; ok {
+		return counted.template
+	}
+	return nil
+}
+
+// compilePatternsFor compiles the patterns again if obj has an ARN pattern or
+// denies, and returns true if it did.
+func (m *CRDMapper) compilePatternsFor(obj interface{}) bool {
+	iamidentity, ok := obj.(*iamauthenticatorv1alpha1.IAMIdentityMapping)
+	if !ok || !(iamidentity.Spec.Deny || arn.IsPattern(iamidentity.Status.CanonicalARN)) {
+		return false
+	}
+	m.compilePatterns()
+	return true
+}
+
+// compilePatterns compiles the ARN patterns and deny mappings in the indexer.
+// Invalid ones are left out, the controller doesn't sync mappings with an
+// invalid ARN.
+func (m *CRDMapper) compilePatterns() {
+	patterns := &compiledPatterns{}
+	byPattern := map[string][]*iamauthenticatorv1alpha1.IAMIdentityMapping{}
+	objects, _ := m.iamMappingsIndex.ByIndex(controller.PatternIndex, "true")
+	for _, obj := range objects {
+		if iamidentity, ok := obj.(*iamauthenticatorv1alpha1.IAMIdentityMapping); ok {
+			pattern := iamidentity.Status.CanonicalARN
+			byPattern[pattern] = append(byPattern[pattern], iamidentity)
+		}
+	}
+	for pattern, iamidentities := range byPattern {
+		sort.Slice(iamidentities, func(i, j int) bool { return iamidentities[i].Name < iamidentities[j].Name })
+		if err := patterns.mappings.Add(pattern, iamidentities); err != nil {
+			logrus.WithError(err).WithField("arn", pattern).Warn("ignoring IAMIdentityMappings with an invalid ARN pattern")
+		}
+	}
+
+	objects, _ = m.iamMappingsIndex.ByIndex(controller.DenyIndex, "true")
+	for _, obj := range objects {
+		if iamidentity, ok := obj.(*iamauthenticatorv1alpha1.IAMIdentityMapping); ok {
+			if err := patterns.denies.Add(controller.DenyMapping(iamidentity)); err != nil {
+				logrus.WithError(err).WithField("name", iamidentity.Name).Warn("ignoring deny IAMIdentityMapping with an invalid ARN")
+			}
+		}
+	}
+
+	m.patternsMutex.Lock()
+	m.patterns = patterns
+	m.patternsMutex.Unlock()
+}
+
+func (m *CRDMapper) compiledPatterns() *compiledPatterns {
+	m.patternsMutex.RLock()
+	defer m.patternsMutex.RUnlock()
+	return m.patterns
 }
 
 func (m *CRDMapper) Name() string {
@@ -89,6 +259,15 @@ func (m *CRDMapper) Start(stopCh <-chan struct{}) error {
 	return nil
 }
 
+// HasSynced returns true once the IAMIdentityMapping informer has synced.
+func (m *CRDMapper) HasSynced() bool {
+	if m.iamMappingsSynced == nil {
+		// created from a prepopulated indexer
+		return true
+	}
+	return m.iamMappingsSynced()
+}
+
 func (m *CRDMapper) Map(identity *token.Identity) (*config.IdentityMapping, error) {
 	canonicalARN := strings.ToLower(identity.CanonicalARN)
 
@@ -100,29 +279,118 @@ func (m *CRDMapper) Map(identity *token.Identity) (*config.IdentityMapping, erro
 	}
 
 	if len(objects) > 0 {
+		now := time.Now()
 		for _, obj := range objects {
 			iamidentity, ok = obj.(*iamauthenticatorv1alpha1.IAMIdentityMapping)
-			if ok {
+			// skip the mappings that have expired or don't match yet
+			if ok && config.IsActive(controller.Time(iamidentity.Spec.NotBefore), controller.Time(iamidentity.Spec.ExpiresAt), now) {
 				break
 			}
+			iamidentity = nil
 		}
 
 		if iamidentity != nil {
-			return &config.IdentityMapping{
-				IdentityARN: canonicalARN,
-				Username:    iamidentity.Spec.Username,
-				Groups:      iamidentity.Spec.Groups,
-			}, nil
+			return identityMapping(canonicalARN, iamidentity), nil
 		}
 	}
 
+	iamidentity, err = m.matchPattern(canonicalARN)
+	if err != nil {
+		return nil, err
+	}
+	if iamidentity != nil {
+		return identityMapping(canonicalARN, iamidentity), nil
+	}
+
 	return nil, errutil.ErrNotMapped
 }
 
-func (m *CRDMapper) IsAccountAllowed(accountID string) bool {
-	return false
+// identityMapping converts the IAMIdentityMapping matching canonicalARN into a
+// generic IdentityMapping object
+func identityMapping(canonicalARN string, iamidentity *iamauthenticatorv1alpha1.IAMIdentityMapping) *config.IdentityMapping {
+	return &config.IdentityMapping{
+		IdentityARN: canonicalARN,
+		Username:    iamidentity.Spec.Username,
+		Groups:      iamidentity.Spec.Groups,
+		Source:      iamidentity.Name,
+		Extra:       iamidentity.Spec.Extra,
+	}
+}
+
+// matchPattern returns the active IAMIdentityMapping with the most specific
+// ARN pattern that matches canonicalARN, or nil. Mappings with the same
+// pattern are told apart by name, so that the result doesn't depend on the
+// order of the informer cache.
+func (m *CRDMapper) matchPattern(canonicalARN string) (*iamauthenticatorv1alpha1.IAMIdentityMapping, error) {
+	now := time.Now()
+	iamidentities, ok := m.compiledPatterns().mappings.Find(canonicalARN, func(iamidentities []*iamauthenticatorv1alpha1.IAMIdentityMapping) bool {
+		return activeMapping(iamidentities, now) != nil
+	})
+	if !ok {
+		return nil, nil
+	}
+	return activeMapping(iamidentities, now), nil
+}
+
+// activeMapping returns the first of iamidentities that is active at now, or nil
+func activeMapping(iamidentities []*iamauthenticatorv1alpha1.IAMIdentityMapping, now time.Time) *iamauthenticatorv1alpha1.IAMIdentityMapping {
+	for _, iamidentity := range iamidentities {
+		if config.IsActive(controller.Time(iamidentity.Spec.NotBefore), controller.Time(iamidentity.Spec.ExpiresAt), now) {
+			return iamidentity
+		}
+	}
+	return nil
+}
+
+// Deny matches identity against the IAMIdentityMappings with deny set. They
+// are used as soon as they are in the informer cache, without waiting for the
+// controller.
+func (m *CRDMapper) Deny(identity *token.Identity) (*config.DenyMapping, error) {
+	return m.compiledPatterns().denies.Match(identity), nil
+}
+
+func (m *CRDMapper) AccountMapping(accountID string) *config.AccountMapping {
+	return nil
 }
 
 func (m *CRDMapper) UsernamePrefixReserveList() []string {
 	return []string{}
 }
+
+// Mappings returns a snapshot of the IAMIdentityMappings in the informer
+// cache. Role and user ARNs share the same resource, they are told apart by
+// the ARN.
+func (m *CRDMapper) Mappings() mapper.Mappings {
+	var mappings mapper.Mappings
+	for _, obj := range m.iamMappingsIndex.List() {
+		iamidentity, ok := obj.(*iamauthenticatorv1alpha1.IAMIdentityMapping)
+		if !ok {
+			continue
+		}
+		if iamidentity.Spec.Deny {
+			mappings.DenyMappings = append(mappings.DenyMappings, controller.DenyMapping(iamidentity))
+			continue
+		}
+		if parsed, err := awsarn.Parse(iamidentity.Spec.ARN); err == nil && strings.HasPrefix(parsed.Resource, "role/") {
+			mappings.RoleMappings = append(mappings.RoleMappings, config.RoleMapping{
+				RoleARN:   iamidentity.Spec.ARN,
+				Username:  iamidentity.Spec.Username,
+				Groups:    iamidentity.Spec.Groups,
+				UserId:    iamidentity.Status.UserID,
+				NotBefore: controller.Time(iamidentity.Spec.NotBefore),
+				ExpiresAt: controller.Time(iamidentity.Spec.ExpiresAt),
+			})
+			continue
+		}
+		mappings.UserMappings = append(mappings.UserMappings, config.UserMapping{
+			UserARN:   iamidentity.Spec.ARN,
+			Username:  iamidentity.Spec.Username,
+			Groups:    iamidentity.Spec.Groups,
+			UserId:    iamidentity.Status.UserID,
+			NotBefore: controller.Time(iamidentity.Spec.NotBefore),
+			ExpiresAt: controller.Time(iamidentity.Spec.ExpiresAt),
+		})
+	}
+	mappings.Sort()
+	return mappings
+}
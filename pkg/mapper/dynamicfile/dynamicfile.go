@@ -5,26 +5,40 @@ import (
 	"fmt"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"sigs.k8s.io/aws-iam-authenticator/pkg/arn"
 	"sigs.k8s.io/aws-iam-authenticator/pkg/config"
 	"sigs.k8s.io/aws-iam-authenticator/pkg/errutil"
 	"sigs.k8s.io/aws-iam-authenticator/pkg/fileutil"
+	"sigs.k8s.io/aws-iam-authenticator/pkg/mapper"
 	"sigs.k8s.io/aws-iam-authenticator/pkg/metrics"
+	"sigs.k8s.io/aws-iam-authenticator/pkg/template"
+	"sigs.k8s.io/aws-iam-authenticator/pkg/token"
 )
 
 type DynamicFileMapStore struct {
 	mutex sync.RWMutex
 	users map[string]config.UserMapping
 	roles map[string]config.RoleMapping
-	// Used as set.
-	awsAccounts               map[string]interface{}
+	// rolePatterns and userPatterns are the mappings with an ARN pattern, the
+	// others are looked up in roles and users. There are none with
+	// userIDStrict, the mappings are keyed by UserId then.
+	rolePatterns arn.Patterns[config.RoleMapping]
+	userPatterns arn.Patterns[config.UserMapping]
+	// Keyed by account ID.
+	awsAccounts map[string]config.AccountMapping
+	denies      config.DenyMatcher
+	// templates are the parsed templates of the mappings
+	templates                 template.Set
 	filename                  string
 	userIDStrict              bool
 	usernamePrefixReserveList []string
 
 	dynamicFileInitDone bool
+	// synced is set once the dynamic file has been loaded, or found deleted
+	synced bool
 }
 
 type DynamicFileData struct {
@@ -40,7 +54,10 @@ type DynamicFileData struct {
 	UserMappings []config.UserMapping `json:"mapUsers"`
 	// AutoMappedAWSAccounts is a list of AWS accounts that are allowed without an explicit user/role mapping.
 	// IAM ARN from these accounts automatically maps to the Kubernetes username.
-	AutoMappedAWSAccounts []string `json:"mapAccounts"`
+	AutoMappedAWSAccounts []config.AccountMapping `json:"mapAccounts"`
+	// DenyMappings is a list of identities that are denied, even if a role,
+	// user or account mapping allows them.
+	DenyMappings []config.DenyMapping `json:"mapDenies"`
 }
 
 type ErrParsingMap struct {
@@ -62,15 +79,25 @@ func NewDynamicFileMapStore(cfg config.Config) (*DynamicFileMapStore, error) {
 func (ms *DynamicFileMapStore) saveMap(
 	userMappings []config.UserMapping,
 	roleMappings []config.RoleMapping,
-	awsAccounts []string) {
+	awsAccounts []config.AccountMapping,
+	denies config.DenyMatcher) {
 
 	ms.mutex.Lock()
 	defer ms.mutex.Unlock()
 	ms.users = make(map[string]config.UserMapping)
 	ms.roles = make(map[string]config.RoleMapping)
-	ms.awsAccounts = make(map[string]interface{})
+	ms.awsAccounts = make(map[string]config.AccountMapping)
+	ms.rolePatterns = arn.Patterns[config.RoleMapping]{}
+	ms.userPatterns = arn.Patterns[config.UserMapping]{}
 
 	for _, user := range userMappings {
+		if !ms.userIDStrict && arn.IsPattern(user.UserARN) {
+			key := strings.ToLower(user.UserARN)
+			ms.users[key] = user
+			// validated when the file was loaded
+			_ = ms.userPatterns.Add(key, user)
+			continue
+		}
 		_, key, _ := arn.Canonicalize(strings.ToLower(user.UserARN))
 		if ms.userIDStrict {
 			key = user.UserId
@@ -78,6 +105,12 @@ func (ms *DynamicFileMapStore) saveMap(
 		ms.users[key] = user
 	}
 	for _, role := range roleMappings {
+		if !ms.userIDStrict && arn.IsPattern(role.RoleARN) {
+			key := strings.ToLower(role.RoleARN)
+			ms.roles[key] = role
+			_ = ms.rolePatterns.Add(key, role)
+			continue
+		}
 		_, key, _ := arn.Canonicalize(strings.ToLower(role.RoleARN))
 		if ms.userIDStrict {
 			key = role.UserId
@@ -85,35 +118,104 @@ func (ms *DynamicFileMapStore) saveMap(
 		ms.roles[key] = role
 	}
 	for _, awsAccount := range awsAccounts {
-		ms.awsAccounts[awsAccount] = nil
+		ms.awsAccounts[awsAccount.Key()] = awsAccount
 	}
+	ms.denies = denies
+	ms.templates = mapper.ParseTemplates(mapper.Mappings{
+		RoleMappings: roleMappings,
+		UserMappings: userMappings,
+		AWSAccounts:  awsAccounts,
+	})
+	ms.synced = true
+}
+
+// Template returns the parsed template of pattern if a mapping has it, or nil.
+func (ms *DynamicFileMapStore) Template(pattern string) *template.Template {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+	return ms.templates[pattern]
+}
+
+// HasSynced returns true once the dynamic file has been loaded.
+func (ms *DynamicFileMapStore) HasSynced() bool {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+	return ms.synced
 }
 
+// UserMapping returns the mapping of key, or of the most specific user ARN
+// pattern that matches it.
 func (ms *DynamicFileMapStore) UserMapping(key string) (config.UserMapping, error) {
 	ms.mutex.RLock()
 	defer ms.mutex.RUnlock()
-	if user, ok := ms.users[key]; !ok {
-		return config.UserMapping{}, errutil.ErrNotMapped
-	} else {
+	now := time.Now()
+	if user, ok := ms.users[key]; ok && user.IsActive(now) {
 		return user, nil
 	}
+	if user, ok := ms.userPatterns.Find(key, func(user config.UserMapping) bool {
+		return user.IsActive(now)
+	}); ok {
+		return user, nil
+	}
+	return config.UserMapping{}, errutil.ErrNotMapped
 }
 
+// RoleMapping returns the mapping of key, or of the most specific role ARN
+// pattern that matches it.
 func (ms *DynamicFileMapStore) RoleMapping(key string) (config.RoleMapping, error) {
 	ms.mutex.RLock()
 	defer ms.mutex.RUnlock()
-	if role, ok := ms.roles[key]; !ok {
-		return config.RoleMapping{}, errutil.ErrNotMapped
-	} else {
+	now := time.Now()
+	if role, ok := ms.roles[key]; ok && role.IsActive(now) {
 		return role, nil
 	}
+	if role, ok := ms.rolePatterns.Find(key, func(role config.RoleMapping) bool {
+		return role.IsActive(now)
+	}); ok {
+		return role, nil
+	}
+	return config.RoleMapping{}, errutil.ErrNotMapped
 }
 
 func (ms *DynamicFileMapStore) AWSAccount(id string) bool {
+	return ms.AccountMapping(id) != nil
+}
+
+// AccountMapping returns the mapping of account id, or nil if it isn't in
+// mapAccounts.
+func (ms *DynamicFileMapStore) AccountMapping(id string) *config.AccountMapping {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+	if account, ok := ms.awsAccounts[id]; ok {
+		return &account
+	}
+	return nil
+}
+
+// DenyMapping returns the deny mapping that matches identity, or nil.
+func (ms *DynamicFileMapStore) DenyMapping(identity *token.Identity) *config.DenyMapping {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+	return ms.denies.Match(identity)
+}
+
+// Mappings returns a snapshot of the mappings loaded from the dynamic file.
+func (ms *DynamicFileMapStore) Mappings() mapper.Mappings {
 	ms.mutex.RLock()
 	defer ms.mutex.RUnlock()
-	_, ok := ms.awsAccounts[id]
-	return ok
+	var mappings mapper.Mappings
+	for _, role := range ms.roles {
+		mappings.RoleMappings = append(mappings.RoleMappings, role)
+	}
+	for _, user := range ms.users {
+		mappings.UserMappings = append(mappings.UserMappings, user)
+	}
+	for _, account := range ms.awsAccounts {
+		mappings.AWSAccounts = append(mappings.AWSAccounts, account)
+	}
+	mappings.DenyMappings = append(mappings.DenyMappings, ms.denies.Mappings()...)
+	mappings.Sort()
+	return mappings
 }
 
 func (ms *DynamicFileMapStore) LogMapping() {
@@ -125,9 +227,12 @@ func (ms *DynamicFileMapStore) LogMapping() {
 	for _, role := range ms.roles {
 		logrus.Info(role)
 	}
-	for awsAccount, _ := range ms.awsAccounts {
+	for _, awsAccount := range ms.awsAccounts {
 		logrus.Info(awsAccount)
 	}
+	for _, deny := range ms.denies.Mappings() {
+		logrus.Info(deny)
+	}
 }
 
 func (ms *DynamicFileMapStore) CallBackForFileLoad(dynamicContent []byte) error {
@@ -148,6 +253,14 @@ func (ms *DynamicFileMapStore) CallBackForFileLoad(dynamicContent []byte) error
 		}
 		if key == "" {
 			errs = append(errs, fmt.Errorf("Value for userarn or userid(if dynamicfileUserIDStrict = true) must be supplied"))
+		} else if err := config.ValidateARNPattern(userMapping.UserARN); err != nil {
+			errs = append(errs, err)
+		} else if err := config.ValidateTemplates(userMapping.Username, userMapping.Groups); err != nil {
+			errs = append(errs, err)
+		} else if err := config.ValidateExtra(userMapping.Extra); err != nil {
+			errs = append(errs, err)
+		} else if err := config.ValidateActivePeriod(userMapping.NotBefore, userMapping.ExpiresAt); err != nil {
+			errs = append(errs, err)
 		} else {
 			userMappings = append(userMappings, userMapping)
 		}
@@ -160,19 +273,44 @@ func (ms *DynamicFileMapStore) CallBackForFileLoad(dynamicContent []byte) error
 		}
 		if key == "" {
 			errs = append(errs, fmt.Errorf("Value for rolearn or userid(if dynamicfileUserIDStrict = true) must be supplied"))
+		} else if err := config.ValidateARNPattern(roleMapping.RoleARN); err != nil {
+			errs = append(errs, err)
+		} else if err := config.ValidateTemplates(roleMapping.Username, roleMapping.Groups); err != nil {
+			errs = append(errs, err)
+		} else if err := config.ValidateExtra(roleMapping.Extra); err != nil {
+			errs = append(errs, err)
+		} else if err := config.ValidateActivePeriod(roleMapping.NotBefore, roleMapping.ExpiresAt); err != nil {
+			errs = append(errs, err)
 		} else {
 			roleMappings = append(roleMappings, roleMapping)
 		}
 	}
 
-	awsAccounts := dynamicFileData.AutoMappedAWSAccounts[:]
+	for _, denyMapping := range dynamicFileData.DenyMappings {
+		if err := denyMapping.Validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	awsAccounts := make([]config.AccountMapping, 0)
+	for _, accountMapping := range dynamicFileData.AutoMappedAWSAccounts {
+		if err := accountMapping.Validate(); err != nil {
+			errs = append(errs, err)
+		} else {
+			awsAccounts = append(awsAccounts, accountMapping)
+		}
+	}
 
 	if len(errs) > 0 {
 		logrus.Warnf("ParseMap: Errors parsing dynamic file: %+v", errs)
 		err = ErrParsingMap{errors: errs}
 		return err
 	}
-	ms.saveMap(userMappings, roleMappings, awsAccounts)
+	denies, err := config.NewDenyMatcher(dynamicFileData.DenyMappings)
+	if err != nil {
+		return ErrParsingMap{errors: []error{err}}
+	}
+	ms.saveMap(userMappings, roleMappings, awsAccounts, denies)
 
 	// when instance or container restarts, the dynamic file is (re)loaded and the latency metric is calculated
 	// regardless if there was a change upstream, and thus can emit an incorrect latency value
@@ -199,7 +337,7 @@ func (ms *DynamicFileMapStore) CallBackForFileLoad(dynamicContent []byte) error
 func (ms *DynamicFileMapStore) CallBackForFileDeletion() error {
 	userMappings := make([]config.UserMapping, 0)
 	roleMappings := make([]config.RoleMapping, 0)
-	awsAccounts := make([]string, 0)
-	ms.saveMap(userMappings, roleMappings, awsAccounts)
+	awsAccounts := make([]config.AccountMapping, 0)
+	ms.saveMap(userMappings, roleMappings, awsAccounts, config.DenyMatcher{})
 	return nil
 }
@@ -38,6 +38,10 @@ func (m *DynamicFileMapper) Start(stopCh <-chan struct{}) error {
 	return nil
 }
 
+func (m *DynamicFileMapper) HasSynced() bool {
+	return m.DynamicFileMapStore.HasSynced()
+}
+
 func (m *DynamicFileMapper) Map(identity *token.Identity) (*config.IdentityMapping, error) {
 	canonicalARN := strings.ToLower(identity.CanonicalARN)
 
@@ -79,10 +83,18 @@ func (m *DynamicFileMapper) match(canonicalARN string, mappingARN string) error
 	return nil
 }
 
-func (m *DynamicFileMapper) IsAccountAllowed(accountID string) bool {
-	return m.AWSAccount(accountID)
+func (m *DynamicFileMapper) Deny(identity *token.Identity) (*config.DenyMapping, error) {
+	return m.DenyMapping(identity), nil
+}
+
+func (m *DynamicFileMapper) AccountMapping(accountID string) *config.AccountMapping {
+	return m.DynamicFileMapStore.AccountMapping(accountID)
 }
 
 func (m *DynamicFileMapper) UsernamePrefixReserveList() []string {
 	return m.usernamePrefixReserveList
 }
+
+func (m *DynamicFileMapper) Mappings() mapper.Mappings {
+	return m.DynamicFileMapStore.Mappings()
+}
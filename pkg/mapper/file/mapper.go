@@ -3,19 +3,29 @@ package file
 import (
 	"fmt"
 	"strings"
+	"time"
 
+	"github.com/sirupsen/logrus"
 	"sigs.k8s.io/aws-iam-authenticator/pkg/errutil"
 	"sigs.k8s.io/aws-iam-authenticator/pkg/token"
 
 	"sigs.k8s.io/aws-iam-authenticator/pkg/arn"
 	"sigs.k8s.io/aws-iam-authenticator/pkg/config"
 	"sigs.k8s.io/aws-iam-authenticator/pkg/mapper"
+	"sigs.k8s.io/aws-iam-authenticator/pkg/template"
 )
 
 type FileMapper struct {
-	roleMap                   map[string]config.RoleMapping
-	userMap                   map[string]config.UserMapping
-	accountMap                map[string]bool
+	roleMap    map[string]config.RoleMapping
+	userMap    map[string]config.UserMapping
+	accountMap map[string]config.AccountMapping
+	// rolePatterns and userPatterns are the mappings with an ARN pattern or
+	// SSO matcher, the others are looked up in roleMap and userMap
+	rolePatterns arn.Patterns[config.RoleMapping]
+	userPatterns arn.Patterns[config.UserMapping]
+	denies       config.DenyMatcher
+	// templates are the parsed templates of the mappings
+	templates                 template.Set
 	usernamePrefixReserveList []string
 }
 
@@ -25,7 +35,7 @@ func NewFileMapper(cfg config.Config) (*FileMapper, error) {
 	fileMapper := &FileMapper{
 		roleMap:    make(map[string]config.RoleMapping),
 		userMap:    make(map[string]config.UserMapping),
-		accountMap: make(map[string]bool),
+		accountMap: make(map[string]config.AccountMapping),
 	}
 
 	for _, m := range cfg.RoleMappings {
@@ -33,7 +43,7 @@ func NewFileMapper(cfg config.Config) (*FileMapper, error) {
 		if err != nil {
 			return nil, err
 		}
-		if m.RoleARN != "" {
+		if m.RoleARN != "" && !arn.IsPattern(m.RoleARN) {
 			_, canonicalizedARN, err := arn.Canonicalize(m.RoleARN)
 			if err != nil {
 				return nil, err
@@ -48,7 +58,9 @@ func NewFileMapper(cfg config.Config) (*FileMapper, error) {
 			return nil, err
 		}
 		var key string
-		if m.UserARN != "" {
+		if arn.IsPattern(m.UserARN) {
+			key = strings.ToLower(m.UserARN)
+		} else if m.UserARN != "" {
 			_, canonicalizedARN, err := arn.Canonicalize(strings.ToLower(m.UserARN))
 			if err != nil {
 				return nil, fmt.Errorf("error canonicalizing ARN: %v", err)
@@ -58,7 +70,21 @@ func NewFileMapper(cfg config.Config) (*FileMapper, error) {
 		fileMapper.userMap[key] = m
 	}
 	for _, m := range cfg.AutoMappedAWSAccounts {
-		fileMapper.accountMap[m] = true
+		if err := m.Validate(); err != nil {
+			return nil, err
+		}
+		fileMapper.accountMap[m.Key()] = m
+	}
+	for _, m := range cfg.DenyMappings {
+		if err := m.Validate(); err != nil {
+			return nil, err
+		}
+		if err := fileMapper.denies.Add(m); err != nil {
+			return nil, err
+		}
+	}
+	if err := fileMapper.indexPatterns(); err != nil {
+		return nil, err
 	}
 	if value, exists := cfg.ReservedPrefixConfig[mapper.ModeMountedFile]; exists {
 		fileMapper.usernamePrefixReserveList = value.UsernamePrefixReserveList
@@ -70,11 +96,43 @@ func NewFileMapperWithMaps(
 	lowercaseRoleMap map[string]config.RoleMapping,
 	lowercaseUserMap map[string]config.UserMapping,
 	accountMap map[string]bool) *FileMapper {
-	return &FileMapper{
+	fileMapper := &FileMapper{
 		roleMap:    lowercaseRoleMap,
 		userMap:    lowercaseUserMap,
-		accountMap: accountMap,
+		accountMap: make(map[string]config.AccountMapping),
 	}
+	for accountID, allowed := range accountMap {
+		if allowed {
+			fileMapper.accountMap[accountID] = config.AccountMapping{AccountID: accountID}
+		}
+	}
+	if err := fileMapper.indexPatterns(); err != nil {
+		logrus.WithError(err).Error("invalid ARN pattern in mappings")
+	}
+	return fileMapper
+}
+
+// indexPatterns adds the role and user mappings keyed by an ARN pattern to
+// rolePatterns and userPatterns, and parses the templates of the mappings
+func (m *FileMapper) indexPatterns() error {
+	m.templates = mapper.ParseTemplates(m.Mappings())
+	m.rolePatterns = arn.Patterns[config.RoleMapping]{}
+	m.userPatterns = arn.Patterns[config.UserMapping]{}
+	for key, role := range m.roleMap {
+		if arn.IsPattern(key) {
+			if err := m.rolePatterns.Add(key, role); err != nil {
+				return err
+			}
+		}
+	}
+	for key, user := range m.userMap {
+		if arn.IsPattern(key) {
+			if err := m.userPatterns.Add(key, user); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
 func (m *FileMapper) Name() string {
@@ -85,31 +143,67 @@ func (m *FileMapper) Start(_ <-chan struct{}) error {
 	return nil
 }
 
+// HasSynced always returns true, the mappings are loaded when the mapper is created.
+func (m *FileMapper) HasSynced() bool {
+	return true
+}
+
+// Map looks the identity up by its canonical ARN first, and only then
+// matches it against the ARN patterns, from the most to the least specific.
 func (m *FileMapper) Map(identity *token.Identity) (*config.IdentityMapping, error) {
 	canonicalARN := strings.ToLower(identity.CanonicalARN)
-	for _, roleMapping := range m.roleMap {
-		if roleMapping.Matches(canonicalARN) {
-			return &config.IdentityMapping{
-				IdentityARN: canonicalARN,
-				Username:    roleMapping.Username,
-				Groups:      roleMapping.Groups,
-			}, nil
-		}
+	now := time.Now()
+	if roleMapping, exists := m.roleMap[canonicalARN]; exists && roleMapping.IsActive(now) {
+		return roleMapping.IdentityMapping(identity), nil
 	}
-	if userMapping, exists := m.userMap[canonicalARN]; exists {
-		return &config.IdentityMapping{
-			IdentityARN: canonicalARN,
-			Username:    userMapping.Username,
-			Groups:      userMapping.Groups,
-		}, nil
+	if userMapping, exists := m.userMap[canonicalARN]; exists && userMapping.IsActive(now) {
+		return userMapping.IdentityMapping(identity), nil
+	}
+	if roleMapping, exists := m.rolePatterns.Find(canonicalARN, func(roleMapping config.RoleMapping) bool {
+		// SSO matchers only match with the SSORoleMatch feature enabled
+		return roleMapping.MatchEnabled() && roleMapping.IsActive(now)
+	}); exists {
+		return roleMapping.IdentityMapping(identity), nil
+	}
+	if userMapping, exists := m.userPatterns.Find(canonicalARN, func(userMapping config.UserMapping) bool {
+		return userMapping.IsActive(now)
+	}); exists {
+		return userMapping.IdentityMapping(identity), nil
 	}
 	return nil, errutil.ErrNotMapped
 }
 
-func (m *FileMapper) IsAccountAllowed(accountID string) bool {
-	return m.accountMap[accountID]
+func (m *FileMapper) Deny(identity *token.Identity) (*config.DenyMapping, error) {
+	return m.denies.Match(identity), nil
+}
+
+func (m *FileMapper) AccountMapping(accountID string) *config.AccountMapping {
+	if accountMapping, exists := m.accountMap[accountID]; exists {
+		return &accountMapping
+	}
+	return nil
 }
 
 func (m *FileMapper) UsernamePrefixReserveList() []string {
 	return m.usernamePrefixReserveList
 }
+
+func (m *FileMapper) Template(pattern string) *template.Template {
+	return m.templates[pattern]
+}
+
+func (m *FileMapper) Mappings() mapper.Mappings {
+	var mappings mapper.Mappings
+	for _, role := range m.roleMap {
+		mappings.RoleMappings = append(mappings.RoleMappings, role)
+	}
+	for _, user := range m.userMap {
+		mappings.UserMappings = append(mappings.UserMappings, user)
+	}
+	for _, account := range m.accountMap {
+		mappings.AWSAccounts = append(mappings.AWSAccounts, account)
+	}
+	mappings.DenyMappings = append(mappings.DenyMappings, m.denies.Mappings()...)
+	mappings.Sort()
+	return mappings
+}
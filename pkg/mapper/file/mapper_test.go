@@ -4,8 +4,10 @@ import (
 	"reflect"
 	"sigs.k8s.io/aws-iam-authenticator/pkg/token"
 	"testing"
+	"time"
 
 	"sigs.k8s.io/aws-iam-authenticator/pkg/config"
+	"sigs.k8s.io/aws-iam-authenticator/pkg/errutil"
 )
 
 func init() {
@@ -42,7 +44,7 @@ func newConfig() config.Config {
 				Groups:   []string{"system:masters"},
 			},
 		},
-		AutoMappedAWSAccounts: []string{"000000000000"},
+		AutoMappedAWSAccounts: []config.AccountMapping{{AccountID: "000000000000"}},
 	}
 }
 
@@ -77,16 +79,30 @@ func TestNewFileMapper(t *testing.T) {
 				Groups:   []string{"system:masters"},
 			},
 		},
-		accountMap: map[string]bool{
-			"000000000000": true,
+		accountMap: map[string]config.AccountMapping{
+			"000000000000": {AccountID: "000000000000"},
 		},
 	}
+	if err := expected.indexPatterns(); err != nil {
+		t.Fatal(err)
+	}
 
 	actual, err := NewFileMapper(cfg)
 	if err != nil {
 		t.Errorf("Could not build FileMapper from test config: %v", err)
 	}
 
+	// parsed templates hold functions, they are compared by pattern
+	if len(actual.templates) != len(expected.templates) {
+		t.Errorf("FileMapper parsed %d templates, expected %d", len(actual.templates), len(expected.templates))
+	}
+	for pattern := range expected.templates {
+		if actual.templates[pattern] == nil {
+			t.Errorf("FileMapper did not parse template %q", pattern)
+		}
+	}
+	expected.templates = actual.templates
+
 	if !reflect.DeepEqual(actual, expected) {
 		t.Errorf("FileMapper does not match expected value.\nActual:   %v\nExpected: %v", actual, expected)
 	}
@@ -106,6 +122,7 @@ func TestMap(t *testing.T) {
 		IdentityARN: identityArn,
 		Username:    "shreyas",
 		Groups:      []string{"system:masters"},
+		Source:      identityArn,
 	}
 	actual, err := fm.Map(&identity)
 	if err != nil {
@@ -123,6 +140,7 @@ func TestMap(t *testing.T) {
 		IdentityARN: identityArn,
 		Username:    "cookie-cutter",
 		Groups:      []string{"system:masters"},
+		Source:      "arn:aws:iam::012345678910:role/awsreservedsso_cookiecutterpermissions_*",
 	}
 	actual, err = fm.Map(&identity)
 	if err != nil {
@@ -140,6 +158,7 @@ func TestMap(t *testing.T) {
 		IdentityARN: identityArn,
 		Username:    "donald",
 		Groups:      []string{"system:masters"},
+		Source:      identityArn,
 	}
 	actual, err = fm.Map(&identity)
 	if err != nil {
@@ -149,3 +168,86 @@ func TestMap(t *testing.T) {
 		t.Errorf("FileMapper.Map() does not match expected value for userMapping:\nActual:   %v\nExpected: %v", actual, expected)
 	}
 }
+
+func TestMapActivePeriod(t *testing.T) {
+	past := time.Now().Add(-time.Hour)
+	future := time.Now().Add(time.Hour)
+	fm, err := NewFileMapper(config.Config{
+		RoleMappings: []config.RoleMapping{
+			{RoleARN: "arn:aws:iam::012345678910:role/breakglass", Username: "breakglass", Groups: []string{"system:masters"}, ExpiresAt: &past},
+			{RoleARN: "arn:aws:iam::012345678910:role/oncall", Username: "oncall", Groups: []string{"system:masters"}, NotBefore: &past, ExpiresAt: &future},
+		},
+		UserMappings: []config.UserMapping{
+			{UserARN: "arn:aws:iam::012345678910:user/donald", Username: "donald", NotBefore: &future},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Could not build FileMapper: %v", err)
+	}
+
+	for arn, mapped := range map[string]bool{
+		"arn:aws:iam::012345678910:role/breakglass": false,
+		"arn:aws:iam::012345678910:role/oncall":     true,
+		"arn:aws:iam::012345678910:user/donald":     false,
+	} {
+		_, err := fm.Map(&token.Identity{CanonicalARN: arn})
+		if mapped && err != nil {
+			t.Errorf("Could not map %s: %s", arn, err)
+		} else if !mapped && err != errutil.ErrNotMapped {
+			t.Errorf("Expected %s not to be mapped outside of its active period, got %v", arn, err)
+		}
+	}
+
+	_, err = NewFileMapper(config.Config{
+		RoleMappings: []config.RoleMapping{{RoleARN: "arn:aws:iam::012345678910:role/oncall", NotBefore: &future, ExpiresAt: &past}},
+	})
+	if err == nil {
+		t.Errorf("Expected an error for a mapping that expires before it starts")
+	}
+}
+
+func TestMapARNPatterns(t *testing.T) {
+	past := time.Now().Add(-time.Hour)
+	fm, err := NewFileMapper(config.Config{
+		RoleMappings: []config.RoleMapping{
+			{RoleARN: "arn:aws:iam::*:role/eks-admin-*", Username: "admin:{{SessionName}}", Groups: []string{"system:masters"}},
+			{RoleARN: "arn:aws:iam::012345678910:role/eks-admin-*", Username: "local-admin:{{SessionName}}", Groups: []string{"system:masters"}},
+			{RoleARN: "arn:aws:iam::012345678910:role/eks-admin-readonly", Username: "readonly", Groups: []string{"readonly"}},
+			{RoleARN: "arn:aws:iam::012345678910:role/eks-admin-old*", Username: "old", ExpiresAt: &past},
+		},
+		UserMappings: []config.UserMapping{
+			{UserARN: "arn:aws:iam::012345678910:user/ops-*", Username: "ops", Groups: []string{"ops"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Could not build FileMapper: %v", err)
+	}
+
+	for arn, username := range map[string]string{
+		// an exact ARN wins over the patterns
+		"arn:aws:iam::012345678910:role/eks-admin-readonly": "readonly",
+		// then the most specific pattern
+		"arn:aws:iam::012345678910:role/eks-admin-alice": "local-admin:{{SessionName}}",
+		"arn:aws:iam::111122223333:role/EKS-Admin-Alice": "admin:{{SessionName}}",
+		// expired patterns are skipped
+		"arn:aws:iam::012345678910:role/eks-admin-oldtimer": "local-admin:{{SessionName}}",
+		"arn:aws:iam::012345678910:user/ops-bob":            "ops",
+	} {
+		mapping, err := fm.Map(&token.Identity{CanonicalARN: arn})
+		if err != nil {
+			t.Errorf("Could not map %s: %s", arn, err)
+		} else if mapping.Username != username {
+			t.Errorf("Expected %s to be mapped to %s, got %s", arn, username, mapping.Username)
+		}
+	}
+	if _, err := fm.Map(&token.Identity{CanonicalARN: "arn:aws:iam::012345678910:role/developer"}); err != errutil.ErrNotMapped {
+		t.Errorf("Expected a role that matches no pattern not to be mapped, got %v", err)
+	}
+
+	_, err = NewFileMapper(config.Config{
+		RoleMappings: []config.RoleMapping{{RoleARN: "arn:aws:iam::*", Username: "invalid"}},
+	})
+	if err == nil {
+		t.Errorf("Expected an error for an invalid ARN pattern")
+	}
+}
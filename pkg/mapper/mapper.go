@@ -2,12 +2,14 @@ package mapper
 
 import (
 	"fmt"
+	"sort"
 
 	"sigs.k8s.io/aws-iam-authenticator/pkg/token"
 
 	"github.com/sirupsen/logrus"
 	"k8s.io/apimachinery/pkg/util/sets"
 	"sigs.k8s.io/aws-iam-authenticator/pkg/config"
+	"sigs.k8s.io/aws-iam-authenticator/pkg/template"
 )
 
 const (
@@ -38,9 +40,81 @@ type Mapper interface {
 	Name() string
 	// Start must be non-blocking
 	Start(stopCh <-chan struct{}) error
+	// HasSynced returns true once the mapper has loaded its mappings at
+	// least once, before that Map may deny identities that will be mapped.
+	HasSynced() bool
 	Map(identity *token.Identity) (*config.IdentityMapping, error)
-	IsAccountAllowed(accountID string) bool
+	// Deny returns the deny mapping that matches identity, or nil. A deny
+	// mapping of any mapper takes precedence over the allows of every mapper.
+	Deny(identity *token.Identity) (*config.DenyMapping, error)
+	// AccountMapping returns the mapping of an account in mapAccounts, or nil
+	// if identities of the account aren't allowed without a role or user mapping.
+	AccountMapping(accountID string) *config.AccountMapping
 	UsernamePrefixReserveList() []string
+	// Mappings returns a snapshot of the mappings currently loaded
+	Mappings() Mappings
+	// Template returns the parsed username, group or extra template of a
+	// mapping currently loaded, or nil if no mapping has pattern.
+	Template(pattern string) *template.Template
+}
+
+// Mappings is a snapshot of the mappings a Mapper has loaded, as served by the
+// admin /debug/mappings endpoint.
+type Mappings struct {
+	RoleMappings []config.RoleMapping    `json:"mapRoles"`
+	UserMappings []config.UserMapping    `json:"mapUsers"`
+	AWSAccounts  []config.AccountMapping `json:"mapAccounts"`
+	DenyMappings []config.DenyMapping    `json:"mapDenies,omitempty"`
+}
+
+// Sort orders the mappings by ARN (or UserId, or SSO permission set), the
+// accounts by ID and the deny mappings by key, so that snapshots are stable.
+func (m *Mappings) Sort() {
+	sort.SliceStable(m.RoleMappings, func(i, j int) bool {
+		return m.RoleMappings[i].Key() < m.RoleMappings[j].Key()
+	})
+	sort.SliceStable(m.UserMappings, func(i, j int) bool {
+		return m.UserMappings[i].Key() < m.UserMappings[j].Key()
+	})
+	sort.SliceStable(m.AWSAccounts, func(i, j int) bool {
+		return m.AWSAccounts[i].Key() < m.AWSAccounts[j].Key()
+	})
+	sort.SliceStable(m.DenyMappings, func(i, j int) bool {
+		return m.DenyMappings[i].Key() < m.DenyMappings[j].Key()
+	})
+}
+
+// ParseTemplates parses the username, groups and extra patterns of the
+// mappings, so that they aren't parsed for each identity. The mappings have
+// been validated: a pattern that doesn't parse is left out, and fails when it
+// is rendered.
+func ParseTemplates(mappings Mappings) template.Set {
+	templates := template.Set{}
+	add := func(username string, groups []string, extra map[string][]string) {
+		_ = templates.Add(username)
+		for _, group := range groups {
+			_ = templates.Add(group)
+		}
+		for _, patterns := range extra {
+			for _, pattern := range patterns {
+				_ = templates.Add(pattern)
+			}
+		}
+	}
+	for _, m := range mappings.RoleMappings {
+		add(m.Username, m.Groups, m.Extra)
+	}
+	for _, m := range mappings.UserMappings {
+		add(m.Username, m.Groups, m.Extra)
+	}
+	for _, m := range mappings.AWSAccounts {
+		username := m.Username
+		if username == "" {
+			username = config.DefaultAccountUsername
+		}
+		add(username, m.Groups, m.Extra)
+	}
+	return templates
 }
 
 func ValidateBackendMode(modes []string) []error {
@@ -13,6 +13,33 @@ const (
 	STSThrottling = "sts_throttling"
 	Unknown       = "uknown_user"
 	Success       = "success"
+	RateLimited   = "rate_limited"
+
+	// Limits that can reject an authenticate request before it reaches STS
+	LimitInFlight  = "in_flight"
+	LimitGlobal    = "global"
+	LimitAccessKey = "access_key"
+
+	// Results of a verified-token cache lookup
+	CacheHit         = "hit"
+	CacheNegativeHit = "negative_hit"
+	CacheMiss        = "miss"
+
+	// Results of checking that a verified token wasn't used before
+	ReplayFirstUse = "first_use"
+	ReplayGrace    = "grace"
+	ReplayRejected = "rejected"
+	ReplayError    = "error"
+
+	// Results of looking up an identity in a mapper
+	MappingHit   = "hit"
+	MappingMiss  = "miss"
+	MappingError = "error"
+
+	// Results of swapping the backend mapper chain, besides Success
+	SwapBuildFailed = "build_failed"
+	SwapNotSynced   = "not_synced"
+	SwapCancelled   = "cancelled"
 )
 
 var authenticatorMetrics Metrics
@@ -45,6 +72,24 @@ type Metrics struct {
 	E2ELatency                   *prometheus.HistogramVec
 	DynamicFileEnabled           prometheus.Gauge
 	DynamicFileOnly              prometheus.Gauge
+	RateLimited                  *prometheus.CounterVec
+	TokenCache                   *prometheus.CounterVec
+	AuditErrors                  *prometheus.CounterVec
+	ServingCertExpiry            prometheus.Gauge
+	MapperChainSwaps             *prometheus.CounterVec
+	MapperChainSwapLatency       prometheus.Histogram
+	StsLatency                   *prometheus.HistogramVec
+	MappingLatency               *prometheus.HistogramVec
+	TemplateFailures             *prometheus.CounterVec
+	EC2DescribeInstancesLatency  prometheus.Histogram
+	MappingsExpiringSoon         *prometheus.GaugeVec
+	MappingsExpired              *prometheus.GaugeVec
+	ClusterIDTokens              *prometheus.CounterVec
+	ClusterIDMismatches          *prometheus.CounterVec
+	StsRetries                   *prometheus.CounterVec
+	StsCircuitOpen               *prometheus.GaugeVec
+	TokenReplays                 *prometheus.CounterVec
+	CoalescedVerifications       prometheus.Counter
 }
 
 func createMetrics(reg prometheus.Registerer) Metrics {
@@ -124,5 +169,135 @@ func createMetrics(reg prometheus.Registerer) Metrics {
 				Help:      "Only dynamic file in backend mode is enabled",
 			},
 		),
+		RateLimited: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: Namespace,
+				Name:      "authenticate_rate_limited_total",
+				Help:      "Authenticate requests rejected before calling STS, partitioned by the limit that was hit",
+			}, []string{"limit"},
+		),
+		TokenCache: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: Namespace,
+				Name:      "token_cache_requests_total",
+				Help:      "Verified-token cache lookups, partitioned by hit, negative_hit or miss",
+			}, []string{"result"},
+		),
+		CoalescedVerifications: factory.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: Namespace,
+				Name:      "token_verifications_coalesced_total",
+				Help:      "Token verifications that waited for, and shared the result of, the verification of the same token already in flight",
+			},
+		),
+		TokenReplays: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: Namespace,
+				Name:      "token_replay_checks_total",
+				Help:      "Single-use checks of verified tokens, partitioned by first_use, grace, rejected or error",
+			}, []string{"result"},
+		),
+		AuditErrors: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: Namespace,
+				Name:      "audit_errors_total",
+				Help:      "Audit records that could not be written or sent, partitioned by sink",
+			}, []string{"sink"},
+		),
+		ServingCertExpiry: factory.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: Namespace,
+				Name:      "serving_certificate_expiration_timestamp_seconds",
+				Help:      "Expiration of the certificate currently served, in seconds since the epoch",
+			},
+		),
+		MapperChainSwaps: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: Namespace,
+				Name:      "mapper_chain_swaps_total",
+				Help:      "Attempts to swap the backend mapper chain, partitioned by success, build_failed, not_synced or cancelled",
+			}, []string{"result"},
+		),
+		MapperChainSwapLatency: factory.NewHistogram(
+			prometheus.HistogramOpts{
+				Namespace: Namespace,
+				Name:      "mapper_chain_swap_duration_seconds",
+				Help:      "Time from building a new backend mapper chain to it becoming active",
+				Buckets:   []float64{0.1, 0.5, 1, 5, 10, 30, 60, 120, 300},
+			},
+		),
+		StsRetries: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: Namespace,
+				Name:      "sts_retries_total",
+				Help:      "Sts calls retried after failing to connect or a 5xx response",
+			}, []string{"StsRegion"},
+		),
+		StsCircuitOpen: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: Namespace,
+				Name:      "sts_circuit_breaker_open",
+				Help:      "1 while calls to an Sts region fail immediately after repeated failures, 0 otherwise",
+			}, []string{"StsRegion"},
+		),
+		StsLatency: factory.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: Namespace,
+				Name:      "sts_get_caller_identity_latency_seconds",
+				Help:      "Sts GetCallerIdentity call latency, including failed calls",
+			}, []string{"StsRegion"},
+		),
+		MappingLatency: factory.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: Namespace,
+				Name:      "mapper_latency_seconds",
+				Help:      "Latency of looking up an identity in a backend mapper, partitioned by mapper and hit, miss or error",
+				Buckets:   []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1},
+			}, []string{"mapper", "result"},
+		),
+		TemplateFailures: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: Namespace,
+				Name:      "template_render_failures_total",
+				Help:      "Mapped identities whose username or groups templates could not be rendered, partitioned by mapper",
+			}, []string{"mapper"},
+		),
+		EC2DescribeInstancesLatency: factory.NewHistogram(
+			prometheus.HistogramOpts{
+				Namespace: Namespace,
+				Name:      "ec2_describe_instances_latency_seconds",
+				Help:      "EC2 DescribeInstances call latency, including failed and batched calls",
+			},
+		),
+		MappingsExpiringSoon: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: Namespace,
+				Name:      "mappings_expiring_soon",
+				Help:      "Role and user mappings that expire within the expiry warning period, partitioned by mapper",
+			},
+			[]string{"mapper"},
+		),
+		MappingsExpired: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: Namespace,
+				Name:      "mappings_expired",
+				Help:      "Role and user mappings that have expired but are still configured, partitioned by mapper",
+			},
+			[]string{"mapper"},
+		),
+		ClusterIDTokens: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: Namespace,
+				Name:      "cluster_id_tokens_total",
+				Help:      "Tokens verified by STS, partitioned by the cluster ID they were signed for",
+			}, []string{"cluster_id"},
+		),
+		ClusterIDMismatches: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: Namespace,
+				Name:      "cluster_id_mismatches_total",
+				Help:      "STS calls made again with the next cluster ID because the token wasn't signed for this one, partitioned by this cluster ID",
+			}, []string{"cluster_id"},
+		),
 	}
 }
@@ -0,0 +1,168 @@
+/*
+Copyright 2017-2020 by the contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+
+	awsarn "github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"sigs.k8s.io/aws-iam-authenticator/pkg/config"
+	"sigs.k8s.io/aws-iam-authenticator/pkg/mapper"
+)
+
+// redacted replaces identifying fields of mappings in scrubbed accounts
+const redacted = "REDACTED"
+
+// debugMappings is the response of /debug/mappings
+type debugMappings struct {
+	BackendModes string        `json:"backendModes"`
+	Mappers      []debugMapper `json:"mappers"`
+}
+
+type debugMapper struct {
+	Name   string `json:"name"`
+	Synced bool   `json:"synced"`
+	mapper.Mappings
+}
+
+// adminHandler serves the endpoints of the admin listener. They aren't
+// authenticated: only the health checks are served unless AdminDebug is set,
+// and the admin listener should then be bound to a trusted address.
+func (h *handler) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "ok")
+	})
+	mux.HandleFunc("/readyz", h.readyzEndpoint)
+	if !h.cfg.AdminDebug {
+		return mux
+	}
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/debug/mappings", h.debugMappingsEndpoint)
+	mux.HandleFunc("/debug/explain", h.explainEndpoint)
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// debugMappingsEndpoint dumps the mappings currently loaded by each mapper in
+// the chain, in the order they are consulted.
+func (h *handler) debugMappingsEndpoint(w http.ResponseWriter, req *http.Request) {
+	backendMapper, release := h.acquireBackendMapper()
+	defer release()
+	resp := debugMappings{
+		BackendModes: backendMapper.currentModes,
+		Mappers:      []debugMapper{},
+	}
+	for _, m := range backendMapper.mappers {
+		resp.Mappers = append(resp.Mappers, debugMapper{
+			Name:     m.Name(),
+			Synced:   m.HasSynced(),
+			Mappings: h.redactMappings(m.Mappings()),
+		})
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(resp)
+}
+
+func (h *handler) isScrubbedAccount(accountID string) bool {
+	for _, account := range h.scrubbedAccounts {
+		if accountID == account {
+			return true
+		}
+	}
+	return false
+}
+
+// isScrubbedARN returns true if arn belongs to a scrubbed account
+func (h *handler) isScrubbedARN(arn string) bool {
+	parsed, err := awsarn.Parse(arn)
+	return err == nil && h.isScrubbedAccount(parsed.AccountID)
+}
+
+// redactMappings replaces the ARNs, principal IDs and account IDs of mappings
+// in scrubbed accounts.
+func (h *handler) redactMappings(mappings mapper.Mappings) mapper.Mappings {
+	if len(h.scrubbedAccounts) == 0 {
+		return mappings
+	}
+	redactedMappings := mapper.Mappings{}
+	for _, role := range mappings.RoleMappings {
+		if h.isScrubbedARN(role.RoleARN) || (role.SSO != nil && h.isScrubbedAccount(role.SSO.AccountID)) {
+			role = redactRoleMapping(role)
+		}
+		redactedMappings.RoleMappings = append(redactedMappings.RoleMappings, role)
+	}
+	for _, user := range mappings.UserMappings {
+		if h.isScrubbedARN(user.UserARN) {
+			user.UserARN = redacted
+			if user.UserId != "" {
+				user.UserId = redacted
+			}
+		}
+		redactedMappings.UserMappings = append(redactedMappings.UserMappings, user)
+	}
+	for _, account := range mappings.AWSAccounts {
+		if h.isScrubbedAccount(account.AccountID) {
+			account.AccountID = redacted
+		}
+		redactedMappings.AWSAccounts = append(redactedMappings.AWSAccounts, account)
+	}
+	for _, deny := range mappings.DenyMappings {
+		if h.isScrubbedAccount(deny.AccountID) || (deny.ARN != "" && h.isScrubbedARN(deny.ARN)) {
+			deny = redactDenyMapping(deny)
+		}
+		redactedMappings.DenyMappings = append(redactedMappings.DenyMappings, deny)
+	}
+	return redactedMappings
+}
+
+// redactDenyMapping replaces the field a deny mapping matches on, the reason
+// is kept so that it's still clear why something is denied
+func redactDenyMapping(deny config.DenyMapping) config.DenyMapping {
+	if deny.ARN != "" {
+		deny.ARN = redacted
+	}
+	if deny.AccountID != "" {
+		deny.AccountID = redacted
+	}
+	return deny
+}
+
+func redactRoleMapping(role config.RoleMapping) config.RoleMapping {
+	if role.RoleARN != "" {
+		role.RoleARN = redacted
+	}
+	if role.SSO != nil {
+		sso := *role.SSO
+		sso.AccountID = redacted
+		role.SSO = &sso
+	}
+	if role.UserId != "" {
+		role.UserId = redacted
+	}
+	return role
+}
@@ -0,0 +1,374 @@
+/*
+Copyright 2017-2020 by the contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"sigs.k8s.io/aws-iam-authenticator/pkg/config"
+	"sigs.k8s.io/aws-iam-authenticator/pkg/metrics"
+	"sigs.k8s.io/aws-iam-authenticator/pkg/token"
+)
+
+const (
+	AuditDecisionAllow = "allow"
+	AuditDecisionDeny  = "deny"
+
+	// Reasons of the denies of tokens STS didn't verify. The STS error isn't
+	// recorded, only logged.
+	AuditReasonSTSThrottled   = "sts_throttled"
+	AuditReasonSTSRejected    = "sts_rejected"
+	AuditReasonSTSUnavailable = "sts_unavailable"
+	AuditReasonSTSError       = "sts_error"
+
+	// auditWebhookBufferSize is the number of records queued for the HTTP sink
+	// before new records are dropped
+	auditWebhookBufferSize = 10000
+	// auditWebhookBatchSize is the maximum number of records sent in one request
+	auditWebhookBatchSize = 100
+	// auditWebhookFlushInterval is the longest a record waits before being sent
+	auditWebhookFlushInterval = time.Second
+	// auditWebhookTimeout bounds a single request to the HTTP sink
+	auditWebhookTimeout = 10 * time.Second
+)
+
+// AuditRecord is the structured record written for every TokenReview.
+type AuditRecord struct {
+	Timestamp time.Time `json:"timestamp"`
+	// Decision is either "allow" or "deny"
+	Decision string `json:"decision"`
+	// Reason explains a deny decision
+	Reason string `json:"reason,omitempty"`
+	// Client is the remote address of the caller, usually the API server
+	Client string `json:"client,omitempty"`
+	// Scrubbed is true when the identity is in a scrubbed account, and the
+	// identifying fields below have been left out.
+	Scrubbed     bool     `json:"scrubbed,omitempty"`
+	ARN          string   `json:"arn,omitempty"`
+	CanonicalARN string   `json:"canonicalArn,omitempty"`
+	AccountID    string   `json:"accountId,omitempty"`
+	UserID       string   `json:"userId,omitempty"`
+	SessionName  string   `json:"sessionName,omitempty"`
+	AccessKeyID  string   `json:"accessKeyId,omitempty"`
+	Mapper       string   `json:"mapper,omitempty"`
+	Username     string   `json:"username,omitempty"`
+	Groups       []string `json:"groups,omitempty"`
+	STSEndpoint  string   `json:"stsEndpoint,omitempty"`
+	// LatencySeconds is the time spent handling the TokenReview
+	LatencySeconds float64 `json:"latencySeconds"`
+}
+
+// auditReason returns the reason recorded when the verifier fails with err:
+// a fixed code for STS failures, the error otherwise.
+func auditReason(err error) string {
+	switch err := err.(type) {
+	case token.STSThrottling:
+		return AuditReasonSTSThrottled
+	case token.STSError:
+		switch err.Reason() {
+		case token.STSReasonRejected:
+			return AuditReasonSTSRejected
+		case token.STSReasonUnavailable:
+			return AuditReasonSTSUnavailable
+		default:
+			return AuditReasonSTSError
+		}
+	}
+	return err.Error()
+}
+
+// setIdentity fills in the identity fields of the record, unless loggable is
+// false in which case the record is only marked as scrubbed.
+func (r *AuditRecord) setIdentity(identity *token.Identity, loggable bool) {
+	r.STSEndpoint = identity.STSEndpoint
+	if !loggable {
+		r.Scrubbed = true
+		return
+	}
+	r.ARN = identity.ARN
+	r.CanonicalARN = identity.CanonicalARN
+	r.AccountID = identity.AccountID
+	r.UserID = identity.UserID
+	r.SessionName = identity.SessionName
+	r.AccessKeyID = identity.AccessKeyID
+}
+
+// AuditSink receives audit records. Write must not block the caller for long,
+// it is called while the TokenReview is being answered.
+type AuditSink interface {
+	Name() string
+	Write(record *AuditRecord) error
+	Close() error
+}
+
+// auditor fans audit records out to every configured sink. A nil *auditor
+// discards all records.
+type auditor struct {
+	sinks []AuditSink
+}
+
+// newAuditor builds the audit sinks configured in cfg, or returns nil if
+// auditing is not enabled.
+func newAuditor(cfg config.Config) (*auditor, error) {
+	var sinks []AuditSink
+	if cfg.AuditLogPath != "" {
+		sink, err := newAuditFileSink(cfg.AuditLogPath, int64(cfg.AuditLogMaxSizeMB)*1024*1024, cfg.AuditLogMaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+	if cfg.AuditWebhookURL != "" {
+		sinks = append(sinks, newAuditWebhookSink(cfg.AuditWebhookURL, &http.Client{Timeout: auditWebhookTimeout}))
+	}
+	if len(sinks) == 0 {
+		return nil, nil
+	}
+	return &auditor{sinks: sinks}, nil
+}
+
+func (a *auditor) audit(record *AuditRecord) {
+	if a == nil {
+		return
+	}
+	for _, sink := range a.sinks {
+		if err := sink.Write(record); err != nil {
+			logrus.WithError(err).WithField("sink", sink.Name()).Error("could not write audit record")
+			metrics.Get().AuditErrors.WithLabelValues(sink.Name()).Inc()
+		}
+	}
+}
+
+func (a *auditor) close() {
+	if a == nil {
+		return
+	}
+	for _, sink := range a.sinks {
+		if err := sink.Close(); err != nil {
+			logrus.WithError(err).WithField("sink", sink.Name()).Error("could not close audit sink")
+		}
+	}
+}
+
+// auditFileSink writes one JSON record per line to a file, rotating it once it
+// grows past maxSize. Rotated files are named <path>.1 (newest) to
+// <path>.<maxBackups> (oldest).
+type auditFileSink struct {
+	mutex      sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func newAuditFileSink(path string, maxSize int64, maxBackups int) (*auditFileSink, error) {
+	s := &auditFileSink{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *auditFileSink) Name() string {
+	return "file"
+}
+
+func (s *auditFileSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("could not open audit log %s: %v", s.path, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("could not stat audit log %s: %v", s.path, err)
+	}
+	s.file = f
+	s.size = info.Size()
+	return nil
+}
+
+func (s *auditFileSink) Write(record *AuditRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.file == nil {
+		return fmt.Errorf("audit log %s is closed", s.path)
+	}
+	if s.maxSize > 0 && s.size > 0 && s.size+int64(len(line)) > s.maxSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := s.file.Write(line)
+	s.size += int64(n)
+	return err
+}
+
+// rotate shifts the existing backups up by one and starts a new file. It must
+// be called with the mutex held.
+func (s *auditFileSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	s.file = nil
+	if s.maxBackups > 0 {
+		for i := s.maxBackups - 1; i > 0; i-- {
+			from := fmt.Sprintf("%s.%d", s.path, i)
+			if _, err := os.Stat(from); err == nil {
+				os.Rename(from, fmt.Sprintf("%s.%d", s.path, i+1))
+			}
+		}
+		if err := os.Rename(s.path, s.path+".1"); err != nil {
+			return fmt.Errorf("could not rotate audit log %s: %v", s.path, err)
+		}
+	} else if err := os.Remove(s.path); err != nil {
+		return fmt.Errorf("could not rotate audit log %s: %v", s.path, err)
+	}
+	return s.open()
+}
+
+func (s *auditFileSink) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// auditWebhookSink POSTs batches of records, as a JSON array, to an HTTP
+// endpoint. Records are queued and sent in the background so a slow endpoint
+// doesn't slow down authentication; when the queue is full records are dropped.
+type auditWebhookSink struct {
+	url     string
+	client  *http.Client
+	records chan *AuditRecord
+	done    chan struct{}
+	// mutex guards closed so that records are never sent on a closed channel
+	mutex  sync.RWMutex
+	closed bool
+}
+
+func newAuditWebhookSink(url string, client *http.Client) *auditWebhookSink {
+	s := &auditWebhookSink{
+		url:     url,
+		client:  client,
+		records: make(chan *AuditRecord, auditWebhookBufferSize),
+		done:    make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+func (s *auditWebhookSink) Name() string {
+	return "webhook"
+}
+
+func (s *auditWebhookSink) Write(record *AuditRecord) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if s.closed {
+		return fmt.Errorf("audit webhook sink is closed")
+	}
+	select {
+	case s.records <- record:
+		return nil
+	default:
+		return fmt.Errorf("audit webhook queue is full, dropping record")
+	}
+}
+
+func (s *auditWebhookSink) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(auditWebhookFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*AuditRecord, 0, auditWebhookBatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := s.send(batch); err != nil {
+			logrus.WithError(err).WithField("records", len(batch)).Error("could not send audit records")
+			metrics.Get().AuditErrors.WithLabelValues(s.Name()).Inc()
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case record, ok := <-s.records:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, record)
+			if len(batch) >= auditWebhookBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+func (s *auditWebhookSink) send(batch []*AuditRecord) error {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("audit webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Close sends any queued records and stops the sink.
+func (s *auditWebhookSink) Close() error {
+	s.mutex.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.records)
+	}
+	s.mutex.Unlock()
+	<-s.done
+	return nil
+}
@@ -0,0 +1,241 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	authenticationv1beta1 "k8s.io/api/authentication/v1beta1"
+	"sigs.k8s.io/aws-iam-authenticator/pkg/config"
+	"sigs.k8s.io/aws-iam-authenticator/pkg/mapper"
+	"sigs.k8s.io/aws-iam-authenticator/pkg/mapper/file"
+	"sigs.k8s.io/aws-iam-authenticator/pkg/token"
+)
+
+type recordingAuditSink struct {
+	mutex   sync.Mutex
+	records []*AuditRecord
+}
+
+func (s *recordingAuditSink) Name() string { return "recording" }
+
+func (s *recordingAuditSink) Write(record *AuditRecord) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.records = append(s.records, record)
+	return nil
+}
+
+func (s *recordingAuditSink) Close() error { return nil }
+
+func authenticateWithAudit(t *testing.T, h *handler) *AuditRecord {
+	t.Helper()
+	sink := &recordingAuditSink{}
+	h.auditor = &auditor{sinks: []AuditSink{sink}}
+	data, err := json.Marshal(authenticationv1beta1.TokenReview{
+		Spec: authenticationv1beta1.TokenReviewSpec{
+			Token: "token",
+		},
+	})
+	if err != nil {
+		t.Fatalf("Could not marshal in put data: %v", err)
+	}
+	h.authenticateEndpoint(httptest.NewRecorder(), httptest.NewRequest("POST", "http://k8s.io/authenticate", bytes.NewReader(data)))
+	if len(sink.records) != 1 {
+		t.Fatalf("expected 1 audit record, got %d", len(sink.records))
+	}
+	return sink.records[0]
+}
+
+func testAuditIdentity() *token.Identity {
+	return &token.Identity{
+		ARN:          "arn:aws:iam::0123456789012:role/Test",
+		CanonicalARN: "arn:aws:iam::0123456789012:role/Test",
+		AccountID:    "0123456789012",
+		UserID:       "Test",
+		SessionName:  "TestSession",
+		AccessKeyID:  "ABCDEF",
+		STSEndpoint:  "sts.amazonaws.com",
+	}
+}
+
+func testAuditMapper() BackendMapper {
+	return BackendMapper{
+		mappers: []mapper.Mapper{file.NewFileMapperWithMaps(map[string]config.RoleMapping{
+			"arn:aws:iam::0123456789012:role/test": {
+				RoleARN:  "arn:aws:iam::0123456789012:role/Test",
+				Username: "TestUser",
+				Groups:   []string{"sys:admin"},
+			},
+		}, nil, nil)},
+		mapperStopCh: make(chan struct{}),
+	}
+}
+
+func TestAuditAllow(t *testing.T) {
+	h := setup(&testVerifier{identity: testAuditIdentity()})
+	h.backendMapper = testAuditMapper()
+	record := authenticateWithAudit(t, h)
+
+	if record.Decision != AuditDecisionAllow {
+		t.Errorf("expected decision %q, got %q", AuditDecisionAllow, record.Decision)
+	}
+	if record.CanonicalARN != "arn:aws:iam::0123456789012:role/Test" || record.AccessKeyID != "ABCDEF" {
+		t.Errorf("expected the identity to be recorded, got %+v", record)
+	}
+	if record.Mapper != mapper.ModeMountedFile || record.Username != "TestUser" || len(record.Groups) != 1 {
+		t.Errorf("expected the mapping to be recorded, got %+v", record)
+	}
+	if record.STSEndpoint != "sts.amazonaws.com" {
+		t.Errorf("expected the STS endpoint to be recorded, got %q", record.STSEndpoint)
+	}
+}
+
+func TestAuditDenyVerifierError(t *testing.T) {
+	h := setup(&testVerifier{err: errors.New("There was an error")})
+	record := authenticateWithAudit(t, h)
+
+	if record.Decision != AuditDecisionDeny || record.Reason != "There was an error" {
+		t.Errorf("expected a deny with the verifier error as reason, got %+v", record)
+	}
+}
+
+func TestAuditDenySTSError(t *testing.T) {
+	for _, c := range []struct {
+		err    error
+		reason string
+	}{
+		{token.NewSTSError("error from AWS (expected 200, got 400) on global endpoint"), AuditReasonSTSError},
+		{token.NewSTSThrottling("got 400 on global endpoint"), AuditReasonSTSThrottled},
+	} {
+		h := setup(&testVerifier{err: c.err})
+		record := authenticateWithAudit(t, h)
+		if record.Decision != AuditDecisionDeny || record.Reason != c.reason {
+			t.Errorf("expected a deny with reason %q, got %+v", c.reason, record)
+		}
+	}
+}
+
+func TestAuditDenyNotMapped(t *testing.T) {
+	h := setup(&testVerifier{identity: testAuditIdentity()})
+	h.backendMapper = BackendMapper{mappers: []mapper.Mapper{file.NewFileMapperWithMaps(nil, nil, nil)}}
+	record := authenticateWithAudit(t, h)
+
+	if record.Decision != AuditDecisionDeny || record.Reason == "" {
+		t.Errorf("expected a deny with a reason, got %+v", record)
+	}
+	if record.CanonicalARN != "arn:aws:iam::0123456789012:role/Test" {
+		t.Errorf("expected the identity to be recorded, got %+v", record)
+	}
+}
+
+func TestAuditScrubbedAccount(t *testing.T) {
+	h := setup(&testVerifier{identity: testAuditIdentity()})
+	h.backendMapper = testAuditMapper()
+	h.scrubbedAccounts = []string{"0123456789012"}
+	record := authenticateWithAudit(t, h)
+
+	if !record.Scrubbed {
+		t.Errorf("expected the record to be marked as scrubbed")
+	}
+	if record.ARN != "" || record.CanonicalARN != "" || record.AccountID != "" || record.UserID != "" || record.AccessKeyID != "" || record.SessionName != "" {
+		t.Errorf("expected identifying fields to be scrubbed, got %+v", record)
+	}
+	if record.Decision != AuditDecisionAllow {
+		t.Errorf("expected decision %q, got %q", AuditDecisionAllow, record.Decision)
+	}
+}
+
+func readAuditLog(t *testing.T, path string) []AuditRecord {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("could not open %s: %v", path, err)
+	}
+	defer f.Close()
+	var records []AuditRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var record AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("could not decode audit record %q: %v", scanner.Text(), err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestAuditFileSinkRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	line, _ := json.Marshal(&AuditRecord{Decision: AuditDecisionAllow, Username: "user"})
+	// room for two records per file
+	sink, err := newAuditFileSink(path, int64(2*(len(line)+1)), 2)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i := 0; i < 7; i++ {
+		if err := sink.Write(&AuditRecord{Decision: AuditDecisionAllow, Username: "user"}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if n := len(readAuditLog(t, path)); n != 1 {
+		t.Errorf("expected 1 record in the current log, got %d", n)
+	}
+	for _, backup := range []string{path + ".1", path + ".2"} {
+		if n := len(readAuditLog(t, backup)); n != 2 {
+			t.Errorf("expected 2 records in %s, got %d", backup, n)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("expected only 2 backups to be kept")
+	}
+	if err := sink.Write(&AuditRecord{}); err == nil {
+		t.Errorf("expected an error writing to a closed sink")
+	}
+}
+
+func TestAuditWebhookSink(t *testing.T) {
+	var mutex sync.Mutex
+	var received []AuditRecord
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var batch []AuditRecord
+		if err := json.Unmarshal(body, &batch); err != nil {
+			t.Errorf("could not decode audit batch: %v", err)
+		}
+		mutex.Lock()
+		received = append(received, batch...)
+		mutex.Unlock()
+	}))
+	defer server.Close()
+
+	sink := newAuditWebhookSink(server.URL, server.Client())
+	for i := 0; i < 3; i++ {
+		if err := sink.Write(&AuditRecord{Decision: AuditDecisionDeny}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	// closing flushes the queued records
+	sink.Close()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(received) != 3 {
+		t.Errorf("expected 3 records to be sent, got %d", len(received))
+	}
+	if err := sink.Write(&AuditRecord{}); err == nil {
+		t.Errorf("expected an error writing to a closed sink")
+	}
+}
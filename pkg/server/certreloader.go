@@ -0,0 +1,259 @@
+/*
+Copyright 2017-2020 by the contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/aws-iam-authenticator/pkg/config"
+	"sigs.k8s.io/aws-iam-authenticator/pkg/config/certs"
+	"sigs.k8s.io/aws-iam-authenticator/pkg/metrics"
+)
+
+// certRotationCheckInterval is how often the serving certificate is checked for rotation
+const certRotationCheckInterval = time.Minute
+
+// certReloader serves the certificate in the state directory, reloading it
+// whenever the files change, and rotates it before it expires.
+//
+// A rotation happens in two steps so API servers never see a certificate they
+// don't trust: once the overlap window starts a next certificate is generated
+// and added to the CA bundle of the webhook kubeconfig, and half way through
+// the window it replaces the current certificate. kube-apiserver only reads the
+// webhook kubeconfig when it starts, so it must be restarted in the first half
+// of the window to trust the next certificate; rewriting the kubeconfig alone
+// doesn't change the CA bundle it trusts.
+//
+// The client certificate the API server authenticates with, when generated,
+// is rotated at the start of its overlap window. The API server reloads it
+// from disk, and the certificate it replaced stays trusted until it expires.
+type certReloader struct {
+	cfg     config.Config
+	overlap time.Duration
+	nowFunc func() time.Time
+
+	mutex sync.RWMutex
+	cert  *tls.Certificate
+	// caBundle is the CA bundle last written to (or found in) the webhook kubeconfig
+	caBundle string
+}
+
+// newCertReloader loads the serving certificate, generating it if needed.
+func newCertReloader(cfg config.Config) (*certReloader, error) {
+	if cfg.CertRotationOverlapOrDefault() >= cfg.CertLifetimeOrDefault() {
+		return nil, fmt.Errorf("cert rotation overlap %s must be shorter than the cert lifetime %s", cfg.CertRotationOverlapOrDefault(), cfg.CertLifetimeOrDefault())
+	}
+	cert, err := cfg.GetOrCreateX509KeyPair()
+	if err != nil {
+		return nil, err
+	}
+	caBundle, err := cfg.WebhookCABundle()
+	if err != nil {
+		return nil, err
+	}
+	r := &certReloader{
+		cfg:      cfg,
+		overlap:  cfg.CertRotationOverlapOrDefault(),
+		nowFunc:  time.Now,
+		caBundle: caBundle,
+	}
+	if err := r.setCertificate(cert); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.cert, nil
+}
+
+func (r *certReloader) setCertificate(cert *tls.Certificate) error {
+	leaf, err := certs.Leaf(cert)
+	if err != nil {
+		return err
+	}
+	r.mutex.Lock()
+	r.cert = cert
+	r.mutex.Unlock()
+	metrics.Get().ServingCertExpiry.Set(float64(leaf.NotAfter.Unix()))
+	return nil
+}
+
+func (r *certReloader) notAfter() (time.Time, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	leaf, err := certs.Leaf(r.cert)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return leaf.NotAfter, nil
+}
+
+// start watches the state directory and periodically checks whether the
+// certificate is due for rotation, until stopCh is closed.
+func (r *certReloader) start(stopCh <-chan struct{}) {
+	go wait.Until(func() {
+		watcher, err := fsnotify.NewWatcher()
+		if err != nil {
+			logrus.WithError(err).Error("could not watch the serving certificate")
+			return
+		}
+		defer watcher.Close()
+		// the files are replaced by renames, so watch the directory rather than the files
+		if err := watcher.Add(r.cfg.StateDir); err != nil {
+			logrus.WithError(err).WithField("stateDir", r.cfg.StateDir).Error("could not watch the serving certificate")
+			return
+		}
+		ticker := time.NewTicker(certRotationCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopCh:
+				return
+			case event := <-watcher.Events:
+				if !r.isWatchedFile(event.Name) {
+					continue
+				}
+				if err := r.reload(); err != nil {
+					// the certificate and key are renamed one after the other,
+					// the next event will pick up the matching pair
+					logrus.WithError(err).Warn("could not reload the serving certificate")
+				}
+			case err := <-watcher.Errors:
+				logrus.WithError(err).Error("error watching the serving certificate")
+				return
+			case <-ticker.C:
+				if err := r.rotate(); err != nil {
+					logrus.WithError(err).Error("could not rotate the serving certificate")
+				}
+				if err := r.rotateClientCert(); err != nil {
+					logrus.WithError(err).Error("could not rotate the client certificate")
+				}
+			}
+		}
+	}, time.Second, stopCh)
+}
+
+func (r *certReloader) isWatchedFile(name string) bool {
+	switch filepath.Clean(name) {
+	case r.cfg.CertPath(), r.cfg.KeyPath(), r.cfg.NextCertPath(), r.cfg.NextKeyPath():
+		return true
+	}
+	return false
+}
+
+// reload loads the certificate from the state directory and regenerates the
+// webhook kubeconfig if the CA bundle changed, unless it was pregenerated.
+func (r *certReloader) reload() error {
+	cert, err := certs.LoadX509KeyPair(r.cfg.CertPath(), r.cfg.KeyPath())
+	if err != nil {
+		return err
+	}
+	if cert == nil {
+		return fmt.Errorf("%s or %s not found, still serving the previous certificate", r.cfg.CertPath(), r.cfg.KeyPath())
+	}
+	if err := r.setCertificate(cert); err != nil {
+		return err
+	}
+	return r.updateKubeconfig()
+}
+
+func (r *certReloader) updateKubeconfig() error {
+	caBundle, err := r.cfg.WebhookCABundle()
+	if err != nil {
+		return err
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if caBundle == r.caBundle {
+		return nil
+	}
+	if r.cfg.KubeconfigPregenerated {
+		// the kubeconfig isn't ours to rewrite
+		logrus.WithField("kubeconfigPath", r.cfg.GenerateKubeconfigPath).Warn("CA bundle changed, the pregenerated webhook kubeconfig and the API servers must be updated to trust it")
+	} else {
+		logrus.WithField("kubeconfigPath", r.cfg.GenerateKubeconfigPath).Info("CA bundle changed, regenerating webhook kubeconfig; restart the API servers to trust it")
+		if err := r.cfg.GenerateWebhookKubeconfig(); err != nil {
+			return err
+		}
+	}
+	r.caBundle = caBundle
+	return nil
+}
+
+// rotate moves the rotation along if the current certificate is in its
+// overlap window.
+func (r *certReloader) rotate() error {
+	notAfter, err := r.notAfter()
+	if err != nil {
+		return err
+	}
+	remaining := notAfter.Sub(r.nowFunc())
+	_, statErr := os.Stat(r.cfg.NextCertPath())
+	nextExists := statErr == nil
+
+	switch {
+	case nextExists && remaining < r.overlap/2:
+		logrus.WithField("notAfter", notAfter).Info("replacing the serving certificate with the next certificate")
+		if err := certs.RenameX509KeyPair(r.cfg.NextCertPath(), r.cfg.NextKeyPath(), r.cfg.CertPath(), r.cfg.KeyPath()); err != nil {
+			return err
+		}
+		return r.reload()
+	case !nextExists && remaining < r.overlap:
+		logrus.WithField("notAfter", notAfter).Info("serving certificate is due for rotation, generating the next certificate")
+		if err := certs.CreateX509KeyPair(r.cfg.NextCertOpts()); err != nil {
+			return err
+		}
+		return r.updateKubeconfig()
+	}
+	return nil
+}
+
+// rotateClientCert replaces the generated client certificate if it is in its
+// overlap window, keeping the one it replaces as a trusted client CA.
+func (r *certReloader) rotateClientCert() error {
+	if !r.cfg.GeneratesClientCert() {
+		return nil
+	}
+	cert, err := certs.LoadX509KeyPair(r.cfg.ClientCertPath(), r.cfg.ClientKeyPath())
+	if err != nil || cert == nil {
+		return err
+	}
+	leaf, err := certs.Leaf(cert)
+	if err != nil {
+		return err
+	}
+	if leaf.NotAfter.Sub(r.nowFunc()) >= r.overlap {
+		return nil
+	}
+	logrus.WithField("notAfter", leaf.NotAfter).Info("client certificate is due for rotation, generating a new client certificate")
+	if err := certs.WriteCertificate(r.cfg.PreviousClientCertPath(), leaf.Raw); err != nil {
+		return err
+	}
+	return certs.CreateClientX509KeyPair(r.cfg.ClientCertOpts())
+}
@@ -0,0 +1,207 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/aws-iam-authenticator/pkg/config"
+	"sigs.k8s.io/aws-iam-authenticator/pkg/config/certs"
+	"sigs.k8s.io/aws-iam-authenticator/pkg/metrics"
+)
+
+func certReloaderTestConfig(t *testing.T) config.Config {
+	dir := t.TempDir()
+	return config.Config{
+		StateDir:               dir,
+		GenerateKubeconfigPath: filepath.Join(dir, "kubeconfig.yaml"),
+		Hostname:               "localhost",
+		Address:                "127.0.0.1",
+		HostPort:               21362,
+		CertLifetime:           time.Hour,
+		CertRotationOverlap:    20 * time.Minute,
+	}
+}
+
+func servedCertificate(t *testing.T, r *certReloader) []byte {
+	t.Helper()
+	cert, err := r.GetCertificate(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatalf("GetCertificate: %v", err)
+	}
+	return cert.Certificate[0]
+}
+
+// kubeconfigCAs returns the DER certificates in the CA bundle of the webhook kubeconfig
+func kubeconfigCAs(t *testing.T, cfg config.Config) [][]byte {
+	t.Helper()
+	b, err := os.ReadFile(cfg.GenerateKubeconfigPath)
+	if err != nil {
+		t.Fatalf("could not read kubeconfig: %v", err)
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "certificate-authority-data: ") {
+			continue
+		}
+		bundle, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(line, "certificate-authority-data: "))
+		if err != nil {
+			t.Fatalf("could not decode CA bundle: %v", err)
+		}
+		var ders [][]byte
+		for block, rest := pem.Decode(bundle); block != nil; block, rest = pem.Decode(rest) {
+			ders = append(ders, block.Bytes)
+		}
+		return ders
+	}
+	t.Fatalf("no certificate-authority-data in kubeconfig")
+	return nil
+}
+
+func TestCertReloaderRotate(t *testing.T) {
+	metrics.InitMetrics(prometheus.NewRegistry())
+	cfg := certReloaderTestConfig(t)
+	r, err := newCertReloader(cfg)
+	if err != nil {
+		t.Fatalf("newCertReloader: %v", err)
+	}
+	if err := cfg.GenerateWebhookKubeconfig(); err != nil {
+		t.Fatalf("GenerateWebhookKubeconfig: %v", err)
+	}
+	original := servedCertificate(t, r)
+	notAfter, err := r.notAfter()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// before the overlap window nothing happens
+	r.nowFunc = func() time.Time { return notAfter.Add(-21 * time.Minute) }
+	if err := r.rotate(); err != nil {
+		t.Fatalf("rotate: %v", err)
+	}
+	if _, err := os.Stat(cfg.NextCertPath()); !os.IsNotExist(err) {
+		t.Errorf("expected no next certificate before the overlap window")
+	}
+
+	// once it starts the next certificate is trusted, but not served yet
+	r.nowFunc = func() time.Time { return notAfter.Add(-19 * time.Minute) }
+	if err := r.rotate(); err != nil {
+		t.Fatalf("rotate: %v", err)
+	}
+	next, err := certs.LoadX509KeyPair(cfg.NextCertPath(), cfg.NextKeyPath())
+	if err != nil || next == nil {
+		t.Fatalf("expected a next certificate, got %v", err)
+	}
+	if !bytes.Equal(servedCertificate(t, r), original) {
+		t.Errorf("expected the original certificate to still be served")
+	}
+	cas := kubeconfigCAs(t, cfg)
+	if len(cas) != 2 || !bytes.Equal(cas[0], original) || !bytes.Equal(cas[1], next.Certificate[0]) {
+		t.Errorf("expected the kubeconfig to trust the original and next certificates, got %d CAs", len(cas))
+	}
+
+	// half way through it the next certificate is served
+	r.nowFunc = func() time.Time { return notAfter.Add(-9 * time.Minute) }
+	if err := r.rotate(); err != nil {
+		t.Fatalf("rotate: %v", err)
+	}
+	if !bytes.Equal(servedCertificate(t, r), next.Certificate[0]) {
+		t.Errorf("expected the next certificate to be served")
+	}
+	if _, err := os.Stat(cfg.NextCertPath()); !os.IsNotExist(err) {
+		t.Errorf("expected the next certificate to have been moved into place")
+	}
+	cas = kubeconfigCAs(t, cfg)
+	if len(cas) != 1 || !bytes.Equal(cas[0], next.Certificate[0]) {
+		t.Errorf("expected the kubeconfig to only trust the new certificate, got %d CAs", len(cas))
+	}
+}
+
+func TestCertReloaderReload(t *testing.T) {
+	metrics.InitMetrics(prometheus.NewRegistry())
+	cfg := certReloaderTestConfig(t)
+	r, err := newCertReloader(cfg)
+	if err != nil {
+		t.Fatalf("newCertReloader: %v", err)
+	}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	r.start(stopCh)
+	// give the watcher time to start
+	time.Sleep(100 * time.Millisecond)
+
+	// replace the certificate out of band, e.g. by re-running init
+	if err := certs.CreateX509KeyPair(cfg.CertOpts()); err != nil {
+		t.Fatalf("CreateX509KeyPair: %v", err)
+	}
+	replaced, err := certs.LoadX509KeyPair(cfg.CertPath(), cfg.KeyPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !bytes.Equal(servedCertificate(t, r), replaced.Certificate[0]) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the replaced certificate to be served")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for {
+		b, _ := os.ReadFile(cfg.GenerateKubeconfigPath)
+		if bytes.Contains(b, []byte("certificate-authority-data: "+certs.CertToPEMBase64(replaced.Certificate[0])+"\n")) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the kubeconfig to be regenerated with the new CA")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNewCertReloaderInvalidOverlap(t *testing.T) {
+	cfg := certReloaderTestConfig(t)
+	cfg.CertRotationOverlap = cfg.CertLifetime
+	if _, err := newCertReloader(cfg); err == nil {
+		t.Errorf("expected an error when the overlap isn't shorter than the lifetime")
+	}
+}
+
+func TestCertReloaderRotateKubeconfigPregenerated(t *testing.T) {
+	metrics.InitMetrics(prometheus.NewRegistry())
+	cfg := certReloaderTestConfig(t)
+	cfg.KubeconfigPregenerated = true
+	pregenerated := []byte("# pregenerated by init\n")
+	if err := os.WriteFile(cfg.GenerateKubeconfigPath, pregenerated, 0600); err != nil {
+		t.Fatal(err)
+	}
+	r, err := newCertReloader(cfg)
+	if err != nil {
+		t.Fatalf("newCertReloader: %v", err)
+	}
+	notAfter, err := r.notAfter()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.nowFunc = func() time.Time { return notAfter.Add(-19 * time.Minute) }
+	if err := r.rotate(); err != nil {
+		t.Fatalf("rotate: %v", err)
+	}
+	if _, err := os.Stat(cfg.NextCertPath()); err != nil {
+		t.Errorf("expected a next certificate, got %v", err)
+	}
+	b, err := os.ReadFile(cfg.GenerateKubeconfigPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, pregenerated) {
+		t.Errorf("expected the pregenerated kubeconfig not to be rewritten, got %q", b)
+	}
+}
@@ -0,0 +1,123 @@
+/*
+Copyright 2017-2020 by the contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"reflect"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"sigs.k8s.io/aws-iam-authenticator/pkg/config"
+)
+
+// configureClientAuth makes tlsConfig require a client certificate signed by
+// the configured client CA, so that only the API server can send TokenReviews.
+// It does nothing unless RequireClientCert is set. The CA bundle is read again
+// whenever it changes, so tlsConfig must otherwise be complete: each
+// connection gets a copy of it with the current bundle.
+func configureClientAuth(cfg config.Config, tlsConfig *tls.Config) error {
+	if !cfg.RequireClientCert {
+		return nil
+	}
+	cas := &clientCAs{paths: cfg.ClientCAPaths()}
+	pool, err := cas.get()
+	if err != nil {
+		return err
+	}
+	tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	tlsConfig.ClientCAs = pool
+	if len(cfg.AllowedClientNames) > 0 {
+		tlsConfig.VerifyConnection = verifyClientName(cfg.AllowedClientNames)
+	}
+	base := tlsConfig.Clone()
+	tlsConfig.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		pool, err := cas.get()
+		if err != nil {
+			logrus.WithError(err).Warn("could not reload the client CA bundle, using the previous one")
+		}
+		config := base.Clone()
+		config.ClientCAs = pool
+		return config, nil
+	}
+	return nil
+}
+
+// clientCAs is the pool of client CAs read from paths, read again whenever
+// the files change. Paths that don't exist are skipped.
+type clientCAs struct {
+	paths []string
+
+	mutex sync.Mutex
+	pems  [][]byte
+	pool  *x509.CertPool
+}
+
+// get returns the pool of the current files, or the previous pool and an
+// error if they don't have any certificates.
+func (c *clientCAs) get() (*x509.CertPool, error) {
+	pems := make([][]byte, len(c.paths))
+	for i, path := range c.paths {
+		pem, err := os.ReadFile(path)
+		if err != nil && (i == 0 || !os.IsNotExist(err)) {
+			return c.previous(), fmt.Errorf("could not read client CA bundle: %v", err)
+		}
+		pems[i] = pem
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.pool != nil && reflect.DeepEqual(pems, c.pems) {
+		return c.pool, nil
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pems[0]) {
+		return c.pool, fmt.Errorf("no certificates found in client CA bundle %s", c.paths[0])
+	}
+	for _, pem := range pems[1:] {
+		pool.AppendCertsFromPEM(pem)
+	}
+	c.pems, c.pool = pems, pool
+	return pool, nil
+}
+
+func (c *clientCAs) previous() *x509.CertPool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.pool
+}
+
+// verifyClientName returns a tls.Config.VerifyConnection func that rejects
+// client certificates without one of allowed as CN or DNS SAN. It runs after
+// the certificate chain has been verified.
+func verifyClientName(allowed []string) func(tls.ConnectionState) error {
+	allowedNames := sets.NewString(allowed...)
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return fmt.Errorf("no client certificate")
+		}
+		cert := cs.PeerCertificates[0]
+		if allowedNames.Has(cert.Subject.CommonName) || allowedNames.HasAny(cert.DNSNames...) {
+			return nil
+		}
+		return fmt.Errorf("client certificate %q is not in the allowed client names", cert.Subject.CommonName)
+	}
+}
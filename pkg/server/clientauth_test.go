@@ -0,0 +1,204 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/aws-iam-authenticator/pkg/config"
+	"sigs.k8s.io/aws-iam-authenticator/pkg/config/certs"
+	"sigs.k8s.io/aws-iam-authenticator/pkg/metrics"
+)
+
+func TestConfigureClientAuthDisabled(t *testing.T) {
+	tlsConfig := &tls.Config{}
+	if err := configureClientAuth(config.Config{}, tlsConfig); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if tlsConfig.ClientAuth != tls.NoClientCert {
+		t.Errorf("expected client certificates not to be required")
+	}
+}
+
+func TestConfigureClientAuth(t *testing.T) {
+	cases := []struct {
+		name         string
+		allowedNames []string
+		sendCert     bool
+		wantOK       bool
+	}{
+		{"no client certificate", nil, false, false},
+		{"client certificate", nil, true, true},
+		{"allowed client name", []string{"aws-iam-authenticator-apiserver"}, true, true},
+		{"client name not allowed", []string{"kube-apiserver"}, true, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg := config.Config{
+				StateDir:           t.TempDir(),
+				RequireClientCert:  true,
+				AllowedClientNames: c.allowedNames,
+			}
+			clientCert, err := cfg.GetOrCreateClientX509KeyPair()
+			if err != nil {
+				t.Fatalf("GetOrCreateClientX509KeyPair: %v", err)
+			}
+
+			ts := startClientAuthServer(t, cfg)
+			defer ts.Close()
+
+			var certificates []tls.Certificate
+			if c.sendCert {
+				certificates = []tls.Certificate{*clientCert}
+			}
+			if err := getWithClientCert(ts, certificates); (err == nil) != c.wantOK {
+				t.Errorf("expected request to succeed: %v, got error: %v", c.wantOK, err)
+			}
+		})
+	}
+}
+
+// startClientAuthServer starts a TLS server requiring the client certificates
+// cfg configures, serving a certificate generated in the state directory
+func startClientAuthServer(t *testing.T, cfg config.Config) *httptest.Server {
+	t.Helper()
+	servingCert, err := certs.GetOrCreateX509KeyPair(certs.CertificateOptions{
+		CertPath: filepath.Join(t.TempDir(), "cert.pem"),
+		KeyPath:  filepath.Join(t.TempDir(), "key.pem"),
+		Hostname: "localhost",
+		Address:  "127.0.0.1",
+		Lifetime: time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("GetOrCreateX509KeyPair: %v", err)
+	}
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "ok")
+	}))
+	// the config of each connection is a copy of it, so it must be complete
+	// before client authentication is configured
+	ts.TLS = &tls.Config{Certificates: []tls.Certificate{*servingCert}}
+	if err := configureClientAuth(cfg, ts.TLS); err != nil {
+		t.Fatalf("configureClientAuth: %v", err)
+	}
+	ts.StartTLS()
+	return ts
+}
+
+// getWithClientCert sends a request to ts on a new connection, presenting
+// certificates
+func getWithClientCert(ts *httptest.Server, certificates []tls.Certificate) error {
+	client := ts.Client()
+	transport := client.Transport.(*http.Transport).Clone()
+	transport.TLSClientConfig.Certificates = certificates
+	client.Transport = transport
+	resp, err := client.Get(ts.URL)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func TestConfigureClientAuthReloadsCA(t *testing.T) {
+	cfg := config.Config{
+		StateDir:          t.TempDir(),
+		RequireClientCert: true,
+		ClientCAFile:      filepath.Join(t.TempDir(), "ca.pem"),
+	}
+	oldCA := config.Config{StateDir: t.TempDir()}
+	oldCert, err := oldCA.GetOrCreateClientX509KeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newCA := config.Config{StateDir: t.TempDir()}
+	newCert, err := newCA.GetOrCreateClientX509KeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := certs.WriteCertificate(cfg.ClientCAFile, oldCert.Certificate[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	ts := startClientAuthServer(t, cfg)
+	defer ts.Close()
+	if err := getWithClientCert(ts, []tls.Certificate{*oldCert}); err != nil {
+		t.Errorf("expected the certificate signed by the CA to be accepted, got %v", err)
+	}
+	if err := getWithClientCert(ts, []tls.Certificate{*newCert}); err == nil {
+		t.Errorf("expected the certificate signed by another CA to be rejected")
+	}
+
+	// rotate the CA without restarting the server
+	if err := certs.WriteCertificate(cfg.ClientCAFile, newCert.Certificate[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := getWithClientCert(ts, []tls.Certificate{*newCert}); err != nil {
+		t.Errorf("expected the certificate signed by the rotated CA to be accepted, got %v", err)
+	}
+	if err := getWithClientCert(ts, []tls.Certificate{*oldCert}); err == nil {
+		t.Errorf("expected the certificate signed by the previous CA to be rejected")
+	}
+
+	// a broken bundle keeps the previous one
+	if err := os.WriteFile(cfg.ClientCAFile, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := getWithClientCert(ts, []tls.Certificate{*newCert}); err != nil {
+		t.Errorf("expected the previous CA bundle to be kept, got %v", err)
+	}
+}
+
+func TestCertReloaderRotateClientCert(t *testing.T) {
+	metrics.InitMetrics(prometheus.NewRegistry())
+	cfg := certReloaderTestConfig(t)
+	cfg.RequireClientCert = true
+	r, err := newCertReloader(cfg)
+	if err != nil {
+		t.Fatalf("newCertReloader: %v", err)
+	}
+	oldCert, err := cfg.GetOrCreateClientX509KeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := startClientAuthServer(t, cfg)
+	defer ts.Close()
+	leaf, err := certs.Leaf(oldCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// before the overlap window nothing happens
+	r.nowFunc = func() time.Time { return leaf.NotAfter.Add(-21 * time.Minute) }
+	if err := r.rotateClientCert(); err != nil {
+		t.Fatalf("rotateClientCert: %v", err)
+	}
+	if _, err := os.Stat(cfg.PreviousClientCertPath()); !os.IsNotExist(err) {
+		t.Errorf("expected the client certificate not to be rotated before the overlap window")
+	}
+
+	r.nowFunc = func() time.Time { return leaf.NotAfter.Add(-19 * time.Minute) }
+	if err := r.rotateClientCert(); err != nil {
+		t.Fatalf("rotateClientCert: %v", err)
+	}
+	newCert, err := certs.LoadX509KeyPair(cfg.ClientCertPath(), cfg.ClientKeyPath())
+	if err != nil || newCert == nil {
+		t.Fatalf("expected a new client certificate, got %v", err)
+	}
+	if bytes.Equal(newCert.Certificate[0], oldCert.Certificate[0]) {
+		t.Fatalf("expected the client certificate to be replaced")
+	}
+	// the API server may not have picked up the new one yet
+	if err := getWithClientCert(ts, []tls.Certificate{*oldCert}); err != nil {
+		t.Errorf("expected the previous client certificate to still be accepted, got %v", err)
+	}
+	if err := getWithClientCert(ts, []tls.Certificate{*newCert}); err != nil {
+		t.Errorf("expected the new client certificate to be accepted, got %v", err)
+	}
+}
@@ -0,0 +1,89 @@
+/*
+Copyright 2017-2020 by the contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"os"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/aws-iam-authenticator/pkg/config"
+)
+
+// Reasons of the events recorded when the backend mapper chain is swapped
+const (
+	MapperChainSwapped       = "MapperChainSwapped"
+	MapperChainSwapFailed    = "MapperChainSwapFailed"
+	MapperChainSwapCancelled = "MapperChainSwapCancelled"
+)
+
+// The pod events are recorded on, set through the downward API
+const (
+	podNameEnv      = "POD_NAME"
+	podNamespaceEnv = "POD_NAMESPACE"
+)
+
+// eventRecorder records Kubernetes events on the authenticator's pod. A nil
+// eventRecorder records nothing.
+type eventRecorder struct {
+	recorder record.EventRecorder
+	pod      *corev1.ObjectReference
+}
+
+// newEventRecorder returns an eventRecorder for the pod named by the POD_NAME
+// and POD_NAMESPACE environment variables, or nil if they aren't set or the
+// API server can't be reached.
+func newEventRecorder(cfg config.Config) *eventRecorder {
+	name, namespace := os.Getenv(podNameEnv), os.Getenv(podNamespaceEnv)
+	if name == "" || namespace == "" {
+		logrus.Infof("%s or %s is not set, not recording events", podNameEnv, podNamespaceEnv)
+		return nil
+	}
+	k8sconfig, err := clientcmd.BuildConfigFromFlags(cfg.Master, cfg.Kubeconfig)
+	if err != nil {
+		logrus.WithError(err).Warn("could not create the kubernetes client, not recording events")
+		return nil
+	}
+	kubeClient, err := kubernetes.NewForConfig(k8sconfig)
+	if err != nil {
+		logrus.WithError(err).Warn("could not create the kubernetes client, not recording events")
+		return nil
+	}
+	eventBroadcaster := record.NewBroadcaster()
+	eventBroadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: kubeClient.CoreV1().Events(namespace)})
+	return &eventRecorder{
+		recorder: eventBroadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: "aws-iam-authenticator"}),
+		pod: &corev1.ObjectReference{
+			APIVersion: "v1",
+			Kind:       "Pod",
+			Namespace:  namespace,
+			Name:       name,
+		},
+	}
+}
+
+func (r *eventRecorder) eventf(eventType, reason, messageFmt string, args ...interface{}) {
+	if r == nil {
+		return
+	}
+	r.recorder.Eventf(r.pod, eventType, reason, messageFmt, args...)
+}
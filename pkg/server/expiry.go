@@ -0,0 +1,145 @@
+/*
+Copyright 2017-2020 by the contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/aws-iam-authenticator/pkg/mapper"
+	"sigs.k8s.io/aws-iam-authenticator/pkg/metrics"
+)
+
+// mappingExpiryCheckInterval is how often the mappings are checked for expiry
+const mappingExpiryCheckInterval = time.Minute
+
+// expiringMapping is a role or user mapping with an ExpiresAt
+type expiringMapping struct {
+	mapper    string
+	arn       string
+	username  string
+	groups    []string
+	expiresAt time.Time
+	// scrubbed is set if the mapping is in a scrubbed account, its ARN must
+	// be redacted when logged
+	scrubbed bool
+}
+
+// loggedARN returns the ARN of the mapping, redacted if it is scrubbed
+func (m expiringMapping) loggedARN() string {
+	if m.scrubbed {
+		return redacted
+	}
+	return m.arn
+}
+
+func (m expiringMapping) key() string {
+	return m.mapper + " " + m.arn + " " + m.expiresAt.String()
+}
+
+// mappingExpiryChecker counts and logs the mappings of the backend mapper
+// chain that have expired, and so no longer match, or are about to.
+type mappingExpiryChecker struct {
+	h       *handler
+	warning time.Duration
+	nowFunc func() time.Time
+	// logged are the mappings already logged, so that each is logged when it
+	// starts expiring soon and when it expires rather than on every check
+	logged map[string]string
+}
+
+func newMappingExpiryChecker(h *handler, warning time.Duration) *mappingExpiryChecker {
+	return &mappingExpiryChecker{
+		h:       h,
+		warning: warning,
+		nowFunc: time.Now,
+		logged:  map[string]string{},
+	}
+}
+
+// start checks the mappings every mappingExpiryCheckInterval until stopCh is
+// closed.
+func (c *mappingExpiryChecker) start(stopCh <-chan struct{}) {
+	go wait.Until(c.check, mappingExpiryCheckInterval, stopCh)
+}
+
+func (c *mappingExpiryChecker) check() {
+	now := c.nowFunc()
+	backendMapper, release := c.h.acquireBackendMapper()
+	defer release()
+
+	// mappers that are no longer in the chain must not keep reporting
+	metrics.Get().MappingsExpiringSoon.Reset()
+	metrics.Get().MappingsExpired.Reset()
+	logged := map[string]string{}
+	for _, m := range backendMapper.mappers {
+		var expiringSoon, expired int
+		for _, mapping := range c.expiringMappings(m) {
+			var state string
+			switch {
+			case !now.Before(mapping.expiresAt):
+				expired++
+				state = "expired"
+			case mapping.expiresAt.Sub(now) <= c.warning:
+				expiringSoon++
+				state = "expiring"
+			default:
+				continue
+			}
+			logged[mapping.key()] = state
+			if c.logged[mapping.key()] == state {
+				continue
+			}
+			log := logrus.WithFields(logrus.Fields{
+				"mapper":    mapping.mapper,
+				"arn":       mapping.loggedARN(),
+				"username":  mapping.username,
+				"groups":    mapping.groups,
+				"expiresAt": mapping.expiresAt.Format(time.RFC3339),
+			})
+			if state == "expired" {
+				log.Info("mapping has expired and no longer matches, it can be removed")
+			} else {
+				log.Warnf("mapping expires in %s", mapping.expiresAt.Sub(now).Round(time.Second))
+			}
+		}
+		metrics.Get().MappingsExpiringSoon.WithLabelValues(m.Name()).Set(float64(expiringSoon))
+		metrics.Get().MappingsExpired.WithLabelValues(m.Name()).Set(float64(expired))
+	}
+	c.logged = logged
+}
+
+// expiringMappings returns the role and user mappings of m with an ExpiresAt.
+// They are keyed by their actual ARN, so that mappings of scrubbed accounts
+// don't collide; only logging redacts it.
+func (c *mappingExpiryChecker) expiringMappings(m mapper.Mapper) []expiringMapping {
+	mappings := m.Mappings()
+	var expiring []expiringMapping
+	for _, role := range mappings.RoleMappings {
+		if role.ExpiresAt != nil {
+			scrubbed := c.h.isScrubbedARN(role.RoleARN) || (role.SSO != nil && c.h.isScrubbedAccount(role.SSO.AccountID))
+			expiring = append(expiring, expiringMapping{m.Name(), role.Key(), role.Username, role.Groups, *role.ExpiresAt, scrubbed})
+		}
+	}
+	for _, user := range mappings.UserMappings {
+		if user.ExpiresAt != nil {
+			expiring = append(expiring, expiringMapping{m.Name(), user.Key(), user.Username, user.Groups, *user.ExpiresAt, c.h.isScrubbedARN(user.UserARN)})
+		}
+	}
+	return expiring
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/aws-iam-authenticator/pkg/config"
+	"sigs.k8s.io/aws-iam-authenticator/pkg/mapper"
+	"sigs.k8s.io/aws-iam-authenticator/pkg/mapper/crd"
+	"sigs.k8s.io/aws-iam-authenticator/pkg/mapper/file"
+	"sigs.k8s.io/aws-iam-authenticator/pkg/metrics"
+	"sigs.k8s.io/aws-iam-authenticator/pkg/token"
+)
+
+func TestMappingExpiryChecker(t *testing.T) {
+	h := setup(nil)
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	expired := now.Add(-time.Minute)
+	soon := now.Add(time.Hour)
+	later := now.Add(48 * time.Hour)
+
+	indexer := createIndexer()
+	breakGlass := newIAMIdentityMapping("arn:aws:iam::123456789012:role/BreakGlass", "arn:aws:iam::123456789012:role/breakglass", "break-glass", []string{"system:masters"})
+	breakGlass.Spec.ExpiresAt = &metav1.Time{Time: soon}
+	indexer.Add(breakGlass)
+	h.backendMapper = BackendMapper{
+		mappers: []mapper.Mapper{
+			crd.NewCRDMapperWithIndexer(indexer),
+			file.NewFileMapperWithMaps(map[string]config.RoleMapping{
+				"arn:aws:iam::123456789012:role/old":    {RoleARN: "arn:aws:iam::123456789012:role/Old", Username: "old", ExpiresAt: &expired},
+				"arn:aws:iam::123456789012:role/oncall": {RoleARN: "arn:aws:iam::123456789012:role/OnCall", Username: "oncall", ExpiresAt: &later},
+				"arn:aws:iam::123456789012:role/admin":  {RoleARN: "arn:aws:iam::123456789012:role/Admin", Username: "admin"},
+			}, map[string]config.UserMapping{
+				"arn:aws:iam::123456789012:user/alice": {UserARN: "arn:aws:iam::123456789012:user/Alice", Username: "alice", ExpiresAt: &soon},
+			}, nil),
+		},
+	}
+
+	checker := newMappingExpiryChecker(h, 24*time.Hour)
+	checker.nowFunc = func() time.Time { return now }
+	checker.check()
+	expected := `
+# HELP aws_iam_authenticator_mappings_expired Role and user mappings that have expired but are still configured, partitioned by mapper
+# TYPE aws_iam_authenticator_mappings_expired gauge
+aws_iam_authenticator_mappings_expired{mapper="CRD"} 0
+aws_iam_authenticator_mappings_expired{mapper="MountedFile"} 1
+# HELP aws_iam_authenticator_mappings_expiring_soon Role and user mappings that expire within the expiry warning period, partitioned by mapper
+# TYPE aws_iam_authenticator_mappings_expiring_soon gauge
+aws_iam_authenticator_mappings_expiring_soon{mapper="CRD"} 1
+aws_iam_authenticator_mappings_expiring_soon{mapper="MountedFile"} 1
+`
+	if err := testutil.CollectAndCompare(metrics.Get().MappingsExpired, strings.NewReader(expected), "aws_iam_authenticator_mappings_expired"); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CollectAndCompare(metrics.Get().MappingsExpiringSoon, strings.NewReader(expected), "aws_iam_authenticator_mappings_expiring_soon"); err != nil {
+		t.Error(err)
+	}
+	if len(checker.logged) != 3 {
+		t.Errorf("Expected 3 mappings to be logged, got %v", checker.logged)
+	}
+
+	// the CRD mapping stops matching once it expires
+	identity := &token.Identity{ARN: "arn:aws:iam::123456789012:role/BreakGlass", CanonicalARN: "arn:aws:iam::123456789012:role/BreakGlass", AccountID: "123456789012"}
+	if mapping, err := h.doMapping(identity, nil); err != nil || mapping.username != "break-glass" {
+		t.Errorf("Expected the break glass role to be mapped, got %+v, %v", mapping, err)
+	}
+	breakGlass.Spec.ExpiresAt = &metav1.Time{Time: time.Now().Add(-time.Second)}
+	if _, err := h.doMapping(identity, nil); err == nil {
+		t.Errorf("Expected the expired break glass role not to be mapped")
+	}
+}
+
+func TestMappingExpiryCheckerScrubbedAccounts(t *testing.T) {
+	h := setup(nil)
+	h.scrubbedAccounts = []string{"123456789012"}
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	expired := now.Add(-time.Minute)
+	h.backendMapper = BackendMapper{
+		mappers: []mapper.Mapper{
+			file.NewFileMapperWithMaps(map[string]config.RoleMapping{
+				"arn:aws:iam::123456789012:role/old":   {RoleARN: "arn:aws:iam::123456789012:role/Old", Username: "old", ExpiresAt: &expired},
+				"arn:aws:iam::123456789012:role/older": {RoleARN: "arn:aws:iam::123456789012:role/Older", Username: "older", ExpiresAt: &expired},
+			}, nil, nil),
+		},
+	}
+
+	checker := newMappingExpiryChecker(h, 24*time.Hour)
+	checker.nowFunc = func() time.Time { return now }
+	checker.check()
+	// the mappings of the scrubbed account are tracked apart
+	if len(checker.logged) != 2 {
+		t.Errorf("Expected 2 mappings to be logged, got %v", checker.logged)
+	}
+	for _, mapping := range checker.expiringMappings(h.backendMapper.mappers[0]) {
+		if got := mapping.loggedARN(); got != redacted {
+			t.Errorf("Expected %s to be logged as %q, got %q", mapping.arn, redacted, got)
+		}
+	}
+}
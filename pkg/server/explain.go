@@ -0,0 +1,181 @@
+/*
+Copyright 2017-2020 by the contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	awsarn "github.com/aws/aws-sdk-go/aws/arn"
+	"sigs.k8s.io/aws-iam-authenticator/pkg/arn"
+	"sigs.k8s.io/aws-iam-authenticator/pkg/ec2provider"
+	"sigs.k8s.io/aws-iam-authenticator/pkg/token"
+)
+
+const (
+	// MappingStepMatched means the mapper had a mapping for the identity
+	MappingStepMatched = "matched"
+	// MappingStepAccountAllowed means the mapper had no mapping for the
+	// identity, but its account is in mapAccounts
+	MappingStepAccountAllowed = "accountAllowed"
+	// MappingStepNotMapped means the mapper had no mapping for the identity
+	MappingStepNotMapped = "notMapped"
+	// MappingStepError means the mapper failed to look up the identity
+	MappingStepError = "error"
+	// MappingStepDenied means the mapper had a deny mapping for the identity
+	MappingStepDenied = "denied"
+)
+
+// Explanation is the response of /debug/explain. It describes how the mapper
+// chain handles an identity, as if it had presented a valid token.
+type Explanation struct {
+	ARN          string `json:"arn"`
+	CanonicalARN string `json:"canonicalArn"`
+	AccountID    string `json:"accountId"`
+	UserID       string `json:"userId,omitempty"`
+	SessionName  string `json:"sessionName,omitempty"`
+	// Steps are the mappers that were consulted, in order
+	Steps []MappingStep `json:"steps"`
+	// Allowed is true if the identity would be authenticated
+	Allowed  bool     `json:"allowed"`
+	Mapper   string   `json:"mapper,omitempty"`
+	Username string   `json:"username,omitempty"`
+	Groups   []string `json:"groups,omitempty"`
+	// Reason explains why the identity would be denied
+	Reason string `json:"reason,omitempty"`
+}
+
+// MappingStep is how a single mapper handled the identity.
+type MappingStep struct {
+	Mapper string `json:"mapper"`
+	// Result is one of matched, accountAllowed, notMapped, error or denied
+	Result string `json:"result"`
+	// Entry is the ARN or user ID of the mapping that matched, or the key of
+	// the deny mapping
+	Entry            string   `json:"entry,omitempty"`
+	UsernameTemplate string   `json:"usernameTemplate,omitempty"`
+	GroupTemplates   []string `json:"groupTemplates,omitempty"`
+	// Error is set when the lookup failed, or when the matched mapping
+	// could not be used, e.g. because the username has a reserved prefix
+	Error string `json:"error,omitempty"`
+}
+
+// addStep records step, a nil *Explanation discards it.
+func (e *Explanation) addStep(step MappingStep, err error) {
+	if e == nil {
+		return
+	}
+	if err != nil {
+		step.Error = err.Error()
+	}
+	e.Steps = append(e.Steps, step)
+}
+
+// explainEC2Provider answers the EC2 lookups of templates when explaining,
+// with placeholders: explaining must not use up the DescribeInstances budget.
+type explainEC2Provider struct{}
+
+func (explainEC2Provider) GetPrivateDNSName(string) (string, error) {
+	return "{{EC2PrivateDNSName}}", nil
+}
+
+func (explainEC2Provider) GetInstance(string) (*ec2provider.Instance, error) {
+	return &ec2provider.Instance{PrivateDNSName: "{{EC2PrivateDNSName}}", InstanceType: "{{EC2InstanceType}}"}, nil
+}
+
+// explainIdentity builds the identity STS would return for identityARN. The
+// session name of an assumed role defaults to the one in its ARN.
+func explainIdentity(identityARN, userID, sessionName string) (*token.Identity, error) {
+	if identityARN == "" {
+		return nil, fmt.Errorf("arn not specified")
+	}
+	principalType, canonicalARN, err := arn.Canonicalize(identityARN)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := awsarn.Parse(identityARN)
+	if err != nil {
+		return nil, err
+	}
+	if principalType == arn.ASSUMED_ROLE && sessionName == "" {
+		sessionName = identityARN[strings.LastIndex(identityARN, "/")+1:]
+	}
+	return &token.Identity{
+		ARN:          identityARN,
+		CanonicalARN: canonicalARN,
+		AccountID:    parsed.AccountID,
+		UserID:       userID,
+		SessionName:  sessionName,
+	}, nil
+}
+
+// explain runs identity through the mapper chain and the templates, like
+// authenticateEndpoint does once a token is verified, but as a dry run: EC2
+// lookups are answered with placeholders and no metrics are recorded.
+func (h *handler) explain(identity *token.Identity) *Explanation {
+	explanation := &Explanation{
+		ARN:          identity.ARN,
+		CanonicalARN: identity.CanonicalARN,
+		AccountID:    identity.AccountID,
+		UserID:       identity.UserID,
+		SessionName:  identity.SessionName,
+		Steps:        []MappingStep{},
+	}
+	mapping, err := h.doMapping(identity, explanation)
+	if err != nil {
+		explanation.Reason = err.Error()
+		return explanation
+	}
+	explanation.Allowed = true
+	explanation.Mapper = mapping.mapper
+	explanation.Username = mapping.username
+	explanation.Groups = mapping.groups
+	return explanation
+}
+
+// explainEndpoint explains how the identity given by the arn, userId and
+// sessionName query parameters would be mapped, without needing a token. It
+// reveals the mappings, so it only answers callers on the loopback interface.
+func (h *handler) explainEndpoint(w http.ResponseWriter, req *http.Request) {
+	if !isLoopback(req.RemoteAddr) {
+		http.Error(w, "/debug/explain is only served to loopback clients", http.StatusForbidden)
+		return
+	}
+	query := req.URL.Query()
+	identity, err := explainIdentity(query.Get("arn"), query.Get("userId"), query.Get("sessionName"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(h.explain(identity))
+}
+
+// isLoopback returns true if remoteAddr is a loopback address
+func isLoopback(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
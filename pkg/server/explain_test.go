@@ -0,0 +1,186 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"sigs.k8s.io/aws-iam-authenticator/pkg/config"
+	"sigs.k8s.io/aws-iam-authenticator/pkg/ec2provider"
+	"sigs.k8s.io/aws-iam-authenticator/pkg/errutil"
+	"sigs.k8s.io/aws-iam-authenticator/pkg/mapper"
+	"sigs.k8s.io/aws-iam-authenticator/pkg/mapper/file"
+	"sigs.k8s.io/aws-iam-authenticator/pkg/metrics"
+)
+
+// reservedPrefixMapper is a FileMapper that reserves the "aws:" prefix
+type reservedPrefixMapper struct {
+	*file.FileMapper
+}
+
+func (m reservedPrefixMapper) UsernamePrefixReserveList() []string {
+	return []string{"aws:"}
+}
+
+func explainRequest(t *testing.T, h *handler, query url.Values) *Explanation {
+	t.Helper()
+	h.cfg.AdminDebug = true
+	resp := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "http://k8s.io/debug/explain?"+query.Encode(), nil)
+	req.RemoteAddr = "127.0.0.1:43210"
+	h.adminHandler().ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, was %d", http.StatusOK, resp.Code)
+	}
+	var explanation Explanation
+	if err := json.NewDecoder(resp.Body).Decode(&explanation); err != nil {
+		t.Fatalf("Could not decode response: %v", err)
+	}
+	return &explanation
+}
+
+func TestExplain(t *testing.T) {
+	h := setup(nil)
+	h.backendMapper = BackendMapper{
+		mappers: []mapper.Mapper{
+			file.NewFileMapperWithMaps(nil, nil, nil),
+			file.NewFileMapperWithMaps(map[string]config.RoleMapping{
+				"arn:aws:iam::123456789012:role/admin": {RoleARN: "arn:aws:iam::123456789012:role/Admin", Username: "admin:{{SessionName}}", Groups: []string{"system:masters"}},
+			}, nil, nil),
+		},
+	}
+
+	got := explainRequest(t, h, url.Values{
+		"arn":    []string{"arn:aws:sts::123456789012:assumed-role/Admin/alice"},
+		"userId": []string{"AROAAAAAAAAAAAAAAAAAA"},
+	})
+	expected := &Explanation{
+		ARN:          "arn:aws:sts::123456789012:assumed-role/Admin/alice",
+		CanonicalARN: "arn:aws:iam::123456789012:role/Admin",
+		AccountID:    "123456789012",
+		UserID:       "AROAAAAAAAAAAAAAAAAAA",
+		SessionName:  "alice",
+		Steps: []MappingStep{
+			{Mapper: mapper.ModeMountedFile, Result: MappingStepNotMapped},
+			{
+				Mapper:           mapper.ModeMountedFile,
+				Result:           MappingStepMatched,
+				Entry:            "arn:aws:iam::123456789012:role/admin",
+				UsernameTemplate: "admin:{{SessionName}}",
+				GroupTemplates:   []string{"system:masters"},
+			},
+		},
+		Allowed:  true,
+		Mapper:   mapper.ModeMountedFile,
+		Username: "admin:alice",
+		Groups:   []string{"system:masters"},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, got)
+	}
+
+	got = explainRequest(t, h, url.Values{"arn": []string{"arn:aws:iam::123456789012:user/Bob"}})
+	if got.Allowed || got.Reason != errutil.ErrNotMapped.Error() || len(got.Steps) != 2 {
+		t.Errorf("Expected an unmapped user to be denied by both mappers, got %+v", got)
+	}
+}
+
+func TestExplainReservedPrefix(t *testing.T) {
+	h := setup(nil)
+	h.backendMapper = BackendMapper{
+		mappers: []mapper.Mapper{reservedPrefixMapper{file.NewFileMapperWithMaps(nil, map[string]config.UserMapping{
+			"arn:aws:iam::123456789012:user/bob": {UserARN: "arn:aws:iam::123456789012:user/Bob", Username: "aws:bob"},
+		}, nil)}},
+	}
+	got := explainRequest(t, h, url.Values{"arn": []string{"arn:aws:iam::123456789012:user/Bob"}})
+	if got.Allowed {
+		t.Errorf("Expected a reserved username to be denied")
+	}
+	if len(got.Steps) != 1 || got.Steps[0].Result != MappingStepMatched || got.Steps[0].Error == "" {
+		t.Errorf("Expected the matched step to carry the reserved prefix error, got %+v", got.Steps)
+	}
+	if got.Reason != got.Steps[0].Error {
+		t.Errorf("Expected reason %q, got %q", got.Steps[0].Error, got.Reason)
+	}
+}
+
+func TestExplainInvalidARN(t *testing.T) {
+	h := setup(nil)
+	h.cfg.AdminDebug = true
+	for _, query := range []string{"", "arn=foo", "arn=arn:aws:s3:::bucket"} {
+		resp := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "http://k8s.io/debug/explain?"+query, nil)
+		req.RemoteAddr = "[::1]:43210"
+		h.adminHandler().ServeHTTP(resp, req)
+		if resp.Code != http.StatusBadRequest {
+			t.Errorf("%q: expected status code %d, was %d", query, http.StatusBadRequest, resp.Code)
+		}
+	}
+}
+
+func TestExplainNotLoopback(t *testing.T) {
+	h := setup(nil)
+	h.cfg.AdminDebug = true
+	resp := httptest.NewRecorder()
+	// httptest requests come from 192.0.2.1
+	h.adminHandler().ServeHTTP(resp, httptest.NewRequest("GET", "http://k8s.io/debug/explain?arn=arn:aws:iam::123456789012:user/Bob", nil))
+	if resp.Code != http.StatusForbidden {
+		t.Errorf("Expected status code %d, was %d", http.StatusForbidden, resp.Code)
+	}
+}
+
+// failingEC2Provider fails the test if EC2 is called
+type failingEC2Provider struct {
+	t *testing.T
+}
+
+func (p failingEC2Provider) GetPrivateDNSName(id string) (string, error) {
+	p.t.Errorf("Unexpected EC2 lookup of %s", id)
+	return "", nil
+}
+
+func (p failingEC2Provider) GetInstance(id string) (*ec2provider.Instance, error) {
+	p.t.Errorf("Unexpected EC2 lookup of %s", id)
+	return nil, nil
+}
+
+func (failingEC2Provider) StartEc2DescribeBatchProcessing() {}
+
+func TestExplainDryRun(t *testing.T) {
+	h := setup(nil)
+	h.ec2Provider = failingEC2Provider{t}
+	h.backendMapper = BackendMapper{
+		mappers: []mapper.Mapper{
+			file.NewFileMapperWithMaps(map[string]config.RoleMapping{
+				"arn:aws:iam::123456789012:role/node": {RoleARN: "arn:aws:iam::123456789012:role/Node", Username: "system:node:{{EC2PrivateDNSName}}", Groups: []string{"{{EC2InstanceType}}", "{{EC2Tag:pool}}", "{{Unknown}}"}},
+			}, nil, nil),
+		},
+	}
+	metrics.InitMetrics(prometheus.NewRegistry())
+
+	got := explainRequest(t, h, url.Values{"arn": []string{"arn:aws:sts::123456789012:assumed-role/Node/i-0123456789abcdef0"}})
+	if got.Allowed || len(got.Steps) != 1 || got.Steps[0].Error == "" {
+		t.Errorf("Expected the unknown template to be reported, got %+v", got)
+	}
+	h.backendMapper.mappers = []mapper.Mapper{
+		file.NewFileMapperWithMaps(map[string]config.RoleMapping{
+			"arn:aws:iam::123456789012:role/node": {RoleARN: "arn:aws:iam::123456789012:role/Node", Username: "system:node:{{EC2PrivateDNSName}}", Groups: []string{"{{EC2InstanceType}}"}},
+		}, nil, nil),
+	}
+	got = explainRequest(t, h, url.Values{"arn": []string{"arn:aws:sts::123456789012:assumed-role/Node/i-0123456789abcdef0"}})
+	if got.Username != "system:node:{{EC2PrivateDNSName}}" || !reflect.DeepEqual(got.Groups, []string{"{{EC2InstanceType}}"}) {
+		t.Errorf("Expected EC2 placeholders, got %+v", got)
+	}
+
+	if count := testutil.CollectAndCount(metrics.Get().MappingLatency); count != 0 {
+		t.Errorf("Expected no mapping latency recorded, got %d series", count)
+	}
+	if count := testutil.CollectAndCount(metrics.Get().TemplateFailures); count != 0 {
+		t.Errorf("Expected no template failure counted, got %d series", count)
+	}
+}
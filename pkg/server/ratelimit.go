@@ -0,0 +1,115 @@
+/*
+Copyright 2017-2020 by the contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	"k8s.io/apimachinery/pkg/util/cache"
+	"sigs.k8s.io/aws-iam-authenticator/pkg/config"
+	"sigs.k8s.io/aws-iam-authenticator/pkg/metrics"
+)
+
+const (
+	// maxAccessKeyLimiters bounds the number of per access key ID limiters kept in memory
+	maxAccessKeyLimiters = 10000
+	// accessKeyLimiterTTL is how long an idle per access key ID limiter is remembered
+	accessKeyLimiterTTL = 15 * time.Minute
+)
+
+// rateLimiter sheds /authenticate requests before they are sent to STS, so a
+// single misbehaving client can't exhaust the STS quota for everyone.
+// A nil *rateLimiter allows every request.
+type rateLimiter struct {
+	// inFlight is a semaphore of the requests currently being processed, nil if unlimited
+	inFlight chan struct{}
+	// global limits the request rate across all callers, nil if unlimited
+	global *rate.Limiter
+
+	accessKeyLimit rate.Limit
+	accessKeyBurst int
+	// accessKeyMutex serializes the creation of per access key ID limiters
+	accessKeyMutex sync.Mutex
+	accessKeys     *cache.LRUExpireCache
+}
+
+// newRateLimiter returns a rateLimiter for the limits in cfg, or nil if none
+// are configured.
+func newRateLimiter(cfg config.Config) *rateLimiter {
+	if cfg.AuthenticateMaxInFlight <= 0 && cfg.AuthenticateQps <= 0 && cfg.AuthenticateAccessKeyQps <= 0 {
+		return nil
+	}
+	l := &rateLimiter{}
+	if cfg.AuthenticateMaxInFlight > 0 {
+		l.inFlight = make(chan struct{}, cfg.AuthenticateMaxInFlight)
+	}
+	if cfg.AuthenticateQps > 0 {
+		l.global = rate.NewLimiter(rate.Limit(cfg.AuthenticateQps), burstOrDefault(cfg.AuthenticateBurst))
+	}
+	if cfg.AuthenticateAccessKeyQps > 0 {
+		l.accessKeyLimit = rate.Limit(cfg.AuthenticateAccessKeyQps)
+		l.accessKeyBurst = burstOrDefault(cfg.AuthenticateAccessKeyBurst)
+		l.accessKeys = cache.NewLRUExpireCache(maxAccessKeyLimiters)
+	}
+	return l
+}
+
+func burstOrDefault(burst int) int {
+	if burst < 1 {
+		return 1
+	}
+	return burst
+}
+
+// acquire admits a request for the given access key ID. If the request is
+// admitted, the returned release func must be called once it is done and the
+// returned limit is empty. Otherwise limit names the limit that was hit.
+func (l *rateLimiter) acquire(accessKeyID string) (release func(), limit string) {
+	if l == nil {
+		return func() {}, ""
+	}
+	// check the narrowest limit first so an abusive access key doesn't
+	// consume the budget shared with everyone else
+	if l.accessKeys != nil && accessKeyID != "" && !l.accessKeyLimiter(accessKeyID).Allow() {
+		return nil, metrics.LimitAccessKey
+	}
+	if l.global != nil && !l.global.Allow() {
+		return nil, metrics.LimitGlobal
+	}
+	if l.inFlight == nil {
+		return func() {}, ""
+	}
+	select {
+	case l.inFlight <- struct{}{}:
+		return func() { <-l.inFlight }, ""
+	default:
+		return nil, metrics.LimitInFlight
+	}
+}
+
+func (l *rateLimiter) accessKeyLimiter(accessKeyID string) *rate.Limiter {
+	l.accessKeyMutex.Lock()
+	defer l.accessKeyMutex.Unlock()
+	if limiter, ok := l.accessKeys.Get(accessKeyID); ok {
+		return limiter.(*rate.Limiter)
+	}
+	limiter := rate.NewLimiter(l.accessKeyLimit, l.accessKeyBurst)
+	l.accessKeys.Add(accessKeyID, limiter, accessKeyLimiterTTL)
+	return limiter
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"testing"
+
+	"sigs.k8s.io/aws-iam-authenticator/pkg/config"
+	"sigs.k8s.io/aws-iam-authenticator/pkg/metrics"
+)
+
+func TestNewRateLimiterDisabled(t *testing.T) {
+	l := newRateLimiter(config.Config{})
+	if l != nil {
+		t.Fatalf("expected no rate limiter when no limits are configured")
+	}
+	for i := 0; i < 100; i++ {
+		release, limit := l.acquire("AKIAEXAMPLE")
+		if limit != "" {
+			t.Fatalf("unexpected limit %q from a nil rate limiter", limit)
+		}
+		release()
+	}
+}
+
+func TestRateLimiterInFlight(t *testing.T) {
+	l := newRateLimiter(config.Config{AuthenticateMaxInFlight: 2})
+
+	release1, limit := l.acquire("")
+	if limit != "" {
+		t.Fatalf("unexpected limit %q", limit)
+	}
+	release2, limit := l.acquire("")
+	if limit != "" {
+		t.Fatalf("unexpected limit %q", limit)
+	}
+	if _, limit = l.acquire(""); limit != metrics.LimitInFlight {
+		t.Errorf("expected limit %q, got %q", metrics.LimitInFlight, limit)
+	}
+	release1()
+	release3, limit := l.acquire("")
+	if limit != "" {
+		t.Errorf("expected a slot to be free after release, got limit %q", limit)
+	}
+	release2()
+	release3()
+}
+
+func TestRateLimiterGlobal(t *testing.T) {
+	l := newRateLimiter(config.Config{AuthenticateQps: 0.001, AuthenticateBurst: 2})
+
+	for i := 0; i < 2; i++ {
+		if _, limit := l.acquire(""); limit != "" {
+			t.Fatalf("request %d: unexpected limit %q", i, limit)
+		}
+	}
+	if _, limit := l.acquire(""); limit != metrics.LimitGlobal {
+		t.Errorf("expected limit %q, got %q", metrics.LimitGlobal, limit)
+	}
+}
+
+func TestRateLimiterAccessKey(t *testing.T) {
+	l := newRateLimiter(config.Config{AuthenticateAccessKeyQps: 0.001, AuthenticateAccessKeyBurst: 1})
+
+	if _, limit := l.acquire("AKIAONE"); limit != "" {
+		t.Fatalf("unexpected limit %q", limit)
+	}
+	if _, limit := l.acquire("AKIAONE"); limit != metrics.LimitAccessKey {
+		t.Errorf("expected limit %q, got %q", metrics.LimitAccessKey, limit)
+	}
+	// other access keys have their own budget
+	if _, limit := l.acquire("AKIATWO"); limit != "" {
+		t.Errorf("unexpected limit %q for a different access key", limit)
+	}
+	// requests whose access key couldn't be parsed are only subject to the shared limits
+	if _, limit := l.acquire(""); limit != "" {
+		t.Errorf("unexpected limit %q without an access key", limit)
+	}
+}
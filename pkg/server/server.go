@@ -20,17 +20,20 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
-	"regexp"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/ec2metadata"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"sigs.k8s.io/aws-iam-authenticator/pkg/config"
+	"sigs.k8s.io/aws-iam-authenticator/pkg/config/kubeconfig"
 	"sigs.k8s.io/aws-iam-authenticator/pkg/ec2provider"
 	"sigs.k8s.io/aws-iam-authenticator/pkg/errutil"
 	"sigs.k8s.io/aws-iam-authenticator/pkg/fileutil"
@@ -40,19 +43,35 @@ import (
 	"sigs.k8s.io/aws-iam-authenticator/pkg/mapper/dynamicfile"
 	"sigs.k8s.io/aws-iam-authenticator/pkg/mapper/file"
 	"sigs.k8s.io/aws-iam-authenticator/pkg/metrics"
+	"sigs.k8s.io/aws-iam-authenticator/pkg/template"
 	"sigs.k8s.io/aws-iam-authenticator/pkg/token"
 
 	awsarn "github.com/aws/aws-sdk-go/aws/arn"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
+	authenticationv1 "k8s.io/api/authentication/v1"
 	authenticationv1beta1 "k8s.io/api/authentication/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 )
 
 // tokenReviewDenyJSON is a static encoding (at init time) of the 'deny' TokenReview
-var tokenReviewDenyJSON = func() []byte {
-	res, err := json.Marshal(authenticationv1beta1.TokenReview{
-		Status: authenticationv1beta1.TokenReviewStatus{
+var tokenReviewDenyJSON = denyJSON(metav1.TypeMeta{})
+
+// tokenReviewDenyJSONByVersion holds the static 'deny' TokenReview for each
+// apiVersion the webhook accepts. Requests without an apiVersion get the
+// legacy unversioned response.
+var tokenReviewDenyJSONByVersion = map[string][]byte{
+	"": tokenReviewDenyJSON,
+	authenticationv1beta1.SchemeGroupVersion.String(): denyJSON(tokenReviewTypeMeta(authenticationv1beta1.SchemeGroupVersion.String())),
+	authenticationv1.SchemeGroupVersion.String():      denyJSON(tokenReviewTypeMeta(authenticationv1.SchemeGroupVersion.String())),
+}
+
+func denyJSON(typeMeta metav1.TypeMeta) []byte {
+	res, err := json.Marshal(authenticationv1.TokenReview{
+		TypeMeta: typeMeta,
+		Status: authenticationv1.TokenReviewStatus{
 			Authenticated: false,
 		},
 	})
@@ -60,24 +79,44 @@ var tokenReviewDenyJSON = func() []byte {
 		logrus.WithError(err).Fatal("could not create static 'deny' JSON response")
 	}
 	return res
-}()
+}
 
-// Pattern to match EC2 instance IDs
-var (
-	instanceIDPattern = regexp.MustCompile("^i-(\\w{8}|\\w{17})$")
-)
+func tokenReviewTypeMeta(apiVersion string) metav1.TypeMeta {
+	if apiVersion == "" {
+		return metav1.TypeMeta{}
+	}
+	return metav1.TypeMeta{APIVersion: apiVersion, Kind: "TokenReview"}
+}
+
+// mapperSyncPollInterval is how often the mappers are checked while waiting for them to sync
+const mapperSyncPollInterval = time.Second
+
+// defaultMapperSwapTimeout bounds how long a new mapper chain may take to sync
+// before it is swapped in, when MapperSyncTimeout isn't set
+const defaultMapperSwapTimeout = 5 * time.Minute
 
 // server state (internal)
 type handler struct {
 	http.ServeMux
+	// mutex guards backendMapper, pendingSwap and stopped, the chain is
+	// swapped when the dynamic backend mode file changes
 	mutex                     sync.RWMutex
+	stopped                   bool
+	pendingSwap               *pendingSwap
+	stopCh                    <-chan struct{}
 	verifier                  token.Verifier
+	stsHealth                 token.STSHealth
 	ec2Provider               ec2provider.EC2Provider
 	clusterID                 string
 	backendMapper             BackendMapper
 	backendModeConfigInitDone bool
 	scrubbedAccounts          []string
 	cfg                       config.Config
+	// uidTemplate is the parsed UID template of cfg
+	uidTemplate *template.Template
+	rateLimiter *rateLimiter
+	auditor     *auditor
+	events      *eventRecorder
 }
 
 // New authentication webhook server.
@@ -91,6 +130,10 @@ func New(cfg config.Config, stopCh <-chan struct{}) *Server {
 		logrus.Fatalf("failed to build mapper chain: %v", err)
 	}
 
+	if err := validateUserInfo(cfg); err != nil {
+		logrus.Fatalf("invalid user info config: %v", err)
+	}
+
 	for _, mapping := range c.RoleMappings {
 		if mapping.RoleARN != "" {
 			logrus.WithFields(logrus.Fields{
@@ -118,10 +161,17 @@ func New(cfg config.Config, stopCh <-chan struct{}) *Server {
 		logrus.WithField("accountID", account).Infof("mapping IAM Account")
 	}
 
-	cert, err := c.GetOrCreateX509KeyPair()
+	certReloader, err := newCertReloader(cfg)
 	if err != nil {
 		logrus.WithError(err).Fatalf("could not load/generate a certificate")
 	}
+	certReloader.start(stopCh)
+
+	if c.GeneratesClientCert() {
+		if _, err := c.GetOrCreateClientX509KeyPair(); err != nil {
+			logrus.WithError(err).Fatalf("could not load/generate a client certificate")
+		}
+	}
 
 	if !c.KubeconfigPregenerated {
 		if err := c.GenerateWebhookKubeconfig(); err != nil {
@@ -129,11 +179,15 @@ func New(cfg config.Config, stopCh <-chan struct{}) *Server {
 		}
 	}
 
-	// start a TLS listener with our custom certs
-	listener, err := tls.Listen("tcp", c.ListenAddr(), &tls.Config{
-		MinVersion:   tls.VersionTLS12,
-		Certificates: []tls.Certificate{*cert},
-	})
+	// start a TLS listener with our custom certs, reloaded whenever they change
+	tlsConfig := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: certReloader.GetCertificate,
+	}
+	if err := configureClientAuth(cfg, tlsConfig); err != nil {
+		logrus.WithError(err).Fatal("could not configure client certificate authentication")
+	}
+	listener, err := tls.Listen("tcp", c.ListenAddr(), tlsConfig)
 	if err != nil {
 		logrus.WithError(err).Fatal("could not open TLS listener")
 	}
@@ -143,7 +197,7 @@ func New(cfg config.Config, stopCh <-chan struct{}) *Server {
 	defer errLog.Close()
 
 	logrus.Infof("listening on %s", listener.Addr())
-	logrus.Infof("reconfigure your apiserver with `--authentication-token-webhook-config-file=%s` to enable (assuming default hostPath mounts)", c.GenerateKubeconfigPath)
+	logrus.Infof("reconfigure your apiserver with `--authentication-token-webhook-config-file=%s --authentication-token-webhook-version=%s` to enable (assuming default hostPath mounts)", c.GenerateKubeconfigPath, kubeconfig.WebhookVersion)
 	internalHandler := c.getHandler(backendMapper, c.EC2DescribeInstancesQps, c.EC2DescribeInstancesBurst, stopCh)
 	c.httpServer = http.Server{
 		ErrorLog: log.New(errLog, "", 0),
@@ -151,6 +205,9 @@ func New(cfg config.Config, stopCh <-chan struct{}) *Server {
 	}
 	c.listener = listener
 	c.internalHandler = internalHandler
+	if c.MappingExpiryWarning > 0 {
+		newMappingExpiryChecker(internalHandler, c.MappingExpiryWarning).start(stopCh)
+	}
 	return c
 }
 
@@ -159,19 +216,28 @@ func (c *Server) Run(stopCh <-chan struct{}) {
 
 	defer c.listener.Close()
 
-	go func() {
-		http.ListenAndServe(":21363", &healthzHandler{})
-	}()
+	if c.AdminAddress != "" {
+		go func() {
+			logrus.Infof("serving admin endpoints on %s", c.AdminAddress)
+			if err := http.ListenAndServe(c.AdminAddress, c.internalHandler.adminHandler()); err != nil {
+				logrus.WithError(err).Error("admin server exited")
+			}
+		}()
+	}
 	go func() {
 		for {
 			select {
 			case <-stopCh:
 				logrus.Info("shut down mapper before return from Run")
-				close(c.internalHandler.backendMapper.mapperStopCh)
+				c.internalHandler.stopBackendMapper()
+				c.internalHandler.auditor.close()
 				return
 			}
 		}
 	}()
+	if c.WaitForMapperSync && !c.waitForMapperSync(stopCh) {
+		return
+	}
 	if err := c.httpServer.Serve(c.listener); err != nil {
 		logrus.WithError(err).Warning("http server exited")
 	}
@@ -186,11 +252,33 @@ func (c *Server) Close() {
 	c.httpServer.Shutdown(ctxTimeout)
 }
 
-type healthzHandler struct{}
-
-func (m *healthzHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintf(w, "ok")
+// waitForMapperSync blocks until every backend mapper has synced or
+// MapperSyncTimeout has passed. It returns false if stopCh was closed first.
+func (c *Server) waitForMapperSync(stopCh <-chan struct{}) bool {
+	var timeout <-chan time.Time
+	if c.MapperSyncTimeout > 0 {
+		timeout = time.After(c.MapperSyncTimeout)
+	}
+	ticker := time.NewTicker(mapperSyncPollInterval)
+	defer ticker.Stop()
+	for {
+		unsynced := c.internalHandler.currentBackendMapper().unsyncedMappers()
+		if len(unsynced) == 0 {
+			logrus.Info("backend mappers synced")
+			return true
+		}
+		logrus.Infof("waiting for backend mappers %v to sync before serving", unsynced)
+		select {
+		case <-stopCh:
+			return false
+		case <-timeout:
+			logrus.Warnf("backend mappers %v did not sync within %s, serving anyway", unsynced, c.MapperSyncTimeout)
+			return true
+		case <-ticker.C:
+		}
+	}
 }
+
 func (c *Server) getHandler(backendMapper BackendMapper, ec2DescribeQps int, ec2DescribeBurst int, stopCh <-chan struct{}) *handler {
 	if c.ServerEC2DescribeInstancesRoleARN != "" {
 		_, err := awsarn.Parse(c.ServerEC2DescribeInstancesRoleARN)
@@ -205,14 +293,85 @@ func (c *Server) getHandler(backendMapper BackendMapper, ec2DescribeQps int, ec2
 		logrus.WithError(err).Errorln("Region not found in instance metadata.")
 	}
 
+	verifier, err := token.NewVerifierWithOptions(token.VerifierOptions{
+		ClusterIDs:      c.ClusterIDs(),
+		PartitionIDs:    c.PartitionIDs(),
+		Region:          instanceRegion,
+		STSHostPatterns: c.STSHostPatterns,
+		STSHostRewrites: c.STSHostRewrites,
+		STSCABundle:     c.STSCABundle,
+		STSProxyURL:     c.STSProxyURL,
+
+		STSRetries:                 c.STSRetries,
+		STSRetryBackoff:            c.STSRetryBackoff,
+		STSCircuitBreakerThreshold: c.STSCircuitBreakerThreshold,
+		STSCircuitBreakerCooldown:  c.STSCircuitBreakerCooldown,
+		STSTimeout:                 c.STSTimeout,
+	})
+	if err != nil {
+		logrus.Fatalf("failed to create token verifier: %v", err)
+	}
+	// kept before the verifier is wrapped, for readiness
+	stsHealth, _ := verifier.(token.STSHealth)
+	// inside of the cache, so that its concurrent misses share an STS call
+	verifier = token.NewCoalescingVerifier(verifier)
+	if c.TokenCacheSize > 0 {
+		logrus.WithFields(logrus.Fields{
+			"size":        c.TokenCacheSize,
+			"ttl":         c.TokenCacheTTL,
+			"negativeTTL": c.TokenCacheNegativeTTL,
+		}).Info("caching verified tokens")
+		verifier = token.NewCachingVerifier(verifier, token.CacheOptions{
+			Size:        c.TokenCacheSize,
+			TTL:         c.TokenCacheTTL,
+			NegativeTTL: c.TokenCacheNegativeTTL,
+		})
+	}
+	if c.TokenSingleUse {
+		// outside of the cache, so that tokens answered from it are checked
+		store := token.NewMemoryReplayStore()
+		if c.TokenReplayDynamoDBTable != "" {
+			dynamoDBConfig := aws.NewConfig()
+			if aws.StringValue(sess.Config.Region) == "" {
+				dynamoDBConfig = dynamoDBConfig.WithRegion(instanceRegion)
+			}
+			store = token.NewDynamoDBReplayStore(dynamodb.New(sess, dynamoDBConfig), c.TokenReplayDynamoDBTable)
+		}
+		logrus.WithFields(logrus.Fields{
+			"gracePeriod":   c.TokenReplayGracePeriod,
+			"dynamoDBTable": c.TokenReplayDynamoDBTable,
+		}).Info("only accepting tokens once")
+		verifier = token.NewSingleUseVerifier(verifier, store, c.TokenReplayGracePeriod)
+	}
+
+	auditor, err := newAuditor(c.Config)
+	if err != nil {
+		logrus.WithError(err).Fatal("could not create audit sinks")
+	}
+
+	ec2Provider := ec2provider.New(c.ServerEC2DescribeInstancesRoleARN, c.SourceARN, instanceRegion, ec2DescribeQps, ec2DescribeBurst)
+	if c.EC2VerifyClusterMembership {
+		logrus.WithField("tag", c.EC2ClusterTagOrDefault()).Info("only mapping EC2 instances that are members of the cluster")
+		ec2Provider = ec2provider.NewClusterMemberProvider(ec2Provider, c.EC2ClusterTagOrDefault())
+	}
+
+	// validated by New
+	uidTemplate, _ := parseUIDTemplate(c.Config)
+
 	h := &handler{
-		verifier:                  token.NewVerifier(c.ClusterID, c.PartitionID, instanceRegion),
-		ec2Provider:               ec2provider.New(c.ServerEC2DescribeInstancesRoleARN, c.SourceARN, instanceRegion, ec2DescribeQps, ec2DescribeBurst),
+		stopCh:                    stopCh,
+		verifier:                  verifier,
+		stsHealth:                 stsHealth,
+		ec2Provider:               ec2Provider,
 		clusterID:                 c.ClusterID,
 		backendMapper:             backendMapper,
 		scrubbedAccounts:          c.Config.ScrubbedAWSAccounts,
 		cfg:                       c.Config,
+		uidTemplate:               uidTemplate,
 		backendModeConfigInitDone: false,
+		rateLimiter:               newRateLimiter(c.Config),
+		auditor:                   auditor,
+		events:                    newEventRecorder(c.Config),
 	}
 
 	h.HandleFunc("/authenticate", h.authenticateEndpoint)
@@ -220,6 +379,7 @@ func (c *Server) getHandler(backendMapper BackendMapper, ec2DescribeQps int, ec2
 	h.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, "ok")
 	})
+	h.HandleFunc("/readyz", h.readyzEndpoint)
 	logrus.Infof("Starting the h.ec2Provider.startEc2DescribeBatchProcessing ")
 	go h.ec2Provider.StartEc2DescribeBatchProcessing()
 	if strings.TrimSpace(c.DynamicBackendModePath) != "" {
@@ -233,6 +393,7 @@ func BuildMapperChain(cfg config.Config, modes []string) (BackendMapper, error)
 	backendMapper := BackendMapper{
 		mappers:      []mapper.Mapper{},
 		mapperStopCh: make(chan struct{}),
+		inFlight:     &sync.WaitGroup{},
 	}
 	for _, mode := range modes {
 		switch mode {
@@ -282,17 +443,228 @@ func BuildMapperChain(cfg config.Config, modes []string) (BackendMapper, error)
 	return backendMapper, nil
 }
 
+// unsyncedMappers returns the names of the mappers in the chain that haven't
+// loaded their mappings yet.
+func (b BackendMapper) unsyncedMappers() []string {
+	var unsynced []string
+	for _, m := range b.mappers {
+		if !m.HasSynced() {
+			unsynced = append(unsynced, m.Name())
+		}
+	}
+	return unsynced
+}
+
+// stop stops the mappers of the chain once the requests using it are done.
+func (b BackendMapper) stop() {
+	go func() {
+		// chains that weren't built by BuildMapperChain aren't reference counted
+		if b.inFlight != nil {
+			b.inFlight.Wait()
+		}
+		close(b.mapperStopCh)
+	}()
+}
+
+// currentBackendMapper returns the active mapper chain. Use
+// acquireBackendMapper to call its mappers.
+func (h *handler) currentBackendMapper() BackendMapper {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	return h.backendMapper
+}
+
+// acquireBackendMapper returns the active mapper chain, which won't be stopped
+// until release is called. A request that started on a chain finishes on it
+// even if the chain is swapped meanwhile.
+func (h *handler) acquireBackendMapper() (backendMapper BackendMapper, release func()) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	backendMapper = h.backendMapper
+	if backendMapper.inFlight == nil {
+		return backendMapper, func() {}
+	}
+	backendMapper.inFlight.Add(1)
+	return backendMapper, backendMapper.inFlight.Done
+}
+
+// pendingSwap is a mapper chain waiting for its mappers to sync before it is
+// swapped in
+type pendingSwap struct {
+	backendMapper BackendMapper
+	cancel        chan struct{}
+}
+
+// errSwapCancelled is returned when a newer chain replaced a pending one
+var errSwapCancelled = errors.New("a newer backend mapper chain was requested")
+
+// startBackendMapperSwap swaps backendMapper in once its mappers have synced,
+// in the background: the active chain keeps serving until then. A swap still
+// pending is cancelled, the latest chain wins.
+func (h *handler) startBackendMapperSwap(backendMapper BackendMapper) {
+	swap := &pendingSwap{backendMapper: backendMapper, cancel: make(chan struct{})}
+	h.mutex.Lock()
+	h.cancelPendingSwapLocked()
+	h.pendingSwap = swap
+	h.mutex.Unlock()
+
+	go func() {
+		err := h.swapBackendMapper(backendMapper, swap.cancel)
+		h.mutex.Lock()
+		if h.pendingSwap == swap {
+			h.pendingSwap = nil
+		}
+		h.mutex.Unlock()
+		if err == nil {
+			h.updateDynamicFileMetrics()
+		}
+	}()
+}
+
+// cancelPendingSwapLocked cancels the pending swap, if any. h.mutex must be
+// held.
+func (h *handler) cancelPendingSwapLocked() {
+	if h.pendingSwap != nil {
+		close(h.pendingSwap.cancel)
+		h.pendingSwap = nil
+	}
+}
+
+// backendModes returns the modes of the active chain, and of the pending one
+// if any
+func (h *handler) backendModes() (active, pending string) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	if h.pendingSwap != nil {
+		pending = h.pendingSwap.backendMapper.currentModes
+	}
+	return h.backendMapper.currentModes, pending
+}
+
+// swapBackendMapper makes backendMapper the active chain once all its mappers
+// have synced, and stops the previous chain. If they don't sync in time, or
+// cancel is closed first, backendMapper is stopped and the previous chain
+// stays active.
+func (h *handler) swapBackendMapper(backendMapper BackendMapper, cancel <-chan struct{}) error {
+	start := time.Now()
+	if err := h.waitForChainSync(backendMapper, cancel); err != nil {
+		backendMapper.stop()
+		if err == errSwapCancelled {
+			h.swapCancelled(backendMapper)
+			return err
+		}
+		metrics.Get().MapperChainSwaps.WithLabelValues(metrics.SwapNotSynced).Inc()
+		h.events.eventf(corev1.EventTypeWarning, MapperChainSwapFailed, "Not swapping in backend modes %q: %v", backendMapper.currentModes, err)
+		logrus.WithError(err).WithField("backendModes", backendMapper.currentModes).Error("not swapping the backend mapper chain")
+		return err
+	}
+
+	h.mutex.Lock()
+	if h.stopped {
+		h.mutex.Unlock()
+		backendMapper.stop()
+		return fmt.Errorf("server is shutting down, not swapping the backend mapper chain")
+	}
+	select {
+	case <-cancel:
+		h.mutex.Unlock()
+		backendMapper.stop()
+		h.swapCancelled(backendMapper)
+		return errSwapCancelled
+	default:
+	}
+	previous := h.backendMapper
+	h.backendMapper = backendMapper
+	h.mutex.Unlock()
+	previous.stop()
+
+	metrics.Get().MapperChainSwaps.WithLabelValues(metrics.Success).Inc()
+	metrics.Get().MapperChainSwapLatency.Observe(duration(start))
+	h.events.eventf(corev1.EventTypeNormal, MapperChainSwapped, "Swapped backend modes %q for %q", previous.currentModes, backendMapper.currentModes)
+	logrus.WithFields(logrus.Fields{
+		"previousBackendModes": previous.currentModes,
+		"backendModes":         backendMapper.currentModes,
+		"syncSeconds":          duration(start),
+	}).Info("swapped the backend mapper chain")
+	return nil
+}
+
+func (h *handler) swapCancelled(backendMapper BackendMapper) {
+	metrics.Get().MapperChainSwaps.WithLabelValues(metrics.SwapCancelled).Inc()
+	h.events.eventf(corev1.EventTypeNormal, MapperChainSwapCancelled, "Not swapping in backend modes %q: %v", backendMapper.currentModes, errSwapCancelled)
+	logrus.WithField("backendModes", backendMapper.currentModes).Info("not swapping the backend mapper chain, a newer one was requested")
+}
+
+// waitForChainSync blocks until every mapper of backendMapper has synced. It
+// gives up after MapperSyncTimeout, or defaultMapperSwapTimeout if unset, and
+// returns errSwapCancelled once cancel is closed.
+func (h *handler) waitForChainSync(backendMapper BackendMapper, cancel <-chan struct{}) error {
+	timeout := h.cfg.MapperSyncTimeout
+	if timeout <= 0 {
+		timeout = defaultMapperSwapTimeout
+	}
+	deadline := time.After(timeout)
+	ticker := time.NewTicker(mapperSyncPollInterval)
+	defer ticker.Stop()
+	for {
+		unsynced := backendMapper.unsyncedMappers()
+		if len(unsynced) == 0 {
+			return nil
+		}
+		select {
+		case <-h.stopCh:
+			return fmt.Errorf("stopped before backend mappers %v synced", unsynced)
+		case <-cancel:
+			return errSwapCancelled
+		case <-deadline:
+			return fmt.Errorf("backend mappers %v did not sync within %s", unsynced, timeout)
+		case <-ticker.C:
+		}
+	}
+}
+
+// stopBackendMapper stops the active chain, and any chain swapped in later.
+func (h *handler) stopBackendMapper() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.stopped {
+		return
+	}
+	h.stopped = true
+	h.backendMapper.stop()
+}
+
+// readyzEndpoint returns a 503 until every mapper in the chain has synced, so
+// that the authenticator isn't sent traffic it would deny for lack of mappings.
+// STS regions whose circuit breaker is open are reported, but don't make the
+// authenticator unready: tokens from the other regions are still verified.
+func (h *handler) readyzEndpoint(w http.ResponseWriter, req *http.Request) {
+	if unsynced := h.currentBackendMapper().unsyncedMappers(); len(unsynced) > 0 {
+		http.Error(w, fmt.Sprintf("backend mappers not synced: %s", strings.Join(unsynced, ", ")), http.StatusServiceUnavailable)
+		return
+	}
+	if h.stsHealth != nil {
+		if regions := h.stsHealth.UnavailableSTSRegions(); len(regions) > 0 {
+			fmt.Fprintf(w, "ok, degraded: STS unavailable in regions: %s", strings.Join(regions, ", "))
+			return
+		}
+	}
+	fmt.Fprintf(w, "ok")
+}
+
 func duration(start time.Time) float64 {
 	return time.Since(start).Seconds()
 }
 
 func (h *handler) isLoggableIdentity(identity *token.Identity) bool {
-	for _, account := range h.scrubbedAccounts {
-		if identity.AccountID == account {
-			return false
-		}
-	}
-	return true
+	return !h.isScrubbedAccount(identity.AccountID)
+}
+
+// isLoggableAccessKeyID reports whether an unverified access key ID may be
+// recorded. Before a token is verified we don't know which account it belongs
+// to, so this is only the case when no accounts are scrubbed.
+func (h *handler) isLoggableAccessKeyID(accessKeyID string) bool {
+	return accessKeyID != "" && len(h.scrubbedAccounts) == 0
 }
 
 func (h *handler) authenticateEndpoint(w http.ResponseWriter, req *http.Request) {
@@ -317,27 +689,69 @@ func (h *handler) authenticateEndpoint(w http.ResponseWriter, req *http.Request)
 	}
 	defer req.Body.Close()
 
-	var tokenReview authenticationv1beta1.TokenReview
+	// authentication.k8s.io/v1 and v1beta1 TokenReviews share the same wire
+	// format, so we decode either into the v1 type and answer with the
+	// apiVersion the API server asked in.
+	var tokenReview authenticationv1.TokenReview
 	if err := json.NewDecoder(req.Body).Decode(&tokenReview); err != nil {
 		log.WithError(err).Error("could not parse request body")
 		http.Error(w, "expected a request body to be a TokenReview", http.StatusBadRequest)
 		metrics.Get().Latency.WithLabelValues(metrics.Malformed).Observe(duration(start))
 		return
 	}
-
-	// TODO: rate limit here so we can't be tricked into spamming AWS
+	apiVersion := tokenReview.APIVersion
+	denyResponse, ok := tokenReviewDenyJSONByVersion[apiVersion]
+	if !ok {
+		log.WithField("apiVersion", apiVersion).Error("unsupported TokenReview apiVersion")
+		http.Error(w, fmt.Sprintf("unsupported TokenReview apiVersion %q", apiVersion), http.StatusBadRequest)
+		metrics.Get().Latency.WithLabelValues(metrics.Malformed).Observe(duration(start))
+		return
+	}
 
 	// all responses from here down have JSON bodies
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 
+	// every TokenReview from here down is audited, as a deny unless it is
+	// explicitly allowed
+	auditRecord := &AuditRecord{
+		Timestamp: start,
+		Decision:  AuditDecisionDeny,
+		Client:    req.RemoteAddr,
+	}
+	defer func() {
+		auditRecord.LatencySeconds = duration(start)
+		h.auditor.audit(auditRecord)
+	}()
+
+	// shed load before calling STS so we can't be tricked into spamming AWS.
+	// The access key ID is unverified at this point, it only keys the limit.
+	accessKeyID, _ := token.AccessKeyID(tokenReview.Spec.Token)
+	release, limit := h.rateLimiter.acquire(accessKeyID)
+	if limit != "" {
+		metrics.Get().RateLimited.WithLabelValues(limit).Inc()
+		metrics.Get().Latency.WithLabelValues(metrics.RateLimited).Observe(duration(start))
+		limitLog := log.WithField("limit", limit)
+		auditRecord.Reason = fmt.Sprintf("rate limited (%s)", limit)
+		if h.isLoggableAccessKeyID(accessKeyID) {
+			limitLog = limitLog.WithField("accesskeyid", accessKeyID)
+			auditRecord.AccessKeyID = accessKeyID
+		}
+		limitLog.Warn("access denied: rate limited")
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write(denyResponse)
+		return
+	}
+	defer release()
+
 	// if the token is invalid, reject with a 403
 	identity, err := h.verifier.Verify(tokenReview.Spec.Token)
 	if err != nil {
+		auditRecord.Reason = auditReason(err)
 		if _, ok := err.(token.STSThrottling); ok {
 			metrics.Get().Latency.WithLabelValues(metrics.STSThrottling).Observe(duration(start))
 			log.WithError(err).Warn("access denied")
 			w.WriteHeader(http.StatusTooManyRequests)
-			w.Write(tokenReviewDenyJSON)
+			w.Write(denyResponse)
 			return
 		} else if _, ok := err.(token.STSError); ok {
 			metrics.Get().Latency.WithLabelValues(metrics.STSError).Observe(duration(start))
@@ -346,7 +760,7 @@ func (h *handler) authenticateEndpoint(w http.ResponseWriter, req *http.Request)
 		}
 		log.WithError(err).Warn("access denied")
 		w.WriteHeader(http.StatusForbidden)
-		w.Write(tokenReviewDenyJSON)
+		w.Write(denyResponse)
 		return
 	}
 
@@ -358,56 +772,55 @@ func (h *handler) authenticateEndpoint(w http.ResponseWriter, req *http.Request)
 			"userid":      identity.UserID,
 			"session":     identity.SessionName,
 			"stsendpoint": identity.STSEndpoint,
+			"clusterid":   identity.ClusterID,
 		}).Info("STS response")
 
 		// look up the ARN in each of our mappings to fill in the username and groups
 		log = log.WithField("arn", identity.CanonicalARN)
 	}
 
-	username, groups, err := h.doMapping(identity)
+	auditRecord.setIdentity(identity, h.isLoggableIdentity(identity))
+
+	mapping, err := h.doMapping(identity, nil)
 	if err != nil {
+		auditRecord.Reason = err.Error()
 		metrics.Get().Latency.WithLabelValues(metrics.Unknown).Observe(duration(start))
 		log.WithError(err).Warn("access denied")
 		w.WriteHeader(http.StatusForbidden)
-		w.Write(tokenReviewDenyJSON)
+		w.Write(denyResponse)
 		return
 	}
 
-	uid := fmt.Sprintf("aws-iam-authenticator:administrative:%s", username)
-	if h.isLoggableIdentity(identity) {
-		// use a prefixed UID that includes the AWS account ID and AWS user ID ("AROAAAAAAAAAAAAAAAAAA")
-		uid = fmt.Sprintf("aws-iam-authenticator:%s:%s", identity.AccountID, identity.UserID)
+	userInfo, err := h.userInfo(identity, mapping)
+	if err != nil {
+		auditRecord.Reason = err.Error()
+		metrics.Get().Latency.WithLabelValues(metrics.Unknown).Observe(duration(start))
+		log.WithError(err).Warn("access denied")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write(denyResponse)
+		return
 	}
 
 	// the token is valid and the role is mapped, return success!
 	log.WithFields(logrus.Fields{
-		"username":    username,
-		"uid":         uid,
-		"groups":      groups,
+		"username":    userInfo.Username,
+		"uid":         userInfo.UID,
+		"groups":      userInfo.Groups,
 		"stsendpoint": identity.STSEndpoint,
+		"mapper":      mapping.mapper,
 	}).Info("access granted")
+	auditRecord.Decision = AuditDecisionAllow
+	auditRecord.Mapper = mapping.mapper
+	auditRecord.Username = userInfo.Username
+	auditRecord.Groups = userInfo.Groups
 	metrics.Get().Latency.WithLabelValues(metrics.Success).Observe(duration(start))
 	w.WriteHeader(http.StatusOK)
 
-	userExtra := map[string]authenticationv1beta1.ExtraValue{}
-	if h.isLoggableIdentity(identity) {
-		userExtra["arn"] = authenticationv1beta1.ExtraValue{identity.ARN}
-		userExtra["canonicalArn"] = authenticationv1beta1.ExtraValue{identity.CanonicalARN}
-		userExtra["sessionName"] = authenticationv1beta1.ExtraValue{identity.SessionName}
-		userExtra["accessKeyId"] = authenticationv1beta1.ExtraValue{identity.AccessKeyID}
-		userExtra["principalId"] = authenticationv1beta1.ExtraValue{identity.UserID}
-		userExtra["sigs.k8s.io/aws-iam-authenticator/principalId"] = authenticationv1beta1.ExtraValue{identity.UserID}
-	}
-
-	json.NewEncoder(w).Encode(authenticationv1beta1.TokenReview{
-		Status: authenticationv1beta1.TokenReviewStatus{
+	json.NewEncoder(w).Encode(authenticationv1.TokenReview{
+		TypeMeta: tokenReviewTypeMeta(apiVersion),
+		Status: authenticationv1.TokenReviewStatus{
 			Authenticated: true,
-			User: authenticationv1beta1.UserInfo{
-				Username: username,
-				UID:      uid,
-				Groups:   groups,
-				Extra:    userExtra,
-			},
+			User:          userInfo,
 		},
 	})
 }
@@ -421,80 +834,189 @@ func ReservedPrefixExists(username string, reservedList []string) bool {
 	return false
 }
 
-func (h *handler) doMapping(identity *token.Identity) (string, []string, error) {
+// mappingResult is the Kubernetes user an identity was mapped to.
+type mappingResult struct {
+	username string
+	groups   []string
+	// mapper is the name of the mapper in the chain that matched
+	mapper string
+	// source is the mapping that matched within the mapper
+	source string
+	extra  map[string][]string
+}
+
+// mappingResultLabel is the result label of the mapping latency metric for
+// the error returned by Mapper.Map
+func mappingResultLabel(err error) string {
+	switch err {
+	case nil:
+		return metrics.MappingHit
+	case errutil.ErrNotMapped:
+		return metrics.MappingMiss
+	default:
+		return metrics.MappingError
+	}
+}
+
+// doMapping runs identity through the mapper chain. If explanation is not nil
+// it records how each mapper handled the identity.
+func (h *handler) doMapping(identity *token.Identity, explanation *Explanation) (*mappingResult, error) {
 	var errs []error
 
-	for _, m := range h.backendMapper.mappers {
+	backendMapper, release := h.acquireBackendMapper()
+	defer release()
+	// a deny mapping of any mapper takes precedence over the allows
+	for _, m := range backendMapper.mappers {
+		denyMapping, err := m.Deny(identity)
+		if err != nil {
+			// the identity may be denied, don't risk allowing it
+			err = fmt.Errorf("mapper %s Deny error: %v", m.Name(), err)
+			explanation.addStep(MappingStep{Mapper: m.Name(), Result: MappingStepError}, err)
+			return nil, err
+		}
+		if denyMapping != nil {
+			explanation.addStep(MappingStep{Mapper: m.Name(), Result: MappingStepDenied, Entry: denyMapping.Key()}, nil)
+			// the error ends up in the audit record, the key matched may be a
+			// scrubbed account's so it is only logged
+			if h.isLoggableIdentity(identity) {
+				logrus.WithFields(logrus.Fields{
+					"mapper":      m.Name(),
+					"denymapping": denyMapping.Key(),
+				}).Info("identity matched a deny mapping")
+			}
+			if denyMapping.Reason != "" {
+				return nil, fmt.Errorf("denied by mapper %s: %s", m.Name(), denyMapping.Reason)
+			}
+			return nil, fmt.Errorf("denied by mapper %s", m.Name())
+		}
+	}
+	for _, m := range backendMapper.mappers {
+		start := time.Now()
 		mapping, err := m.Map(identity)
+		if explanation == nil {
+			metrics.Get().MappingLatency.WithLabelValues(m.Name(), mappingResultLabel(err)).Observe(duration(start))
+		}
 		if err == nil {
+			step := MappingStep{
+				Mapper:           m.Name(),
+				Result:           MappingStepMatched,
+				Entry:            mapping.IdentityARN,
+				UsernameTemplate: mapping.Username,
+				GroupTemplates:   mapping.Groups,
+			}
 			// Mapping found, try to render any templates like {{EC2PrivateDNSName}}
-			username, groups, err := h.renderTemplates(*mapping, identity)
+			result, err := h.renderMapping(m, *mapping, identity, explanation)
+			explanation.addStep(step, err)
 			if err != nil {
-				return "", nil, fmt.Errorf("mapper %s renderTemplates error: %v", m.Name(), err)
-			}
-			if len(m.UsernamePrefixReserveList()) > 0 && ReservedPrefixExists(username, m.UsernamePrefixReserveList()) {
-				return "", nil, fmt.Errorf("invalid username '%s' for mapper %s: username must not begin with with the following prefixes: %v", username, m.Name(), m.UsernamePrefixReserveList())
+				return nil, err
 			}
-			return username, groups, nil
+			return result, nil
 		} else {
+			step := MappingStep{Mapper: m.Name(), Result: MappingStepNotMapped}
 			if err != errutil.ErrNotMapped {
 				errs = append(errs, fmt.Errorf("mapper %s Map error: %v", m.Name(), err))
+				step.Result = MappingStepError
+			} else {
+				err = nil
 			}
 
-			if m.IsAccountAllowed(identity.AccountID) {
-				return identity.CanonicalARN, []string{}, nil
+			if accountMapping := m.AccountMapping(identity.AccountID); accountMapping != nil {
+				mapping := accountMapping.IdentityMapping(identity)
+				step.Result = MappingStepAccountAllowed
+				step.Entry = accountMapping.Key()
+				step.UsernameTemplate = mapping.Username
+				step.GroupTemplates = mapping.Groups
+				result, renderErr := h.renderMapping(m, *mapping, identity, explanation)
+				if renderErr != nil {
+					explanation.addStep(step, renderErr)
+					return nil, renderErr
+				}
+				explanation.addStep(step, err)
+				return result, nil
 			}
+			explanation.addStep(step, err)
 		}
 	}
 
 	if len(errs) > 0 {
-		return "", nil, utilerrors.NewAggregate(errs)
+		return nil, utilerrors.NewAggregate(errs)
+	}
+	return nil, errutil.ErrNotMapped
+}
+
+// renderMapping renders the username, groups and extra of a mapping of m and
+// checks that the username doesn't use one of the prefixes m reserves. When
+// explaining, EC2 isn't called and no metrics are recorded.
+func (h *handler) renderMapping(m mapper.Mapper, mapping config.IdentityMapping, identity *token.Identity, explanation *Explanation) (*mappingResult, error) {
+	var ec2 template.EC2Provider = h.ec2Provider
+	if explanation != nil {
+		ec2 = explainEC2Provider{}
+	}
+	result, err := renderTemplates(m, mapping, identity, ec2)
+	if err != nil {
+		if explanation == nil {
+			metrics.Get().TemplateFailures.WithLabelValues(m.Name()).Inc()
+		}
+		return nil, fmt.Errorf("mapper %s renderTemplates error: %v", m.Name(), err)
+	}
+	if len(m.UsernamePrefixReserveList()) > 0 && ReservedPrefixExists(result.username, m.UsernamePrefixReserveList()) {
+		return nil, fmt.Errorf("invalid username '%s' for mapper %s: username must not begin with with the following prefixes: %v", result.username, m.Name(), m.UsernamePrefixReserveList())
 	}
-	return "", nil, errutil.ErrNotMapped
+	result.mapper = m.Name()
+	result.source = mapping.Source
+	return result, nil
 }
 
-func (h *handler) renderTemplates(mapping config.IdentityMapping, identity *token.Identity) (string, []string, error) {
+// renderTemplates renders the templates of mapping, which m parsed when it
+// loaded the mapping. They are parsed again if m has reloaded its mappings
+// since then and no longer has them.
+func renderTemplates(m mapper.Mapper, mapping config.IdentityMapping, identity *token.Identity, ec2 template.EC2Provider) (*mappingResult, error) {
+	render := func(pattern string) (string, error) {
+		t := m.Template(pattern)
+		if t == nil {
+			var err error
+			if t, err = template.Parse(pattern); err != nil {
+				return "", err
+			}
+		}
+		return t.Execute(identity, ec2)
+	}
+
 	var username string
 	groups := []string{}
 	var err error
 
 	userPattern := mapping.Username
-	username, err = h.renderTemplate(userPattern, identity)
+	username, err = render(userPattern)
 	if err != nil {
-		return "", nil, fmt.Errorf("error rendering username template %q: %s", userPattern, err.Error())
+		return nil, fmt.Errorf("error rendering username template %q: %s", userPattern, err.Error())
 	}
 
 	for _, groupPattern := range mapping.Groups {
-		group, err := h.renderTemplate(groupPattern, identity)
+		group, err := render(groupPattern)
 		if err != nil {
-			return "", nil, fmt.Errorf("error rendering group template %q: %s", groupPattern, err.Error())
+			return nil, fmt.Errorf("error rendering group template %q: %s", groupPattern, err.Error())
 		}
 		groups = append(groups, group)
 	}
 
-	return username, groups, nil
-}
-
-func (h *handler) renderTemplate(template string, identity *token.Identity) (string, error) {
-	// Private DNS requires EC2 API call
-	if strings.Contains(template, "{{EC2PrivateDNSName}}") {
-		if !instanceIDPattern.MatchString(identity.SessionName) {
-			return "", fmt.Errorf("SessionName did not contain an instance id")
+	var extra map[string][]string
+	for key, patterns := range mapping.Extra {
+		values := make([]string, 0, len(patterns))
+		for _, pattern := range patterns {
+			value, err := render(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("error rendering extra %q template %q: %s", key, pattern, err.Error())
+			}
+			values = append(values, value)
 		}
-		privateDNSName, err := h.ec2Provider.GetPrivateDNSName(identity.SessionName)
-		if err != nil {
-			return "", err
+		if extra == nil {
+			extra = map[string][]string{}
 		}
-		template = strings.Replace(template, "{{EC2PrivateDNSName}}", privateDNSName, -1)
+		extra[key] = values
 	}
 
-	template = strings.Replace(template, "{{AccountID}}", identity.AccountID, -1)
-	sessionName := strings.Replace(identity.SessionName, "@", "-", -1)
-	template = strings.Replace(template, "{{SessionName}}", sessionName, -1)
-	template = strings.Replace(template, "{{SessionNameRaw}}", identity.SessionName, -1)
-	template = strings.Replace(template, "{{AccessKeyID}}", identity.AccessKeyID, -1)
-
-	return template, nil
+	return &mappingResult{username: username, groups: groups, extra: extra}, nil
 }
 
 func (h *handler) CallBackForFileLoad(dynamicContent []byte) error {
@@ -505,18 +1027,28 @@ func (h *handler) CallBackForFileLoad(dynamicContent []byte) error {
 		logrus.Infof("CallBackForFileLoad: could not unmarshal dynamic file.")
 		return err
 	}
-	if h.backendMapper.currentModes != backendModes.BackendMode {
-		logrus.Infof("BackendMode dynamic file got changed, %s different from current mode %s, rebuild mapper", backendModes.BackendMode, h.backendMapper.currentModes)
+	switch activeModes, pendingModes := h.backendModes(); {
+	case backendModes.BackendMode == pendingModes:
+		logrus.Infof("BackendMode dynamic file got changed, but same with pending mode, skip rebuild mapper")
+	case backendModes.BackendMode == activeModes && pendingModes != "":
+		logrus.Infof("BackendMode dynamic file got changed back to current mode %s, cancel pending mode %s", activeModes, pendingModes)
+		h.mutex.Lock()
+		h.cancelPendingSwapLocked()
+		h.mutex.Unlock()
+	case backendModes.BackendMode == activeModes:
+		logrus.Infof("BackendMode dynamic file got changed, but same with current mode, skip rebuild mapper")
+	default:
+		logrus.Infof("BackendMode dynamic file got changed, %s different from current mode %s, rebuild mapper", backendModes.BackendMode, activeModes)
 		newMapper, err := BuildMapperChain(h.cfg, strings.Split(backendModes.BackendMode, " "))
-		if err == nil && len(newMapper.mappers) > 0 {
-			// replace the mapper
-			close(h.backendMapper.mapperStopCh)
-			h.backendMapper = newMapper
-		} else {
+		if err != nil {
+			metrics.Get().MapperChainSwaps.WithLabelValues(metrics.SwapBuildFailed).Inc()
+			h.events.eventf(corev1.EventTypeWarning, MapperChainSwapFailed, "Could not build backend modes %q: %v", backendModes.BackendMode, err)
 			return err
 		}
-	} else {
-		logrus.Infof("BackendMode dynamic file got changed, but same with current mode, skip rebuild mapper")
+		if len(newMapper.mappers) > 0 {
+			// replace the mapper once it has synced
+			h.startBackendMapperSwap(newMapper)
+		}
 	}
 
 	// when instance or container restarts, the backendend mode config is (re)loaded and the latency metric is calculated
@@ -537,25 +1069,31 @@ func (h *handler) CallBackForFileLoad(dynamicContent []byte) error {
 		}
 	}
 	h.backendModeConfigInitDone = true
+	h.updateDynamicFileMetrics()
+	return nil
+}
 
-	if h.backendMapper.currentModes == mapper.ModeDynamicFile {
+// updateDynamicFileMetrics records whether the active chain uses the
+// DynamicFile mapper
+func (h *handler) updateDynamicFileMetrics() {
+	if currentModes := h.currentBackendMapper().currentModes; currentModes == mapper.ModeDynamicFile {
 		metrics.Get().DynamicFileOnly.Set(1)
-	} else if strings.Contains(h.backendMapper.currentModes, mapper.ModeDynamicFile) {
+	} else if strings.Contains(currentModes, mapper.ModeDynamicFile) {
 		metrics.Get().DynamicFileEnabled.Set(1)
 	}
-
-	return nil
 }
 
 func (h *handler) CallBackForFileDeletion() error {
 	logrus.Infof("BackendMode dynamic file got deleted")
 	backendMapper, err := BuildMapperChain(h.cfg, h.cfg.BackendMode)
-	if err == nil && len(backendMapper.mappers) > 0 {
-		// replace the mapper
-		close(h.backendMapper.mapperStopCh)
-		h.backendMapper = backendMapper
-	} else {
+	if err != nil {
+		metrics.Get().MapperChainSwaps.WithLabelValues(metrics.SwapBuildFailed).Inc()
+		h.events.eventf(corev1.EventTypeWarning, MapperChainSwapFailed, "Could not build backend modes %q: %v", strings.Join(h.cfg.BackendMode, " "), err)
 		return err
 	}
+	if len(backendMapper.mappers) > 0 {
+		// replace the mapper once it has synced
+		h.startBackendMapperSwap(backendMapper)
+	}
 	return nil
 }
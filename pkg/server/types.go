@@ -19,6 +19,7 @@ package server
 import (
 	"net"
 	"net/http"
+	"sync"
 
 	"sigs.k8s.io/aws-iam-authenticator/pkg/config"
 	"sigs.k8s.io/aws-iam-authenticator/pkg/mapper"
@@ -37,6 +38,9 @@ type BackendMapper struct {
 	mappers      []mapper.Mapper
 	mapperStopCh chan struct{}
 	currentModes string
+	// inFlight counts the requests using this chain, it is stopped once
+	// they are done
+	inFlight *sync.WaitGroup
 }
 
 // AccessConfig represents the configuration format for cluster access config via backend mode.
@@ -0,0 +1,177 @@
+/*
+Copyright 2017-2020 by the contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"sort"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	"sigs.k8s.io/aws-iam-authenticator/pkg/config"
+	"sigs.k8s.io/aws-iam-authenticator/pkg/template"
+	"sigs.k8s.io/aws-iam-authenticator/pkg/token"
+)
+
+// DefaultUIDTemplate is the UID of authenticated users unless configured, a
+// prefixed UID with their AWS account ID and AWS user ID ("AROAAAAAAAAAAAAAAAAAA")
+const DefaultUIDTemplate = "aws-iam-authenticator:{{AccountID}}:{{UserID}}"
+
+var defaultUIDTemplate = template.MustParse(DefaultUIDTemplate)
+
+// DefaultExtraAttributes are the attributes returned as user extra unless
+// configured.
+var DefaultExtraAttributes = []string{
+	"arn",
+	"canonicalArn",
+	"sessionName",
+	"accessKeyId",
+	"principalId",
+	"sigs.k8s.io/aws-iam-authenticator/principalId",
+}
+
+// extraAttribute is the value of a user extra attribute
+type extraAttribute struct {
+	value func(identity *token.Identity, mapping *mappingResult) string
+	// scrubbed attributes reveal the account of the identity, they are left
+	// out for identities of scrubbed accounts
+	scrubbed bool
+}
+
+// extraAttributes are the attributes Config.ExtraAttributes can contain, the
+// name of each is its user extra key.
+var extraAttributes = map[string]extraAttribute{
+	"arn": {
+		value:    func(identity *token.Identity, _ *mappingResult) string { return identity.ARN },
+		scrubbed: true,
+	},
+	"canonicalArn": {
+		value:    func(identity *token.Identity, _ *mappingResult) string { return identity.CanonicalARN },
+		scrubbed: true,
+	},
+	"sessionName": {
+		value:    func(identity *token.Identity, _ *mappingResult) string { return identity.SessionName },
+		scrubbed: true,
+	},
+	"accessKeyId": {
+		value:    func(identity *token.Identity, _ *mappingResult) string { return identity.AccessKeyID },
+		scrubbed: true,
+	},
+	"principalId": {
+		value:    func(identity *token.Identity, _ *mappingResult) string { return identity.UserID },
+		scrubbed: true,
+	},
+	"sigs.k8s.io/aws-iam-authenticator/principalId": {
+		value:    func(identity *token.Identity, _ *mappingResult) string { return identity.UserID },
+		scrubbed: true,
+	},
+	"accountId": {
+		value:    func(identity *token.Identity, _ *mappingResult) string { return identity.AccountID },
+		scrubbed: true,
+	},
+	"stsEndpoint": {
+		value:    func(identity *token.Identity, _ *mappingResult) string { return identity.STSEndpoint },
+		scrubbed: true,
+	},
+	"clusterId": {
+		value: func(identity *token.Identity, _ *mappingResult) string { return identity.ClusterID },
+	},
+	"mapper": {
+		value: func(_ *token.Identity, mapping *mappingResult) string { return mapping.mapper },
+	},
+	"mappingSource": {
+		value:    func(_ *token.Identity, mapping *mappingResult) string { return mapping.source },
+		scrubbed: true,
+	},
+}
+
+// validateUserInfo returns an error if the UID template or one of the extra
+// attributes of cfg is not valid
+func validateUserInfo(cfg config.Config) error {
+	if _, err := parseUIDTemplate(cfg); err != nil {
+		return err
+	}
+	for _, name := range cfg.ExtraAttributes {
+		if _, ok := extraAttributes[name]; !ok {
+			names := make([]string, 0, len(extraAttributes))
+			for name := range extraAttributes {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return fmt.Errorf("unknown extra attribute %q, must be one of %v", name, names)
+		}
+	}
+	return nil
+}
+
+// parseUIDTemplate returns the UID template of cfg, parsed once when the
+// handler is created, or the default one if it isn't set.
+func parseUIDTemplate(cfg config.Config) (*template.Template, error) {
+	if cfg.UIDTemplate == "" {
+		return defaultUIDTemplate, nil
+	}
+	t, err := template.Parse(cfg.UIDTemplate)
+	if err == nil {
+		err = t.Validate()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid UID template %q: %v", cfg.UIDTemplate, err)
+	}
+	return t, nil
+}
+
+// userInfo returns the Kubernetes user identity was mapped to. The extra of
+// the mapping is overridden by the configured attributes, so that a mapping
+// can't impersonate them.
+func (h *handler) userInfo(identity *token.Identity, mapping *mappingResult) (authenticationv1.UserInfo, error) {
+	loggable := h.isLoggableIdentity(identity)
+
+	uid := fmt.Sprintf("aws-iam-authenticator:administrative:%s", mapping.username)
+	if loggable {
+		uidTemplate := h.uidTemplate
+		if uidTemplate == nil {
+			uidTemplate = defaultUIDTemplate
+		}
+		var err error
+		uid, err = uidTemplate.Execute(identity, h.ec2Provider)
+		if err != nil {
+			return authenticationv1.UserInfo{}, fmt.Errorf("error rendering UID template %q: %v", uidTemplate, err)
+		}
+	}
+
+	userExtra := map[string]authenticationv1.ExtraValue{}
+	for key, values := range mapping.extra {
+		userExtra[key] = authenticationv1.ExtraValue(values)
+	}
+	attributes := h.cfg.ExtraAttributes
+	if attributes == nil {
+		attributes = DefaultExtraAttributes
+	}
+	for _, name := range attributes {
+		attribute, ok := extraAttributes[name]
+		if !ok || (attribute.scrubbed && !loggable) {
+			continue
+		}
+		userExtra[name] = authenticationv1.ExtraValue{attribute.value(identity, mapping)}
+	}
+
+	return authenticationv1.UserInfo{
+		Username: mapping.username,
+		UID:      uid,
+		Groups:   mapping.groups,
+		Extra:    userExtra,
+	}, nil
+}
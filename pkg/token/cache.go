@@ -0,0 +1,134 @@
+/*
+Copyright 2017-2020 by the contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package token
+
+import (
+	"crypto/sha256"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/cache"
+	"sigs.k8s.io/aws-iam-authenticator/pkg/metrics"
+)
+
+// CacheOptions configures the verified-token cache returned by NewCachingVerifier.
+type CacheOptions struct {
+	// Size is the maximum number of cached verification results.
+	Size int
+	// TTL is how long a successful verification is cached. Entries never
+	// outlive the expiration of the token itself.
+	TTL time.Duration
+	// NegativeTTL is how long a token that STS rejected, or that was
+	// malformed, is cached. 0 disables negative caching.
+	NegativeTTL time.Duration
+}
+
+// cachingVerifier remembers verification results so that kubectl re-sending
+// the same pre-signed token doesn't result in a GetCallerIdentity call every
+// time.
+type cachingVerifier struct {
+	verifier    Verifier
+	cache       *cache.LRUExpireCache
+	ttl         time.Duration
+	negativeTTL time.Duration
+	nowFunc     func() time.Time
+}
+
+// cacheEntry is a cached verification result, exactly one of identity or err is set.
+type cacheEntry struct {
+	identity *Identity
+	err      error
+}
+
+type clockFunc func() time.Time
+
+func (f clockFunc) Now() time.Time { return f() }
+
+// NewCachingVerifier returns a Verifier that caches the results of verifier,
+// keyed by a hash of the token.
+func NewCachingVerifier(verifier Verifier, opts CacheOptions) Verifier {
+	return newCachingVerifier(verifier, opts, time.Now)
+}
+
+func newCachingVerifier(verifier Verifier, opts CacheOptions, nowFunc func() time.Time) *cachingVerifier {
+	return &cachingVerifier{
+		verifier:    verifier,
+		cache:       cache.NewLRUExpireCacheWithClock(opts.Size, clockFunc(nowFunc)),
+		ttl:         opts.TTL,
+		negativeTTL: opts.NegativeTTL,
+		nowFunc:     nowFunc,
+	}
+}
+
+// Verify returns the cached result for token if there is one, and otherwise
+// verifies it and caches the result.
+func (v *cachingVerifier) Verify(token string) (*Identity, error) {
+	key := sha256.Sum256([]byte(token))
+	if cached, ok := v.cache.Get(key); ok {
+		entry := cached.(cacheEntry)
+		if entry.err != nil {
+			metrics.Get().TokenCache.WithLabelValues(metrics.CacheNegativeHit).Inc()
+			return nil, entry.err
+		}
+		metrics.Get().TokenCache.WithLabelValues(metrics.CacheHit).Inc()
+		identity := *entry.identity
+		return &identity, nil
+	}
+	metrics.Get().TokenCache.WithLabelValues(metrics.CacheMiss).Inc()
+
+	identity, err := v.verifier.Verify(token)
+	if err != nil {
+		if v.negativeTTL > 0 && isCacheableError(err) {
+			v.add(key, token, cacheEntry{err: err}, v.negativeTTL)
+		}
+		return nil, err
+	}
+	cached := *identity
+	v.add(key, token, cacheEntry{identity: &cached}, v.ttl)
+	return identity, nil
+}
+
+// add caches entry for at most ttl, and never past the expiration of token.
+func (v *cachingVerifier) add(key [sha256.Size]byte, token string, entry cacheEntry, ttl time.Duration) {
+	expiration, err := Expiration(token)
+	if err != nil {
+		// a token we can't find the expiration of can only be a malformed
+		// one, which is cached for the negative TTL regardless
+		if entry.err == nil {
+			return
+		}
+	} else if remaining := expiration.Sub(v.nowFunc()); remaining < ttl {
+		ttl = remaining
+	}
+	if ttl <= 0 {
+		return
+	}
+	v.cache.Add(key, entry, ttl)
+}
+
+// isCacheableError returns true for errors that will be the same no matter
+// how many times the token is verified. Throttling and failures talking to
+// STS are transient and are never cached.
+func isCacheableError(err error) bool {
+	switch e := err.(type) {
+	case FormatError:
+		return true
+	case STSError:
+		return e.rejected
+	default:
+		return false
+	}
+}
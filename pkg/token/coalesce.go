@@ -0,0 +1,58 @@
+/*
+Copyright 2017-2020 by the contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package token
+
+import (
+	"crypto/sha256"
+
+	"golang.org/x/sync/singleflight"
+	"sigs.k8s.io/aws-iam-authenticator/pkg/metrics"
+)
+
+// coalescingVerifier shares a single verification between the concurrent
+// requests for the same token, e.g. a kubectl burst or a controller fan-out.
+// Unlike cachingVerifier, it doesn't remember the result once it's returned.
+type coalescingVerifier struct {
+	verifier Verifier
+	group    singleflight.Group
+}
+
+// NewCoalescingVerifier returns a Verifier that calls verifier once for the
+// concurrent verifications of the same token, keyed by a hash of the token.
+func NewCoalescingVerifier(verifier Verifier) Verifier {
+	return &coalescingVerifier{verifier: verifier}
+}
+
+// Verify verifies token, or waits for the verification of the same token
+// already in flight and returns its result.
+func (v *coalescingVerifier) Verify(token string) (*Identity, error) {
+	key := sha256.Sum256([]byte(token))
+	verified := false
+	result, err, _ := v.group.Do(string(key[:]), func() (interface{}, error) {
+		verified = true
+		return v.verifier.Verify(token)
+	})
+	if !verified {
+		metrics.Get().CoalescedVerifications.Inc()
+	}
+	if err != nil {
+		return nil, err
+	}
+	// each waiter gets its own copy of the shared identity
+	identity := *result.(*Identity)
+	return &identity, nil
+}
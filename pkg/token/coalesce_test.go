@@ -0,0 +1,116 @@
+package token
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"sigs.k8s.io/aws-iam-authenticator/pkg/metrics"
+)
+
+// blockingVerifier blocks each verification until release is closed
+type blockingVerifier struct {
+	started chan struct{}
+	release chan struct{}
+	err     error
+
+	mutex sync.Mutex
+	calls int
+}
+
+func (v *blockingVerifier) Verify(token string) (*Identity, error) {
+	v.mutex.Lock()
+	v.calls++
+	v.mutex.Unlock()
+	v.started <- struct{}{}
+	<-v.release
+	if v.err != nil {
+		return nil, v.err
+	}
+	return &Identity{ARN: "arn:aws:iam::123456789012:user/Alice"}, nil
+}
+
+// verifyConcurrently verifies tok n times in parallel, once the first
+// verification is in flight
+func verifyConcurrently(v Verifier, backend *blockingVerifier, tok string, n int) ([]*Identity, []error) {
+	identities := make([]*Identity, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	verify := func(i int) {
+		defer wg.Done()
+		identities[i], errs[i] = v.Verify(tok)
+	}
+	wg.Add(n)
+	go verify(0)
+	<-backend.started
+	for i := 1; i < n; i++ {
+		go verify(i)
+	}
+	// give the others time to wait for the verification in flight
+	time.Sleep(100 * time.Millisecond)
+	close(backend.release)
+	wg.Wait()
+	return identities, errs
+}
+
+func TestCoalescingVerifier(t *testing.T) {
+	backend := &blockingVerifier{started: make(chan struct{}, 10), release: make(chan struct{})}
+	v := NewCoalescingVerifier(backend)
+	coalesced := testutil.ToFloat64(metrics.Get().CoalescedVerifications)
+
+	identities, errs := verifyConcurrently(v, backend, tokenSignedAt(time.Now()), 10)
+	for i := range identities {
+		if errs[i] != nil {
+			t.Fatalf("unexpected error: %v", errs[i])
+		}
+		if identities[i].ARN != "arn:aws:iam::123456789012:user/Alice" {
+			t.Errorf("unexpected identity %+v", identities[i])
+		}
+		// callers must not be able to alter the identity of the others
+		identities[i].ARN = "modified"
+	}
+	if backend.calls >= 10 {
+		t.Errorf("expected concurrent verifications to be coalesced, got %d calls to the backend verifier", backend.calls)
+	}
+	if count := testutil.ToFloat64(metrics.Get().CoalescedVerifications) - coalesced; int(count) != 10-backend.calls {
+		t.Errorf("expected %d coalesced verifications counted, got %v", 10-backend.calls, count)
+	}
+
+	// the result isn't remembered once returned
+	calls := backend.calls
+	if _, err := v.Verify(tokenSignedAt(time.Now())); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if backend.calls != calls+1 {
+		t.Errorf("expected a new call to the backend verifier, got %d calls", backend.calls-calls)
+	}
+}
+
+func TestCoalescingVerifierError(t *testing.T) {
+	backend := &blockingVerifier{started: make(chan struct{}, 5), release: make(chan struct{}), err: STSError{message: "rejected", rejected: true}}
+	v := NewCoalescingVerifier(backend)
+
+	_, errs := verifyConcurrently(v, backend, tokenSignedAt(time.Now()), 5)
+	for _, err := range errs {
+		var stsErr STSError
+		if !errors.As(err, &stsErr) {
+			t.Errorf("expected the shared STSError, got %v", err)
+		}
+	}
+}
+
+func TestCoalescingVerifierDifferentTokens(t *testing.T) {
+	backend := &countingVerifier{identity: &Identity{}}
+	v := NewCoalescingVerifier(backend)
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if _, err := v.Verify(tokenSignedAt(now.Add(-time.Duration(i) * time.Second))); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if backend.calls != 3 {
+		t.Errorf("expected 3 calls to the backend verifier, got %d", backend.calls)
+	}
+}
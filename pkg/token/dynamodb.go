@@ -0,0 +1,89 @@
+/*
+Copyright 2017-2020 by the contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package token
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// Attributes of the items of the DynamoDB replay store table. The table's
+// partition key must be the string attribute "Key", and its time to live
+// attribute "ExpiresAt" so that DynamoDB deletes expired tokens.
+const (
+	dynamoDBKeyAttribute       = "Key"
+	dynamoDBFirstUsedAttribute = "FirstUsed"
+	dynamoDBExpiresAtAttribute = "ExpiresAt"
+)
+
+// dynamoDBReplayStore is a ReplayStore shared by the replicas through a
+// DynamoDB table
+type dynamoDBReplayStore struct {
+	client dynamodbiface.DynamoDBAPI
+	table  string
+}
+
+// NewDynamoDBReplayStore returns a ReplayStore that keeps the used tokens in
+// a DynamoDB table, so that a token used on one replica is rejected by the
+// others.
+func NewDynamoDBReplayStore(client dynamodbiface.DynamoDBAPI, table string) ReplayStore {
+	return &dynamoDBReplayStore{client: client, table: table}
+}
+
+// MarkUsed puts the item of the token unless there is one that hasn't expired
+// yet, DynamoDB only deletes expired items eventually.
+func (s *dynamoDBReplayStore) MarkUsed(key string, now, expiration time.Time) (time.Time, error) {
+	_, err := s.client.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(s.table),
+		Item: map[string]*dynamodb.AttributeValue{
+			dynamoDBKeyAttribute:       {S: aws.String(key)},
+			dynamoDBFirstUsedAttribute: {N: aws.String(strconv.FormatInt(now.UnixNano(), 10))},
+			dynamoDBExpiresAtAttribute: {N: aws.String(strconv.FormatInt(expiration.Unix(), 10))},
+		},
+		ConditionExpression: aws.String("attribute_not_exists(#key) OR #expiresAt < :now"),
+		ExpressionAttributeNames: map[string]*string{
+			"#key":       aws.String(dynamoDBKeyAttribute),
+			"#expiresAt": aws.String(dynamoDBExpiresAtAttribute),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":now": {N: aws.String(strconv.FormatInt(now.Unix(), 10))},
+		},
+		ReturnValuesOnConditionCheckFailure: aws.String(dynamodb.ReturnValuesOnConditionCheckFailureAllOld),
+	})
+	if err == nil {
+		return now, nil
+	}
+	var used *dynamodb.ConditionalCheckFailedException
+	if !errors.As(err, &used) {
+		return time.Time{}, fmt.Errorf("error putting token in DynamoDB table %s: %v", s.table, err)
+	}
+	firstUsed, ok := used.Item[dynamoDBFirstUsedAttribute]
+	if !ok || firstUsed.N == nil {
+		return time.Time{}, fmt.Errorf("token in DynamoDB table %s has no %s attribute", s.table, dynamoDBFirstUsedAttribute)
+	}
+	nanos, err := strconv.ParseInt(*firstUsed.N, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("token in DynamoDB table %s has an invalid %s attribute: %v", s.table, dynamoDBFirstUsedAttribute, err)
+	}
+	return time.Unix(0, nanos), nil
+}
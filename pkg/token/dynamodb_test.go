@@ -0,0 +1,137 @@
+package token
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// fakeDynamoDB answers PutItem like a table with a single item would
+type fakeDynamoDB struct {
+	dynamodbiface.DynamoDBAPI
+	item map[string]*dynamodb.AttributeValue
+	err  error
+	// puts are the PutItem inputs received
+	puts []*dynamodb.PutItemInput
+}
+
+func (f *fakeDynamoDB) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	f.puts = append(f.puts, input)
+	if f.err != nil {
+		return nil, f.err
+	}
+	if aws.StringValue(input.ReturnValuesOnConditionCheckFailure) != dynamodb.ReturnValuesOnConditionCheckFailureAllOld {
+		return nil, errors.New("expected the old item to be returned")
+	}
+	if f.item != nil {
+		expiresAt, _ := strconv.ParseInt(aws.StringValue(f.item[dynamoDBExpiresAtAttribute].N), 10, 64)
+		now, _ := strconv.ParseInt(aws.StringValue(input.ExpressionAttributeValues[":now"].N), 10, 64)
+		if expiresAt >= now {
+			return nil, &dynamodb.ConditionalCheckFailedException{Item: f.item}
+		}
+	}
+	f.item = input.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func TestDynamoDBReplayStore(t *testing.T) {
+	client := &fakeDynamoDB{}
+	store := NewDynamoDBReplayStore(client, "tokens")
+	now := time.Unix(1700000000, 123456789)
+
+	firstUsed, err := store.MarkUsed("a", now, now.Add(time.Minute))
+	if err != nil || !firstUsed.Equal(now) {
+		t.Errorf("expected a to be used first at %v, got %v, %v", now, firstUsed, err)
+	}
+	if table := aws.StringValue(client.puts[0].TableName); table != "tokens" {
+		t.Errorf("expected the item to be put in tokens, got %s", table)
+	}
+	firstUsed, err = store.MarkUsed("a", now.Add(time.Second), now.Add(time.Minute))
+	if err != nil || !firstUsed.Equal(now) {
+		t.Errorf("expected a to be used first at %v, got %v, %v", now, firstUsed, err)
+	}
+	// expired, but not deleted by DynamoDB yet
+	later := now.Add(2 * time.Minute)
+	firstUsed, err = store.MarkUsed("a", later, later.Add(time.Minute))
+	if err != nil || !firstUsed.Equal(later) {
+		t.Errorf("expected a to be used first at %v, got %v, %v", later, firstUsed, err)
+	}
+
+	// an item without the time it was first used can't be trusted
+	client.item = map[string]*dynamodb.AttributeValue{
+		dynamoDBKeyAttribute:       {S: aws.String("a")},
+		dynamoDBExpiresAtAttribute: {N: aws.String(strconv.FormatInt(later.Add(time.Minute).Unix(), 10))},
+	}
+	if _, err := store.MarkUsed("a", later, later.Add(time.Minute)); err == nil || !strings.Contains(err.Error(), dynamoDBFirstUsedAttribute) {
+		t.Errorf("expected an error about the missing %s attribute, got %v", dynamoDBFirstUsedAttribute, err)
+	}
+}
+
+func TestDynamoDBReplayStoreExpiresAt(t *testing.T) {
+	client := &fakeDynamoDB{}
+	date := time.Unix(1700000000, 0)
+	clock := &fakeClock{now: date.Add(5 * time.Second)}
+	v := newSingleUseVerifier(&countingVerifier{identity: &Identity{}}, NewDynamoDBReplayStore(client, "tokens"), 0, clock.Now)
+	tok := signedToken(date, "aaaa")
+
+	if _, err := v.Verify(tok); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(client.puts) != 1 {
+		t.Fatalf("expected 1 PutItem, got %d", len(client.puts))
+	}
+	item := client.puts[0].Item
+	if key := aws.StringValue(item[dynamoDBKeyAttribute].S); key != replayKey(tok) {
+		t.Errorf("expected the item to be keyed by %s, got %s", replayKey(tok), key)
+	}
+	// DynamoDB deletes the item once STS stops accepting the token, 15
+	// minutes after its X-Amz-Date whatever its X-Amz-Expires
+	expiresAt := strconv.FormatInt(date.Add(presignedURLExpiration).Unix(), 10)
+	if got := aws.StringValue(item[dynamoDBExpiresAtAttribute].N); got != expiresAt {
+		t.Errorf("expected %s to be %s, got %s", dynamoDBExpiresAtAttribute, expiresAt, got)
+	}
+	firstUsed := strconv.FormatInt(clock.now.UnixNano(), 10)
+	if got := aws.StringValue(item[dynamoDBFirstUsedAttribute].N); got != firstUsed {
+		t.Errorf("expected %s to be %s, got %s", dynamoDBFirstUsedAttribute, firstUsed, got)
+	}
+}
+
+func TestDynamoDBReplayStoreReplayRejected(t *testing.T) {
+	client := &fakeDynamoDB{}
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	v := newSingleUseVerifier(&countingVerifier{identity: &Identity{}}, NewDynamoDBReplayStore(client, "tokens"), 10*time.Second, clock.Now)
+	tok := signedToken(clock.now, "aaaa")
+
+	if _, err := v.Verify(tok); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// the token is in the table, e.g. used on another replica
+	clock.now = clock.now.Add(11 * time.Second)
+	_, err := v.Verify(tok)
+	if _, ok := err.(ReplayError); !ok {
+		t.Errorf("expected a ReplayError, got %v", err)
+	}
+	if len(client.puts) != 2 {
+		t.Errorf("expected 2 PutItem, got %d", len(client.puts))
+	}
+}
+
+func TestDynamoDBReplayStoreError(t *testing.T) {
+	client := &fakeDynamoDB{err: errors.New("ProvisionedThroughputExceededException")}
+	v := NewSingleUseVerifier(&countingVerifier{identity: &Identity{}}, NewDynamoDBReplayStore(client, "tokens"), time.Minute)
+
+	// the token is denied when it can't be checked
+	_, err := v.Verify(signedToken(time.Now(), "aaaa"))
+	if err == nil || !strings.Contains(err.Error(), "ProvisionedThroughputExceededException") || !strings.Contains(err.Error(), "tokens") {
+		t.Errorf("expected the DynamoDB error, got %v", err)
+	}
+	if _, ok := err.(ReplayError); ok {
+		t.Errorf("expected an error other than a ReplayError, got %v", err)
+	}
+}
@@ -0,0 +1,159 @@
+/*
+Copyright 2017-2020 by the contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package token
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"sigs.k8s.io/aws-iam-authenticator/pkg/metrics"
+)
+
+// ReplayStore remembers the tokens that were accepted, until they expire
+type ReplayStore interface {
+	// MarkUsed records that the token with key was accepted at now, and
+	// returns when it was first accepted: now, unless it was accepted before.
+	// The token can be forgotten after expiration.
+	MarkUsed(key string, now, expiration time.Time) (time.Time, error)
+}
+
+// ReplayError is returned when a token is accepted again after the grace
+// period of single-use tokens.
+type ReplayError struct {
+	message string
+}
+
+func (e ReplayError) Error() string {
+	return "token was already used: " + e.message
+}
+
+// singleUseVerifier rejects the tokens verifier accepted before, so that a
+// token leaked after it was used can't be used again.
+type singleUseVerifier struct {
+	verifier    Verifier
+	store       ReplayStore
+	gracePeriod time.Duration
+	nowFunc     func() time.Time
+}
+
+// NewSingleUseVerifier returns a Verifier that rejects tokens verifier already
+// accepted more than gracePeriod ago, e.g. tokens sent again by a client or
+// replayed by someone else. The grace period lets the same request be retried,
+// or be sent to the authenticator by several API servers.
+//
+// verifier should be the caching verifier, if any, so that cached tokens are
+// also checked.
+func NewSingleUseVerifier(verifier Verifier, store ReplayStore, gracePeriod time.Duration) Verifier {
+	return newSingleUseVerifier(verifier, store, gracePeriod, time.Now)
+}
+
+func newSingleUseVerifier(verifier Verifier, store ReplayStore, gracePeriod time.Duration, nowFunc func() time.Time) *singleUseVerifier {
+	return &singleUseVerifier{
+		verifier:    verifier,
+		store:       store,
+		gracePeriod: gracePeriod,
+		nowFunc:     nowFunc,
+	}
+}
+
+// Verify verifies token, and then rejects it if it was accepted before. Only
+// tokens STS accepts are remembered, so that the store can't be filled with
+// made up ones.
+func (v *singleUseVerifier) Verify(token string) (*Identity, error) {
+	identity, err := v.verifier.Verify(token)
+	if err != nil {
+		return nil, err
+	}
+	// STS accepts the token until then even past its X-Amz-Expires, so it must
+	// be remembered as long
+	expiration, err := stsExpiration(token)
+	if err != nil {
+		return nil, err
+	}
+	now := v.nowFunc()
+	firstUsed, err := v.store.MarkUsed(replayKey(token), now, expiration)
+	if err != nil {
+		metrics.Get().TokenReplays.WithLabelValues(metrics.ReplayError).Inc()
+		return nil, fmt.Errorf("could not check if the token was already used: %v", err)
+	}
+	if firstUsed.Equal(now) {
+		metrics.Get().TokenReplays.WithLabelValues(metrics.ReplayFirstUse).Inc()
+		return identity, nil
+	}
+	if used := now.Sub(firstUsed); used > v.gracePeriod {
+		metrics.Get().TokenReplays.WithLabelValues(metrics.ReplayRejected).Inc()
+		return nil, ReplayError{fmt.Sprintf("first used %s ago, more than the %s grace period", used.Round(time.Second), v.gracePeriod)}
+	}
+	metrics.Get().TokenReplays.WithLabelValues(metrics.ReplayGrace).Inc()
+	return identity, nil
+}
+
+// replayKey returns the key a token is remembered by, a hash of its
+// signature
+func replayKey(token string) string {
+	signed := token
+	if queryParamsLower, err := unverifiedQueryParams(token); err == nil {
+		if signature := queryParamsLower.Get("x-amz-signature"); signature != "" {
+			signed = signature
+		}
+	}
+	sum := sha256.Sum256([]byte(signed))
+	return hex.EncodeToString(sum[:])
+}
+
+// memoryReplayStore is a ReplayStore for a single replica
+type memoryReplayStore struct {
+	mutex     sync.Mutex
+	used      map[string]usedToken
+	lastSweep time.Time
+}
+
+type usedToken struct {
+	firstUsed  time.Time
+	expiration time.Time
+}
+
+// replaySweepInterval is how often expired tokens are removed from the
+// in-memory store
+const replaySweepInterval = time.Minute
+
+// NewMemoryReplayStore returns a ReplayStore that keeps the used tokens in
+// memory. Replicas don't see the tokens used on each other.
+func NewMemoryReplayStore() ReplayStore {
+	return &memoryReplayStore{used: map[string]usedToken{}}
+}
+
+func (s *memoryReplayStore) MarkUsed(key string, now, expiration time.Time) (time.Time, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if now.Sub(s.lastSweep) >= replaySweepInterval {
+		for k, used := range s.used {
+			if now.After(used.expiration) {
+				delete(s.used, k)
+			}
+		}
+		s.lastSweep = now
+	}
+	if used, ok := s.used[key]; ok && !now.After(used.expiration) {
+		return used.firstUsed, nil
+	}
+	s.used[key] = usedToken{firstUsed: now, expiration: expiration}
+	return now, nil
+}
@@ -0,0 +1,113 @@
+package token
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signedToken returns a token whose X-Amz-Date is date and X-Amz-Signature is
+// signature
+func signedToken(date time.Time, signature string) string {
+	return toToken(fmt.Sprintf("https://sts.amazonaws.com/?action=GetCallerIdentity&x-amz-signedheaders=x-k8s-aws-id&x-amz-expires=60&x-amz-date=%s&X-Amz-Signature=%s", date.UTC().Format(dateHeaderFormat), signature))
+}
+
+func TestSingleUseVerifier(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	backend := &countingVerifier{identity: &Identity{ARN: "arn:aws:iam::123456789012:user/Alice"}}
+	cached := newCachingVerifier(backend, CacheOptions{Size: 10, TTL: 5 * time.Minute}, clock.Now)
+	v := newSingleUseVerifier(cached, NewMemoryReplayStore(), 10*time.Second, clock.Now)
+	tok := signedToken(clock.now, "aaaa")
+
+	if _, err := v.Verify(tok); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// the same request sent again, e.g. by another API server
+	clock.now = clock.now.Add(10 * time.Second)
+	if _, err := v.Verify(tok); err != nil {
+		t.Fatalf("unexpected error within the grace period: %v", err)
+	}
+	// replayed, from the cache
+	clock.now = clock.now.Add(time.Second)
+	_, err := v.Verify(tok)
+	if _, ok := err.(ReplayError); !ok {
+		t.Errorf("expected a ReplayError, got %v", err)
+	}
+	if backend.calls != 1 {
+		t.Errorf("expected 1 call to the backend verifier, got %d", backend.calls)
+	}
+
+	// another token of the same identity
+	if _, err := v.Verify(signedToken(clock.now, "bbbb")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestSingleUseVerifierPastExpires(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	backend := &countingVerifier{identity: &Identity{}}
+	v := newSingleUseVerifier(backend, NewMemoryReplayStore(), 0, clock.Now)
+	tok := signedToken(clock.now, "aaaa")
+
+	if _, err := v.Verify(tok); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// STS still accepts the token past its 60s X-Amz-Expires
+	clock.now = clock.now.Add(5 * time.Minute)
+	if _, err := v.Verify(tok); err == nil {
+		t.Errorf("expected the token to still be remembered past its X-Amz-Expires")
+	}
+}
+
+func TestSingleUseVerifierRejectedNotRemembered(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	backend := &countingVerifier{err: STSError{message: "rejected", rejected: true}}
+	v := newSingleUseVerifier(backend, NewMemoryReplayStore(), 0, clock.Now)
+	tok := signedToken(clock.now, "aaaa")
+
+	if _, err := v.Verify(tok); err == nil {
+		t.Fatalf("expected an error")
+	}
+	backend.err = nil
+	backend.identity = &Identity{}
+	if _, err := v.Verify(tok); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+type failingReplayStore struct{}
+
+func (failingReplayStore) MarkUsed(key string, now, expiration time.Time) (time.Time, error) {
+	return time.Time{}, errors.New("unavailable")
+}
+
+func TestSingleUseVerifierStoreError(t *testing.T) {
+	backend := &countingVerifier{identity: &Identity{}}
+	v := NewSingleUseVerifier(backend, failingReplayStore{}, time.Minute)
+	// the token is denied when it can't be checked
+	if _, err := v.Verify(signedToken(time.Now(), "aaaa")); err == nil || !strings.Contains(err.Error(), "unavailable") {
+		t.Errorf("expected the store error, got %v", err)
+	}
+}
+
+func TestMemoryReplayStoreExpiration(t *testing.T) {
+	store := NewMemoryReplayStore().(*memoryReplayStore)
+	now := time.Now()
+	if firstUsed, _ := store.MarkUsed("a", now, now.Add(time.Minute)); !firstUsed.Equal(now) {
+		t.Errorf("expected a to be used first at %v, got %v", now, firstUsed)
+	}
+	if firstUsed, _ := store.MarkUsed("a", now.Add(time.Second), now.Add(time.Minute)); !firstUsed.Equal(now) {
+		t.Errorf("expected a to be used first at %v, got %v", now, firstUsed)
+	}
+
+	// an expired token is forgotten, a token that expires again would be a new one
+	later := now.Add(2 * time.Minute)
+	if _, err := store.MarkUsed("b", later, later.Add(time.Minute)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := store.used["a"]; ok {
+		t.Errorf("expected the expired token to be removed")
+	}
+}
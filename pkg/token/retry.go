@@ -0,0 +1,205 @@
+/*
+Copyright 2017-2020 by the contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package token
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"sigs.k8s.io/aws-iam-authenticator/pkg/metrics"
+)
+
+// STSHealth is implemented by the Verifiers of NewVerifierWithOptions. It
+// reports the STS regions calls currently fail fast for.
+type STSHealth interface {
+	// UnavailableSTSRegions returns the STS regions whose circuit breaker is
+	// open, sorted.
+	UnavailableSTSRegions() []string
+}
+
+// retryPolicy retries the GetCallerIdentity calls that failed to connect or
+// got a 5xx
+type retryPolicy struct {
+	// retries is the maximum number of retries of a call, 0 disables them
+	retries int
+	// backoff is the maximum delay before the first retry, doubled for each
+	// following one. The actual delay is random, up to that maximum.
+	backoff time.Duration
+	// sleep is time.Sleep, replaced in tests
+	sleep func(time.Duration)
+}
+
+// delay returns the jittered delay before the given retry, starting at 1
+func (p retryPolicy) delay(retry int) time.Duration {
+	maxDelay := p.backoff << (retry - 1)
+	if maxDelay <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(maxDelay)))
+}
+
+// circuitBreakers track the consecutive failed calls to each STS region.
+// Once threshold calls in a row failed, calls to the region fail immediately
+// for cooldown, after which a single call is let through to probe it.
+type circuitBreakers struct {
+	threshold int
+	cooldown  time.Duration
+	nowFunc   func() time.Time
+
+	mutex   sync.Mutex
+	regions map[string]*circuitBreaker
+}
+
+type circuitBreaker struct {
+	failures  int
+	openUntil time.Time
+}
+
+func newCircuitBreakers(threshold int, cooldown time.Duration) *circuitBreakers {
+	return &circuitBreakers{
+		threshold: threshold,
+		cooldown:  cooldown,
+		nowFunc:   time.Now,
+		regions:   map[string]*circuitBreaker{},
+	}
+}
+
+// allow returns false if calls to region must fail immediately
+func (b *circuitBreakers) allow(region string) bool {
+	if b == nil || b.threshold <= 0 {
+		return true
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	breaker, ok := b.regions[region]
+	if !ok || breaker.failures < b.threshold {
+		return true
+	}
+	now := b.nowFunc()
+	if now.Before(breaker.openUntil) {
+		return false
+	}
+	// let this call probe the region, and keep the others out until it returns
+	breaker.openUntil = now.Add(b.cooldown)
+	return true
+}
+
+// record records the outcome of a call to region
+func (b *circuitBreakers) record(region string, failed bool) {
+	if b == nil || b.threshold <= 0 {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	breaker, ok := b.regions[region]
+	if !failed {
+		if ok && breaker.failures >= b.threshold {
+			logrus.WithField("region", region).Info("STS region is available again, closing its circuit breaker")
+			metrics.Get().StsCircuitOpen.WithLabelValues(region).Set(0)
+		}
+		delete(b.regions, region)
+		return
+	}
+	if !ok {
+		breaker = &circuitBreaker{}
+		b.regions[region] = breaker
+	}
+	breaker.failures++
+	if breaker.failures < b.threshold {
+		return
+	}
+	if breaker.failures == b.threshold {
+		logrus.WithFields(logrus.Fields{
+			"region":   region,
+			"failures": breaker.failures,
+			"cooldown": b.cooldown,
+		}).Warn("STS region is unavailable, opening its circuit breaker")
+		metrics.Get().StsCircuitOpen.WithLabelValues(region).Set(1)
+	}
+	breaker.openUntil = b.nowFunc().Add(b.cooldown)
+}
+
+// open returns the regions whose circuit breaker is open, sorted
+func (b *circuitBreakers) open() []string {
+	if b == nil || b.threshold <= 0 {
+		return nil
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	now := b.nowFunc()
+	var regions []string
+	for region, breaker := range b.regions {
+		if breaker.failures >= b.threshold && now.Before(breaker.openUntil) {
+			regions = append(regions, region)
+		}
+	}
+	sort.Strings(regions)
+	return regions
+}
+
+// UnavailableSTSRegions returns the STS regions whose circuit breaker is open
+func (v tokenVerifier) UnavailableSTSRegions() []string {
+	return v.breakers.open()
+}
+
+// callSTS calls getCallerIdentity, retrying transient failures with jittered
+// backoff as long as the retry can start before the deadline of ctx. The call
+// counts once against the circuit breaker of the region, however many
+// attempts it took.
+func (v tokenVerifier) callSTS(ctx context.Context, parsedURL *url.URL, stsRegion, clusterID string) ([]byte, error) {
+	sleep := v.retry.sleep
+	if sleep == nil {
+		sleep = time.Sleep
+	}
+	var responseBody []byte
+	var err error
+	transient := false
+	for retry := 0; ; retry++ {
+		if !v.breakers.allow(stsRegion) {
+			if retry == 0 {
+				stsErr := NewSTSError(fmt.Sprintf("circuit breaker is open for %s endpoint after repeated failures", stsRegion))
+				stsErr.transient = true
+				return nil, stsErr
+			}
+			// opened by other calls since the first attempt
+			break
+		}
+		responseBody, err = v.getCallerIdentity(ctx, parsedURL, stsRegion, clusterID)
+		stsErr, ok := err.(STSError)
+		transient = ok && stsErr.transient
+		if !transient || retry >= v.retry.retries {
+			break
+		}
+		delay := v.retry.delay(retry + 1)
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(delay).After(deadline) {
+			break
+		}
+		metrics.Get().StsRetries.WithLabelValues(stsRegion).Inc()
+		sleep(delay)
+	}
+	v.breakers.record(stsRegion, transient)
+	if err != nil {
+		return nil, err
+	}
+	return responseBody, nil
+}
@@ -0,0 +1,210 @@
+package token
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"sigs.k8s.io/aws-iam-authenticator/pkg/metrics"
+)
+
+// sequenceRoundTripper answers with one status code per call, 0 is a
+// connection error
+type sequenceRoundTripper struct {
+	statusCodes []int
+	calls       int
+}
+
+func (rt *sequenceRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	statusCode := rt.statusCodes[rt.calls]
+	rt.calls++
+	switch statusCode {
+	case 0:
+		return nil, errors.New("connection reset")
+	case http.StatusOK:
+		body := jsonResponse("arn:aws:iam::123456789012:user/Alice", "123456789012", "Alice")
+		return &http.Response{StatusCode: statusCode, Body: io.NopCloser(strings.NewReader(body))}, nil
+	default:
+		return &http.Response{StatusCode: statusCode, Body: io.NopCloser(strings.NewReader("error"))}, nil
+	}
+}
+
+func TestVerifyRetries(t *testing.T) {
+	cases := []struct {
+		name          string
+		statusCodes   []int
+		token         string
+		expectedCalls int
+		expectErr     string
+	}{
+		{name: "success", statusCodes: []int{200}, token: validToken, expectedCalls: 1},
+		{name: "retried", statusCodes: []int{503, 0, 200}, token: validToken, expectedCalls: 3},
+		{name: "exhausted", statusCodes: []int{500, 0, 502}, token: validToken, expectedCalls: 3, expectErr: "expected 200, got 502"},
+		{name: "rejected", statusCodes: []int{403}, token: validToken, expectedCalls: 1, expectErr: "expected 200, got 403"},
+		{
+			name:          "expiring",
+			statusCodes:   []int{503},
+			token:         toToken(fmt.Sprintf("https://sts.amazonaws.com/?action=GetCallerIdentity&x-amz-signedheaders=x-k8s-aws-id&x-amz-expires=60&x-amz-date=%s", time.Now().Add(-presignedURLExpiration+time.Minute).UTC().Format(dateHeaderFormat))),
+			expectedCalls: 1,
+			expectErr:     "expected 200, got 503",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			rt := &sequenceRoundTripper{statusCodes: c.statusCodes}
+			verifier := mustNewVerifier(t, VerifierOptions{
+				PartitionIDs:    []string{"aws"},
+				STSRetries:      2,
+				STSRetryBackoff: 100 * time.Millisecond,
+			})
+			if c.name == "expiring" {
+				// any delay but a negligible few would be past the expiration
+				verifier.retry.backoff = 1000 * time.Hour
+			}
+			verifier.client = &http.Client{Transport: rt}
+			var delays []time.Duration
+			verifier.retry.sleep = func(d time.Duration) { delays = append(delays, d) }
+			retries := testutil.ToFloat64(metrics.Get().StsRetries.WithLabelValues("global"))
+
+			_, err := verifier.Verify(c.token)
+			if c.expectErr != "" {
+				errorContains(t, err, c.expectErr)
+			} else if err != nil {
+				t.Fatalf("received unexpected error: %s", err)
+			}
+			if rt.calls != c.expectedCalls {
+				t.Errorf("Expected %d calls to STS, got %d", c.expectedCalls, rt.calls)
+			}
+			if len(delays) != c.expectedCalls-1 {
+				t.Errorf("Expected %d retries, got %d", c.expectedCalls-1, len(delays))
+			}
+			for i, delay := range delays {
+				if maxDelay := 100 * time.Millisecond << i; delay < 0 || delay >= maxDelay {
+					t.Errorf("Expected retry %d after less than %s, was %s", i+1, maxDelay, delay)
+				}
+			}
+			if count := testutil.ToFloat64(metrics.Get().StsRetries.WithLabelValues("global")) - retries; int(count) != len(delays) {
+				t.Errorf("Expected %d retries counted, got %v", len(delays), count)
+			}
+		})
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Now()
+	rt := &sequenceRoundTripper{statusCodes: []int{0, 403, 500, 0, 200, 200}}
+	verifier := mustNewVerifier(t, VerifierOptions{
+		PartitionIDs:               []string{"aws"},
+		STSCircuitBreakerThreshold: 2,
+		STSCircuitBreakerCooldown:  time.Minute,
+	})
+	verifier.client = &http.Client{Transport: rt}
+	verifier.breakers.nowFunc = func() time.Time { return now }
+
+	verify := func(expectedCalls int, expectErr string) {
+		t.Helper()
+		_, err := verifier.Verify(validToken)
+		if expectErr != "" {
+			errorContains(t, err, expectErr)
+			assertSTSError(t, err)
+		} else if err != nil {
+			t.Fatalf("received unexpected error: %s", err)
+		}
+		if rt.calls != expectedCalls {
+			t.Errorf("Expected %d calls to STS, got %d", expectedCalls, rt.calls)
+		}
+	}
+	expectOpen := func(expected []string) {
+		t.Helper()
+		if diff := cmp.Diff(expected, verifier.UnavailableSTSRegions()); diff != "" {
+			t.Errorf("Unexpected unavailable regions (-want +got):\n%s", diff)
+		}
+	}
+
+	verify(1, "connection reset")
+	// STS answering, even to refuse the token, resets the count
+	verify(2, "got 403")
+	expectOpen(nil)
+
+	verify(3, "got 500")
+	verify(4, "connection reset")
+	expectOpen([]string{"global"})
+	if open := testutil.ToFloat64(metrics.Get().StsCircuitOpen.WithLabelValues("global")); open != 1 {
+		t.Errorf("Expected the circuit breaker gauge to be 1, was %v", open)
+	}
+	verify(4, "circuit breaker is open for global endpoint")
+
+	// a single call probes the region once the cooldown is over
+	now = now.Add(time.Minute)
+	expectOpen(nil)
+	verify(5, "")
+	expectOpen(nil)
+	verify(6, "")
+	if open := testutil.ToFloat64(metrics.Get().StsCircuitOpen.WithLabelValues("global")); open != 0 {
+		t.Errorf("Expected the circuit breaker gauge to be 0, was %v", open)
+	}
+}
+
+// hangingRoundTripper answers once the request is cancelled
+type hangingRoundTripper struct {
+	calls int
+}
+
+func (rt *hangingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.calls++
+	<-req.Context().Done()
+	return nil, req.Context().Err()
+}
+
+func TestVerifySTSTimeout(t *testing.T) {
+	rt := &hangingRoundTripper{}
+	verifier := mustNewVerifier(t, VerifierOptions{
+		PartitionIDs:               []string{"aws"},
+		STSRetries:                 2,
+		STSRetryBackoff:            10 * time.Millisecond,
+		STSCircuitBreakerThreshold: 10,
+		STSTimeout:                 50 * time.Millisecond,
+	})
+	verifier.client = &http.Client{Transport: rt}
+
+	start := time.Now()
+	_, err := verifier.Verify(validToken)
+	errorContains(t, err, "context deadline exceeded")
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected Verify to give up after the STS timeout, took %s", elapsed)
+	}
+	if rt.calls != 1 {
+		t.Errorf("Expected no retry past the STS timeout, got %d calls", rt.calls)
+	}
+}
+
+func TestCircuitBreakerCountsCalls(t *testing.T) {
+	rt := &sequenceRoundTripper{statusCodes: []int{503, 0, 502}}
+	verifier := mustNewVerifier(t, VerifierOptions{
+		PartitionIDs:               []string{"aws"},
+		STSRetries:                 2,
+		STSCircuitBreakerThreshold: 2,
+		STSCircuitBreakerCooldown:  time.Minute,
+	})
+	verifier.client = &http.Client{Transport: rt}
+	verifier.retry.sleep = func(time.Duration) {}
+
+	_, err := verifier.Verify(validToken)
+	errorContains(t, err, "expected 200, got 502")
+	if rt.calls != 3 {
+		t.Errorf("Expected 3 calls to STS, got %d", rt.calls)
+	}
+	// the three attempts of the call count as a single failure
+	if regions := verifier.UnavailableSTSRegions(); len(regions) != 0 {
+		t.Errorf("Expected the circuit breaker to stay closed, got %v open", regions)
+	}
+	if failures := verifier.breakers.regions["global"].failures; failures != 1 {
+		t.Errorf("Expected 1 failure recorded, got %d", failures)
+	}
+}
@@ -0,0 +1,102 @@
+/*
+Copyright 2017-2020 by the contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package token
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+// validateSTSHostPattern returns an error if pattern is not a valid hostname
+// pattern, or has a wildcard in its last two labels: "*.com" would accept
+// hosts anyone can answer for.
+func validateSTSHostPattern(pattern string) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("STS host pattern %q is not valid: %v", pattern, err)
+	}
+	labels := strings.Split(pattern, ".")
+	if len(labels) < 3 {
+		return fmt.Errorf("STS host pattern %q must have at least 3 labels", pattern)
+	}
+	if strings.ContainsAny(strings.Join(labels[len(labels)-2:], "."), "*?[") {
+		return fmt.Errorf("STS host pattern %q must not have wildcards in its domain", pattern)
+	}
+	return nil
+}
+
+// validateSTSHostRewrite returns an error if endpoint is not a hostname,
+// optionally with a port, that the requests for host can be sent to
+func validateSTSHostRewrite(host, endpoint string) error {
+	parsed, err := url.Parse("https://" + endpoint)
+	if host == "" || err != nil || parsed.Host != endpoint || parsed.Hostname() == "" {
+		return fmt.Errorf("STS host rewrite %q=%q is not valid, expected a hostname and an endpoint hostname", host, endpoint)
+	}
+	return nil
+}
+
+// matchesSTSHostPattern returns true if host matches one of patterns
+func matchesSTSHostPattern(patterns []string, host string) bool {
+	host = strings.ToLower(host)
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(strings.ToLower(pattern), host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// stsTransport returns the transport STS is called with, or nil to use the
+// default one when neither a CA bundle nor a proxy is configured.
+func stsTransport(caBundle, proxyURL string) (http.RoundTripper, error) {
+	if caBundle == "" && proxyURL == "" {
+		return nil, nil
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if caBundle != "" {
+		pem, err := os.ReadFile(caBundle)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read STS CA bundle: %v", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("STS CA bundle %s has no PEM certificates", caBundle)
+		}
+		transport.TLSClientConfig = &tls.Config{
+			RootCAs:    pool,
+			MinVersion: tls.VersionTLS12,
+		}
+	}
+
+	if proxyURL != "" {
+		parsed, err := url.Parse(proxyURL)
+		if err != nil || parsed.Host == "" {
+			return nil, fmt.Errorf("STS proxy URL %q is not valid", proxyURL)
+		}
+		transport.Proxy = http.ProxyURL(parsed)
+	}
+	return transport, nil
+}
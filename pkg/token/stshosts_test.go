@@ -0,0 +1,142 @@
+package token
+
+import (
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSTSHostPatterns(t *testing.T) {
+	verifier := mustNewVerifier(t, VerifierOptions{
+		PartitionIDs: []string{"aws"},
+		STSHostPatterns: []string{
+			"*.sts.us-east-1.vpce.amazonaws.com",
+			"sts-fips.*.amazonaws.com",
+			"sts.*.api.aws",
+		},
+	})
+	cases := []struct {
+		host  string
+		valid bool
+	}{
+		{"sts.us-west-2.amazonaws.com", true},
+		{"vpce-0123-abcd.sts.us-east-1.vpce.amazonaws.com", true},
+		{"VPCE-0123-ABCD.sts.us-east-1.vpce.amazonaws.com", true},
+		{"sts-fips.us-east-2.amazonaws.com", true},
+		{"sts.us-east-2.api.aws", true},
+		{"vpce-0123-abcd.sts.us-west-2.vpce.amazonaws.com", false},
+		{"sts.us-east-2.api.aws.example.com", false},
+		{"sts-fips.us-east-2.amazonaws.com.example.com", false},
+		{"example.com", false},
+	}
+	for _, c := range cases {
+		err := verifier.verifyHost(c.host)
+		if err != nil && c.valid {
+			t.Errorf("%s is unexpectedly not a valid STS host: %v", c.host, err)
+		} else if err == nil && !c.valid {
+			t.Errorf("%s is unexpectedly a valid STS host", c.host)
+		}
+	}
+}
+
+func TestInvalidSTSOptions(t *testing.T) {
+	cases := []struct {
+		name    string
+		options VerifierOptions
+	}{
+		{name: "syntax", options: VerifierOptions{STSHostPatterns: []string{"sts.[us-east-1.amazonaws.com"}}},
+		{name: "wildcard domain", options: VerifierOptions{STSHostPatterns: []string{"sts.us-east-1.*.com"}}},
+		{name: "wildcard tld", options: VerifierOptions{STSHostPatterns: []string{"sts.amazonaws.*"}}},
+		{name: "too short", options: VerifierOptions{STSHostPatterns: []string{"*.aws"}}},
+		{name: "rewrite url", options: VerifierOptions{STSHostRewrites: map[string]string{"sts.amazonaws.com": "https://sts.example.com/"}}},
+		{name: "rewrite empty", options: VerifierOptions{STSHostRewrites: map[string]string{"sts.amazonaws.com": ""}}},
+		{name: "missing ca bundle", options: VerifierOptions{STSCABundle: filepath.Join(t.TempDir(), "missing.pem")}},
+		{name: "proxy", options: VerifierOptions{STSProxyURL: "proxy:3128"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if _, err := NewVerifierWithOptions(c.options); err == nil {
+				t.Errorf("Expected an error")
+			}
+		})
+	}
+}
+
+// hostRoundTripper records the endpoint and Host header STS is called with
+type hostRoundTripper struct {
+	urlHost string
+	host    string
+}
+
+func (rt *hostRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.urlHost = req.URL.Host
+	rt.host = req.Host
+	body := jsonResponse("arn:aws:iam::123456789012:user/Alice", "123456789012", "Alice")
+	return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(body))}, nil
+}
+
+func TestSTSHostRewrites(t *testing.T) {
+	rt := &hostRoundTripper{}
+	verifier := mustNewVerifier(t, VerifierOptions{
+		PartitionIDs: []string{"aws"},
+		STSHostRewrites: map[string]string{
+			"sts.amazonaws.com": "vpce-0123-abcd.sts.us-east-1.vpce.amazonaws.com",
+		},
+	})
+	verifier.client = &http.Client{Transport: rt}
+
+	if _, err := verifier.Verify(validToken); err != nil {
+		t.Fatalf("received unexpected error: %s", err)
+	}
+	if rt.urlHost != "vpce-0123-abcd.sts.us-east-1.vpce.amazonaws.com" {
+		t.Errorf("Expected STS to be called on the VPC endpoint, was called on %q", rt.urlHost)
+	}
+	if rt.host != "sts.amazonaws.com" {
+		t.Errorf("Expected the signed Host header to be kept, was %q", rt.host)
+	}
+}
+
+func TestSTSTransport(t *testing.T) {
+	if transport, err := stsTransport("", ""); err != nil || transport != nil {
+		t.Errorf("Expected the default transport, got %v, %v", transport, err)
+	}
+
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+	caBundle := filepath.Join(t.TempDir(), "ca.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	if err := os.WriteFile(caBundle, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	transport, err := stsTransport(caBundle, "http://proxy.example.com:3128")
+	if err != nil {
+		t.Fatalf("received unexpected error: %s", err)
+	}
+	proxy, err := transport.(*http.Transport).Proxy(httptest.NewRequest("GET", "https://sts.amazonaws.com/", nil))
+	if err != nil || proxy.String() != "http://proxy.example.com:3128" {
+		t.Errorf("Expected STS to be called through the proxy, got %v, %v", proxy, err)
+	}
+
+	transport, err = stsTransport(caBundle, "")
+	if err != nil {
+		t.Fatalf("received unexpected error: %s", err)
+	}
+	resp, err := (&http.Client{Transport: transport}).Get(ts.URL)
+	if err != nil {
+		t.Fatalf("Expected the CA bundle to be trusted: %v", err)
+	}
+	resp.Body.Close()
+
+	if err := os.WriteFile(caBundle, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stsTransport(caBundle, ""); err == nil {
+		t.Errorf("Expected an error for a CA bundle without certificates")
+	}
+}
@@ -17,6 +17,7 @@ limitations under the License.
 package token
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -24,6 +25,7 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -81,6 +83,10 @@ type Identity struct {
 
 	// ASW STS endpoint used to authenticate (expected values is sts endpoint eg: sts.us-west-2.amazonaws.com)
 	STSEndpoint string
+
+	// ClusterID is the cluster ID the token was signed for, one of those the
+	// Verifier accepts.
+	ClusterID string
 }
 
 const (
@@ -132,12 +138,42 @@ func (e FormatError) Error() string {
 // processing the data returned from STS.
 type STSError struct {
 	message string
+	// rejected is true when STS answered and refused the token, as opposed
+	// to a transient failure talking to STS.
+	rejected bool
+	// signatureMismatch is true when STS refused the signature, e.g. because
+	// the token was signed for another cluster ID
+	signatureMismatch bool
+	// transient is true when STS couldn't be reached or answered with a 5xx,
+	// the call can be retried
+	transient bool
 }
 
 func (e STSError) Error() string {
 	return "sts getCallerIdentity failed: " + e.message
 }
 
+// Reasons STS failed to verify a token, see STSError.Reason
+const (
+	STSReasonRejected    = "rejected"
+	STSReasonUnavailable = "unavailable"
+	STSReasonError       = "error"
+)
+
+// Reason returns why STS failed to verify the token, one of the STSReason
+// constants. Unlike the message it can't contain anything from the token or
+// from STS's response.
+func (e STSError) Reason() string {
+	switch {
+	case e.rejected:
+		return STSReasonRejected
+	case e.transient:
+		return STSReasonUnavailable
+	default:
+		return STSReasonError
+	}
+}
+
 // NewSTSError creates a error of type STS.
 func NewSTSError(m string) STSError {
 	return STSError{message: m}
@@ -373,9 +409,16 @@ type Verifier interface {
 }
 
 type tokenVerifier struct {
-	client            *http.Client
-	clusterID         string
+	client *http.Client
+	// clusterIDs are tried in order, the token only names the signed header
+	clusterIDs        []string
 	validSTShostnames map[string]bool
+	stsHostPatterns   []string
+	stsHostRewrites   map[string]string
+	retry             retryPolicy
+	breakers          *circuitBreakers
+	// stsTimeout bounds the time spent calling STS to verify a token
+	stsTimeout time.Duration
 }
 
 func getDefaultHostNameForRegion(partition *endpoints.Partition, region, service string) (string, error) {
@@ -390,6 +433,28 @@ func getDefaultHostNameForRegion(partition *endpoints.Partition, region, service
 	return parsedURL.Hostname(), nil
 }
 
+// stsHostsForPartitions returns the STS hostnames of each of partitionIDs. The
+// hostname of region is only added for the partition region belongs to, so
+// that no hostname is made up for the other partitions.
+func stsHostsForPartitions(partitionIDs []string, region string) map[string]bool {
+	if len(partitionIDs) == 1 {
+		return stsHostsForPartition(partitionIDs[0], region)
+	}
+
+	validSTShostnames := map[string]bool{}
+	regionPartition, _ := endpoints.PartitionForRegion(endpoints.DefaultPartitions(), region)
+	for _, partitionID := range partitionIDs {
+		partitionRegion := region
+		if partitionID != regionPartition.ID() {
+			partitionRegion = ""
+		}
+		for host := range stsHostsForPartition(partitionID, partitionRegion) {
+			validSTShostnames[host] = true
+		}
+	}
+	return validSTShostnames
+}
+
 func stsHostsForPartition(partitionID, region string) map[string]bool {
 	validSTShostnames := map[string]bool{}
 
@@ -434,8 +499,8 @@ func stsHostsForPartition(partitionID, region string) map[string]bool {
 	}
 
 	// Add the host of the current instances region if not already exists so we don't fail if the region is not
-	// present in the go sdk but matches the instances region.
-	if _, ok := stsSvcEndPoints[region]; !ok {
+	// present in the go sdk but matches the instances region. There is none for the partitions the instance isn't in.
+	if _, ok := stsSvcEndPoints[region]; !ok && region != "" {
 		stsHostName, err := getDefaultHostNameForRegion(partition, region, stsServiceID)
 		if err != nil {
 			logrus.WithError(err).Error("Error getting default hostname")
@@ -449,30 +514,134 @@ func stsHostsForPartition(partitionID, region string) map[string]bool {
 
 // NewVerifier creates a Verifier that is bound to the clusterID and uses the default http client.
 func NewVerifier(clusterID, partitionID, region string) Verifier {
+	// only the STS options can make NewVerifierWithOptions fail
+	verifier, _ := NewVerifierWithOptions(VerifierOptions{
+		ClusterIDs:   []string{clusterID},
+		PartitionIDs: []string{partitionID},
+		Region:       region,
+	})
+	return verifier
+}
+
+// VerifierOptions is passed to NewVerifierWithOptions to configure the Verifier
+type VerifierOptions struct {
+	// ClusterIDs are the cluster IDs tokens are accepted for, e.g. both the
+	// old and the new ID while clients move from one to the other. The token
+	// doesn't say which ID it was signed for, so STS is asked with each of them
+	// in turn until the signature matches: put the ID most clients use first.
+	// There can be at most MaxClusterIDs.
+	ClusterIDs []string
+	// PartitionIDs are the AWS partitions whose STS endpoints tokens are
+	// accepted for (e.g., "aws" and "aws-us-gov").
+	PartitionIDs []string
+	// Region is the region the server runs in. Its STS endpoint is accepted
+	// even if the SDK doesn't know it yet.
+	Region string
+	// STSHostPatterns are hostnames accepted in addition to the STS endpoints
+	// of the partitions, e.g. interface VPC endpoints. They can contain *
+	// wildcards, except in their last two labels (e.g.,
+	// "*.sts.us-east-1.vpce.amazonaws.com" or "sts.*.api.aws").
+	STSHostPatterns []string
+	// STSHostRewrites sends the GetCallerIdentity requests of tokens signed
+	// for a host (e.g., "sts.us-east-1.amazonaws.com") to another endpoint
+	// (e.g., a VPC endpoint). The signed Host header is kept.
+	STSHostRewrites map[string]string
+	// STSCABundle is a PEM file of CAs trusted in addition to the system ones
+	// when calling STS.
+	STSCABundle string
+	// STSProxyURL is the proxy STS is called through. Empty uses the
+	// HTTPS_PROXY and NO_PROXY environment variables.
+	STSProxyURL string
+	// STSRetries is the number of times a GetCallerIdentity call that failed
+	// to connect, or got a 5xx, is retried. Retries stop when STSTimeout
+	// passes or the token expires.
+	STSRetries int
+	// STSRetryBackoff is the maximum delay before the first retry, doubled
+	// for each following one. The actual delays are random up to that maximum.
+	STSRetryBackoff time.Duration
+	// STSCircuitBreakerThreshold is the number of failed calls in a row to an
+	// STS region after which calls to it fail immediately, for
+	// STSCircuitBreakerCooldown. 0 disables the circuit breakers.
+	STSCircuitBreakerThreshold int
+	// STSCircuitBreakerCooldown is how long calls to a region fail immediately
+	// before a single call is let through to probe it.
+	STSCircuitBreakerCooldown time.Duration
+	// STSTimeout bounds the time spent calling STS to verify a token, retries
+	// included, so that the API server gets an answer before its webhook
+	// times out. 0 uses DefaultSTSTimeout.
+	STSTimeout time.Duration
+}
+
+// MaxClusterIDs is the maximum number of cluster IDs a Verifier accepts
+// tokens for. Each ID after the first costs an extra STS call for the tokens
+// signed for it.
+const MaxClusterIDs = 3
+
+// DefaultSTSTimeout is the default time spent calling STS to verify a token,
+// well under the timeout of the API server's authentication webhook calls
+const DefaultSTSTimeout = 10 * time.Second
+
+// NewVerifierWithOptions creates a Verifier that uses the default http client,
+// unless a CA bundle or a proxy is configured.
+func NewVerifierWithOptions(options VerifierOptions) (Verifier, error) {
 	// Initialize metrics if they haven't already been initialized to avoid a
 	// nil pointer panic when setting metric values.
 	if !metrics.Initialized() {
 		metrics.InitMetrics(prometheus.NewRegistry())
 	}
 
+	if len(options.ClusterIDs) > MaxClusterIDs {
+		return nil, fmt.Errorf("%d cluster IDs configured, at most %d are accepted", len(options.ClusterIDs), MaxClusterIDs)
+	}
+	for _, pattern := range options.STSHostPatterns {
+		if err := validateSTSHostPattern(pattern); err != nil {
+			return nil, err
+		}
+	}
+	for host, endpoint := range options.STSHostRewrites {
+		if err := validateSTSHostRewrite(host, endpoint); err != nil {
+			return nil, err
+		}
+	}
+	transport, err := stsTransport(options.STSCABundle, options.STSProxyURL)
+	if err != nil {
+		return nil, err
+	}
+	stsTimeout := options.STSTimeout
+	if stsTimeout <= 0 {
+		stsTimeout = DefaultSTSTimeout
+	}
+
 	return tokenVerifier{
 		client: &http.Client{
+			Transport: transport,
 			CheckRedirect: func(req *http.Request, via []*http.Request) error {
 				return http.ErrUseLastResponse
 			},
 			Timeout: 10 * time.Second,
 		},
-		clusterID:         clusterID,
-		validSTShostnames: stsHostsForPartition(partitionID, region),
-	}
+		clusterIDs:        options.ClusterIDs,
+		validSTShostnames: stsHostsForPartitions(options.PartitionIDs, options.Region),
+		stsHostPatterns:   options.STSHostPatterns,
+		stsHostRewrites:   options.STSHostRewrites,
+		retry: retryPolicy{
+			retries: options.STSRetries,
+			backoff: options.STSRetryBackoff,
+		},
+		breakers:   newCircuitBreakers(options.STSCircuitBreakerThreshold, options.STSCircuitBreakerCooldown),
+		stsTimeout: stsTimeout,
+	}, nil
 }
 
 // verify a sts host, doc: http://docs.amazonaws.cn/en_us/general/latest/gr/rande.html#sts_region
 func (v tokenVerifier) verifyHost(host string) error {
-	if _, ok := v.validSTShostnames[host]; !ok {
-		return FormatError{fmt.Sprintf("unexpected hostname %q in pre-signed URL", host)}
+	if _, ok := v.validSTShostnames[host]; ok {
+		return nil
 	}
-	return nil
+	if matchesSTSHostPattern(v.stsHostPatterns, host) {
+		return nil
+	}
+	return FormatError{fmt.Sprintf("unexpected hostname %q in pre-signed URL", host)}
 }
 
 // Verify a token is valid for the specified clusterID. On success, returns an
@@ -569,49 +738,224 @@ func (v tokenVerifier) Verify(token string) (*Identity, error) {
 		return nil, FormatError{fmt.Sprintf("X-Amz-Date parameter is expired (%.f minute expiration) %s", presignedURLExpiration.Minutes(), dateParam)}
 	}
 
-	req, err := http.NewRequest("GET", parsedURL.String(), nil)
-	req.Header.Set(clusterIDHeader, v.clusterID)
+	// STS isn't called past the expiration of the token either
+	deadline := expiration
+	if v.stsTimeout > 0 && now.Add(v.stsTimeout).Before(deadline) {
+		deadline = now.Add(v.stsTimeout)
+	}
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	clusterIDs := v.clusterIDs
+	if len(clusterIDs) == 0 {
+		clusterIDs = []string{""}
+	}
+	var responseBody []byte
+	var clusterID string
+	for i, id := range clusterIDs {
+		responseBody, err = v.callSTS(ctx, parsedURL, stsRegion, id)
+		if stsErr, ok := err.(STSError); ok && stsErr.signatureMismatch && i < len(clusterIDs)-1 {
+			// the token may have been signed for the next cluster ID
+			metrics.Get().ClusterIDMismatches.WithLabelValues(id).Inc()
+			logrus.WithFields(logrus.Fields{
+				"clusterID":     id,
+				"nextClusterID": clusterIDs[i+1],
+			}).Debug("token not signed for cluster ID, calling STS again with the next one")
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		clusterID = id
+		break
+	}
+	metrics.Get().ClusterIDTokens.WithLabelValues(clusterID).Inc()
+
+	var callerIdentity getCallerIdentityWrapper
+	err = json.Unmarshal(responseBody, &callerIdentity)
+	if err != nil {
+		return nil, NewSTSError(err.Error())
+	}
+
+	id := &Identity{
+		AccessKeyID: accessKeyID,
+		STSEndpoint: parsedURL.Host,
+		ClusterID:   clusterID,
+	}
+	return getIdentityFromSTSResponse(id, callerIdentity)
+}
+
+// getCallerIdentity calls the pre-signed GetCallerIdentity URL of a token with
+// clusterID as the signed cluster ID header, and returns the body of the
+// response.
+func (v tokenVerifier) getCallerIdentity(ctx context.Context, parsedURL *url.URL, stsRegion, clusterID string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", parsedURL.String(), nil)
+	if err != nil {
+		return nil, NewSTSError(err.Error())
+	}
+	if endpoint, ok := v.stsHostRewrites[parsedURL.Host]; ok {
+		// the Host header is signed, only the endpoint called changes
+		req.URL.Host = endpoint
+		req.Host = parsedURL.Host
+	}
+	req.Header.Set(clusterIDHeader, clusterID)
 	req.Header.Set("accept", "application/json")
 
+	start := time.Now()
 	response, err := v.client.Do(req)
+	metrics.Get().StsLatency.WithLabelValues(stsRegion).Observe(time.Since(start).Seconds())
 	if err != nil {
 		metrics.Get().StsConnectionFailure.WithLabelValues(stsRegion).Inc()
 		// special case to avoid printing the full URL if possible
 		if urlErr, ok := err.(*url.Error); ok {
-			return nil, NewSTSError(fmt.Sprintf("error during GET: %v on %s endpoint", urlErr.Err, stsRegion))
+			err = urlErr.Err
 		}
-		return nil, NewSTSError(fmt.Sprintf("error during GET: %v on %s endpoint", err, stsRegion))
+		stsErr := NewSTSError(fmt.Sprintf("error during GET: %v on %s endpoint", err, stsRegion))
+		stsErr.transient = true
+		return nil, stsErr
 	}
 	defer response.Body.Close()
 
 	responseBody, err := io.ReadAll(response.Body)
 	if err != nil {
-		return nil, NewSTSError(fmt.Sprintf("error reading HTTP result: %v", err))
+		stsErr := NewSTSError(fmt.Sprintf("error reading HTTP result: %v", err))
+		stsErr.transient = true
+		return nil, stsErr
 	}
 
 	metrics.Get().StsResponses.WithLabelValues(fmt.Sprint(response.StatusCode), stsRegion).Inc()
 	if response.StatusCode != 200 {
 		responseStr := string(responseBody[:])
+		// the body can echo parts of the request, so it is only logged at debug
+		// level and the error only has the AWS error code
+		logrus.WithFields(logrus.Fields{
+			"statusCode": response.StatusCode,
+			"region":     stsRegion,
+			"body":       responseStr,
+		}).Debug("sts getCallerIdentity failed")
 		// refer to https://docs.aws.amazon.com/STS/latest/APIReference/CommonErrors.html and log
 		// response body for STS Throttling is {"Error":{"Code":"Throttling","Message":"Rate exceeded","Type":"Sender"},"RequestId":"xxx"}
 		if strings.Contains(responseStr, "Throttling") {
 			metrics.Get().StsThrottling.WithLabelValues(stsRegion).Inc()
-			return nil, NewSTSThrottling(responseStr)
+			return nil, NewSTSThrottling(fmt.Sprintf("got %d on %s endpoint", response.StatusCode, stsRegion))
 		}
-		return nil, NewSTSError(fmt.Sprintf("error from AWS (expected 200, got %d) on %s endpoint. Body: %s", response.StatusCode, stsRegion, responseStr))
+		stsErr := NewSTSError(fmt.Sprintf("error from AWS (expected 200, got %d%s) on %s endpoint", response.StatusCode, stsErrorCode(responseStr), stsRegion))
+		stsErr.rejected = response.StatusCode >= 400 && response.StatusCode < 500
+		stsErr.signatureMismatch = response.StatusCode == http.StatusForbidden && strings.Contains(responseStr, "SignatureDoesNotMatch")
+		stsErr.transient = response.StatusCode >= 500
+		return nil, stsErr
 	}
+	return responseBody, nil
+}
 
-	var callerIdentity getCallerIdentityWrapper
-	err = json.Unmarshal(responseBody, &callerIdentity)
+// stsErrorCodePattern matches the error code of an STS response, in JSON or
+// XML
+var stsErrorCodePattern = regexp.MustCompile(`"Code"\s*:\s*"([A-Za-z.]{1,64})"|<Code>([A-Za-z.]{1,64})</Code>`)
+
+// stsErrorCode returns ", " and the error code of an STS response body, or ""
+// if it has none
+func stsErrorCode(body string) string {
+	match := stsErrorCodePattern.FindStringSubmatch(body)
+	if match == nil {
+		return ""
+	}
+	return ", " + match[1] + match[2]
+}
+
+// AccessKeyID returns the AWS Access Key ID a token claims to have been signed
+// with. The token is NOT verified, so the result must only be used where a
+// forged value is harmless, such as keying rate limits before calling STS.
+func AccessKeyID(token string) (string, error) {
+	queryParamsLower, err := unverifiedQueryParams(token)
 	if err != nil {
-		return nil, NewSTSError(err.Error())
+		return "", err
+	}
+	credential := queryParamsLower.Get("x-amz-credential")
+	if credential == "" {
+		return "", FormatError{"X-Amz-Credential parameter must be present in pre-signed URL"}
 	}
+	return strings.Split(credential, "/")[0], nil
+}
 
-	id := &Identity{
-		AccessKeyID: accessKeyID,
-		STSEndpoint: parsedURL.Host,
+// Expiration returns the time a token expires, X-Amz-Expires after its
+// X-Amz-Date but no later than the 15 minutes STS accepts it for. Like
+// AccessKeyID, the token is NOT verified.
+func Expiration(token string) (time.Time, error) {
+	queryParamsLower, err := unverifiedQueryParams(token)
+	if err != nil {
+		return time.Time{}, err
 	}
-	return getIdentityFromSTSResponse(id, callerIdentity)
+	date, err := unverifiedDate(queryParamsLower)
+	if err != nil {
+		return time.Time{}, err
+	}
+	expires, err := strconv.Atoi(queryParamsLower.Get("x-amz-expires"))
+	if err != nil || expires < 0 {
+		return time.Time{}, FormatError{"invalid X-Amz-Expires parameter in pre-signed URL"}
+	}
+	if expiration := time.Duration(expires) * time.Second; expiration < presignedURLExpiration {
+		return date.Add(expiration), nil
+	}
+	return date.Add(presignedURLExpiration), nil
+}
+
+// stsExpiration returns the time a token stops being accepted by STS, 15
+// minutes after its X-Amz-Date whatever its X-Amz-Expires. The token is NOT
+// verified.
+func stsExpiration(token string) (time.Time, error) {
+	queryParamsLower, err := unverifiedQueryParams(token)
+	if err != nil {
+		return time.Time{}, err
+	}
+	date, err := unverifiedDate(queryParamsLower)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return date.Add(presignedURLExpiration), nil
+}
+
+// unverifiedDate returns the X-Amz-Date of a token's query parameters
+func unverifiedDate(queryParamsLower url.Values) (time.Time, error) {
+	date := queryParamsLower.Get("x-amz-date")
+	if date == "" {
+		return time.Time{}, FormatError{"X-Amz-Date parameter must be present in pre-signed URL"}
+	}
+	dateParam, err := time.Parse(dateHeaderFormat, date)
+	if err != nil {
+		return time.Time{}, FormatError{fmt.Sprintf("error parsing X-Amz-Date parameter %s into format %s: %s", date, dateHeaderFormat, err.Error())}
+	}
+	return dateParam, nil
+}
+
+// unverifiedQueryParams decodes a token and returns the query parameters of
+// its pre-signed URL with lowercased keys.
+func unverifiedQueryParams(token string) (url.Values, error) {
+	if len(token) > maxTokenLenBytes {
+		return nil, FormatError{"token is too large"}
+	}
+	if !strings.HasPrefix(token, v1Prefix) {
+		return nil, FormatError{fmt.Sprintf("token is missing expected %q prefix", v1Prefix)}
+	}
+	tokenBytes, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(token, v1Prefix))
+	if err != nil {
+		return nil, FormatError{err.Error()}
+	}
+	parsedURL, err := url.Parse(string(tokenBytes))
+	if err != nil {
+		return nil, FormatError{err.Error()}
+	}
+	queryParams, err := url.ParseQuery(parsedURL.RawQuery)
+	if err != nil {
+		return nil, FormatError{"malformed query parameter"}
+	}
+	queryParamsLower := make(url.Values)
+	for key, values := range queryParams {
+		if len(values) != 1 {
+			return nil, FormatError{"query parameter with multiple values not supported"}
+		}
+		queryParamsLower.Set(strings.ToLower(key), values[0])
+	}
+	return queryParamsLower, nil
 }
 
 func getIdentityFromSTSResponse(id *Identity, wrapper getCallerIdentityWrapper) (*Identity, error) {
@@ -683,5 +1027,9 @@ func getStsRegion(host string) (string, error) {
 	if host == "sts.amazonaws.com" {
 		return "global", nil
 	}
+	// interface VPC endpoints, e.g. vpce-0123-abcd.sts.us-east-1.vpce.amazonaws.com
+	if strings.HasPrefix(parts[0], "vpce-") && len(parts) > 3 && parts[1] == "sts" {
+		return parts[2], nil
+	}
 	return parts[1], nil
 }
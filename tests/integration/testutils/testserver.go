@@ -138,6 +138,7 @@ func testConfig(t *testing.T, setup AuthenticatorTestFrameworkSetup) (config.Con
 		GenerateKubeconfigPath: filepath.Join(testDir, "webhook.kubeconfig"),
 		BackendMode:            setup.BackendMode,
 		StateDir:               testDir,
+		AdminAddress:           fmt.Sprintf(":%d", hardcodedHealthcheckPort),
 	}
 
 	if setup.ModifyAuthenticatorServerConfig != nil {